@@ -0,0 +1,142 @@
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLogFields are the fields a JSONAccessLog writes by default
+var AccessLogFields = []string{"timestamp", "client_ip", "method", "url", "host", "status",
+	"bytes_in", "bytes_out", "duration_ms", "mitm", "error"}
+
+// JSONAccessLog writes an access log of the requests going through a proxy, as newline delimited
+// JSON objects, one per request, once its response was sent. The available fields are:
+//
+//	timestamp    the time the request was received, in RFC3339 format
+//	client_ip    the IP of the client, see ClientIP
+//	method       the request method
+//	url          the request URL
+//	host         the request Host header
+//	status       the response status code, 0 if there was no response
+//	bytes_in     the number of bytes of the request body sent
+//	bytes_out    the number of bytes of the response body sent
+//	duration_ms  the time it took to handle the request, in milliseconds
+//	mitm         whether the request was eavesdropped in a CONNECT tunnel
+//	error        the error handling the request, see CtxError, or null
+type JSONAccessLog struct {
+	// Fields are the fields written for every request, in order. Unknown fields are ignored.
+	// AccessLogFields are written if it is empty.
+	Fields []string
+	mu     sync.Mutex
+	w      io.Writer
+}
+
+// NewJSONAccessLog returns a JSONAccessLog writing to w. Register it on a proxy with Register.
+func NewJSONAccessLog(w io.Writer) *JSONAccessLog {
+	return &JSONAccessLog{w: w}
+}
+
+type accessLogEntry struct {
+	start    time.Time
+	req      *http.Request
+	status   int
+	bytesIn  int64
+	bytesOut int64
+}
+
+// countingReader counts the bytes read from an io.ReadCloser into n
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// Register registers handlers on proxy, writing an access log entry for every request. Register it
+// before other handlers, so that requests answered by request handlers are logged too. Response
+// bodies are counted as they are when reaching the access log response handler.
+func (l *JSONAccessLog) Register(proxy *ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		entry := &accessLogEntry{start: time.Now(), req: req}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = countingReader{req.Body, &entry.bytesIn}
+		}
+		req = req.WithContext(context.WithValue(req.Context(), ctxKeyAccessLog, entry))
+		CtxOnFinish(req.Context(), func() {
+			if err := l.write(entry, CtxError(req.Context())); err != nil {
+				proxy.Loggers.Error.Log("event", "access log write", "error", err.Error())
+			}
+		})
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		entry, ok := req.Context().Value(ctxKeyAccessLog).(*accessLogEntry)
+		if !ok || resp == nil {
+			return req, resp
+		}
+		entry.status = resp.StatusCode
+		resp.Body = countingReader{resp.Body, &entry.bytesOut}
+		return req, resp
+	})
+}
+
+func (l *JSONAccessLog) write(entry *accessLogEntry, err error) error {
+	fields := l.Fields
+	if len(fields) == 0 {
+		fields = AccessLogFields
+	}
+	var errValue interface{}
+	if err != nil {
+		errValue = err.Error()
+	}
+	req := entry.req
+	values := map[string]interface{}{
+		"timestamp":   entry.start.Format(time.RFC3339Nano),
+		"client_ip":   ClientIP(req),
+		"method":      req.Method,
+		"url":         req.URL.String(),
+		"host":        req.Host,
+		"status":      entry.status,
+		"bytes_in":    atomic.LoadInt64(&entry.bytesIn),
+		"bytes_out":   atomic.LoadInt64(&entry.bytesOut),
+		"duration_ms": float64(time.Since(entry.start)) / float64(time.Millisecond),
+		"mitm":        CtxConnectRequest(req.Context()) != nil,
+		"error":       errValue,
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	first := true
+	for _, field := range fields {
+		v, ok := values[field]
+		if !ok {
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		k, _ := json.Marshal(field)
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(b)
+	}
+	buf.WriteString("}\n")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = buf.WriteTo(l.w)
+	return err
+}
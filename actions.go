@@ -2,13 +2,15 @@ package goproxy
 
 import (
 	"net/http"
+	"net/url"
 )
 
 // ReqHandler will "tamper" with the request coming to the proxy server
 // If Handle returns req,nil the proxy will send the returned request
 // to the destination server. If it returns nil,resp the proxy will
 // skip sending any requests, and will simply return the response `resp`
-// to the client.
+// to the client. In that case, response handlers will get the last non-nil request,
+// and CtxSynthesized will be true for its context.
 type ReqHandler interface {
 	Handle(req *http.Request) (*http.Request, *http.Response)
 }
@@ -21,6 +23,23 @@ func (f FuncReqHandler) Handle(req *http.Request) (*http.Request, *http.Response
 	return f(req)
 }
 
+// RewritePath returns a ReqHandler letting f rewrite the URL of the request, typically
+// its Path and RawQuery, before it is sent to the destination server. The request is
+// updated so that the rewritten URL is the one sent.
+// Use it with conditions for scoped rewrites, e.g. stripping an API prefix:
+//
+//	proxy.OnRequest(goproxy.UrlHasPrefix("/api/v1/")).Do(goproxy.RewritePath(func(u *url.URL) {
+//		u.Path = strings.TrimPrefix(u.Path, "/api/v1")
+//	}))
+func RewritePath(f func(u *url.URL)) ReqHandler {
+	return FuncReqHandler(func(req *http.Request) (*http.Request, *http.Response) {
+		f(req.URL)
+		// RequestURI must not be set in client requests, and it would hold the original path
+		req.RequestURI = ""
+		return req, nil
+	})
+}
+
 // after the proxy have sent the request to the destination server, it will
 // "filter" the response through the RespHandlers it has.
 // The proxy server will send to the client the response returned by the RespHandler.
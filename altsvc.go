@@ -0,0 +1,69 @@
+package goproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isH3AltSvc returns true if the given Alt-Svc entry advertises HTTP/3 or QUIC,
+// e.g. `h3=":443"; ma=86400` or `h3-29=":443"`.
+func isH3AltSvc(entry string) bool {
+	protocol := strings.TrimSpace(entry)
+	if ix := strings.IndexAny(protocol, "=;"); ix != -1 {
+		protocol = protocol[:ix]
+	}
+	protocol = strings.ToLower(strings.TrimSpace(protocol))
+	return protocol == "h3" || strings.HasPrefix(protocol, "h3-") || strings.HasPrefix(protocol, "quic")
+}
+
+// stripH3AltSvc removes from the Alt-Svc header all entries advertising HTTP/3, leaving
+// other alternative services intact if keepOthers, or the whole header otherwise. Since QUIC
+// runs over UDP, a client following such an advertisement would bypass the proxy altogether.
+func stripH3AltSvc(h http.Header, keepOthers bool) {
+	values := h["Alt-Svc"]
+	if len(values) == 0 {
+		return
+	}
+	if !keepOthers {
+		h.Del("Alt-Svc")
+		return
+	}
+	var kept []string
+	for _, v := range values {
+		for _, entry := range strings.Split(v, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" && !isH3AltSvc(entry) {
+				kept = append(kept, entry)
+			}
+		}
+	}
+	if len(kept) == 0 {
+		h.Del("Alt-Svc")
+		return
+	}
+	h.Set("Alt-Svc", strings.Join(kept, ", "))
+}
+
+// StripH3Advertisement returns a RespHandler removing HTTP/3 advertisements (h3, h3-29, etc.) from
+// the Alt-Svc header of responses, so that browsers keep using the proxy instead of silently
+// upgrading to QUIC. If keepOthers, non HTTP/3 Alt-Svc entries are left intact, otherwise the
+// whole Alt-Svc header is removed. Use it with StripAltUsed.
+//
+//	proxy.OnRequest().Do(goproxy.StripAltUsed)
+//	proxy.OnResponse().Do(goproxy.StripH3Advertisement(true))
+//
+// Setting proxy.StripAltSvc is equivalent to registering both after all other handlers.
+func StripH3Advertisement(keepOthers bool) RespHandler {
+	return FuncRespHandler(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		if resp != nil {
+			stripH3AltSvc(resp.Header, keepOthers)
+		}
+		return req, resp
+	})
+}
+
+// StripAltUsed is a ReqHandler removing the Alt-Used header, with which clients tell origin servers
+// the alternative service they used, from requests.
+var StripAltUsed ReqHandler = FuncReqHandler(func(req *http.Request) (*http.Request, *http.Response) {
+	req.Header.Del("Alt-Used")
+	return req, nil
+})
@@ -0,0 +1,78 @@
+package goproxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// BasicAuthHandler requires clients to authenticate to the proxy with HTTP Basic authentication.
+// It is both a ReqHandler, for proxied requests, and an HttpsHandler, for CONNECT requests.
+type BasicAuthHandler struct {
+	realm    string
+	validate func(user, pass string) bool
+}
+
+// BasicAuth returns a handler answering requests without valid credentials in their
+// Proxy-Authorization header with 407 Proxy Authentication Required. Register it for both
+// proxied and CONNECT requests, before any other handler:
+//
+//	auth := goproxy.BasicAuth("my proxy", goproxy.BasicAuthCredentials("user", "secret"))
+//	proxy.OnRequest().Do(auth)
+//	proxy.OnRequest().HandleConnect(auth)
+//
+// validate should compare the credentials in constant time, as BasicAuthCredentials does.
+// Requests eavesdropped in CONNECT tunnels were authenticated by their CONNECT request, and
+// are let through.
+func BasicAuth(realm string, validate func(user, pass string) bool) *BasicAuthHandler {
+	return &BasicAuthHandler{realm: realm, validate: validate}
+}
+
+// BasicAuthCredentials returns a validate function for BasicAuth, accepting a single user and
+// password. The credentials are compared in constant time.
+func BasicAuthCredentials(user, pass string) func(user, pass string) bool {
+	return func(u, p string) bool {
+		// both are compared, not to tell valid users apart by the time it takes
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+		return userOK && passOK
+	}
+}
+
+func (a *BasicAuthHandler) Handle(req *http.Request) (*http.Request, *http.Response) {
+	if CtxConnectRequest(req.Context()) != nil || a.authenticated(req) {
+		return req, nil
+	}
+	return req, a.unauthorized(req)
+}
+
+func (a *BasicAuthHandler) HandleConnect(req *http.Request, host string) (*http.Request, *ConnectAction, string) {
+	if a.authenticated(req) {
+		// let the next handlers decide what to do with the tunnel
+		return req, nil, host
+	}
+	req = req.WithContext(CtxWithResp(req.Context(), a.unauthorized(req)))
+	return req, RejectConnect, host
+}
+
+// authenticated returns whether the Proxy-Authorization header of req has valid credentials
+func (a *BasicAuthHandler) authenticated(req *http.Request) bool {
+	scheme, credentials, ok := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return false
+	}
+	user, pass, ok := strings.Cut(string(decoded), ":")
+	return ok && a.validate(user, pass)
+}
+
+func (a *BasicAuthHandler) unauthorized(req *http.Request) *http.Response {
+	resp := NewResponse(req, ContentTypeText, http.StatusProxyAuthRequired, "Proxy Authentication Required")
+	realm := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(a.realm)
+	resp.Header.Set("Proxy-Authenticate", `Basic realm="`+realm+`"`)
+	return resp
+}
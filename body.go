@@ -0,0 +1,115 @@
+package goproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// peekedBody is a body that read ahead of orig and was rewound, so it has the bytes of orig
+type peekedBody struct {
+	io.ReadCloser
+	orig io.ReadCloser
+}
+
+// PeekedBody marks body as having the same bytes as orig, e.g. a reader that read ahead of orig
+// and was rewound, such as a regretable reader. When a response handler replaces the body of a
+// response, the proxy drops its Content-Length, since the new body may have another length; a
+// body only peeked at keeps it.
+func PeekedBody(orig, body io.ReadCloser) io.ReadCloser {
+	return &peekedBody{ReadCloser: body, orig: orig}
+}
+
+// unpeekedBody returns the body body was peeked from, see PeekedBody
+func unpeekedBody(body io.ReadCloser) io.ReadCloser {
+	for {
+		p, ok := body.(*peekedBody)
+		if !ok {
+			return body
+		}
+		body = p.orig
+	}
+}
+
+// ErrNegativeBodyLimit is returned by BufferRequestBody when maxBytes is negative
+var ErrNegativeBodyLimit = errors.New("negative body limit")
+
+// BufferRequestBody reads up to maxBytes from the request body, and returns them.
+// The request body is replaced, so that the full original body, starting with the
+// buffered prefix, would still be sent upstream. This allows conditions and handlers
+// to inspect the body without consuming it.
+// If the body is shorter than maxBytes, the whole body is returned.
+// In case of a read error, the bytes read so far are returned with the error, and
+// the request body still starts with them.
+// A negative maxBytes returns ErrNegativeBodyLimit, leaving the request body untouched.
+func BufferRequestBody(req *http.Request, maxBytes int) ([]byte, error) {
+	if maxBytes < 0 {
+		return nil, ErrNegativeBodyLimit
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	buf := make([]byte, maxBytes)
+	n, err := io.ReadFull(req.Body, buf)
+	buf = buf[:n]
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	prefix := make([]byte, n)
+	copy(prefix, buf)
+	req.Body = readCloser{io.MultiReader(bytes.NewReader(prefix), req.Body), req.Body}
+	return buf, err
+}
+
+// ProgressInterval is the minimal time between calls of a WithProgress callback, other than the last
+var ProgressInterval = 100 * time.Millisecond
+
+// progressReader reports the progress of reading a body, see WithProgress
+type progressReader struct {
+	io.ReadCloser
+	read, total int64
+	last        time.Time
+	cb          func(read, total int64)
+	done        bool
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	if r.done {
+		return n, err
+	}
+	if err != nil {
+		r.done = true
+		r.cb(r.read, r.total)
+	} else if now := time.Now(); n > 0 && now.Sub(r.last) >= ProgressInterval {
+		r.last = now
+		r.cb(r.read, r.total)
+	}
+	return n, err
+}
+
+// WithProgress replaces the body of resp with a reader calling cb with the number of bytes read so
+// far, as the response is copied to the client. total is resp.ContentLength, -1 if unknown. cb is
+// called at most every ProgressInterval, and once more at the end of the body, or on a read error.
+// The body bytes are not altered.
+//
+//	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+//		goproxy.WithProgress(resp, func(read, total int64) {
+//			log.Printf("%s: %d/%d", req.URL, read, total)
+//		})
+//		return req, resp
+//	})
+func WithProgress(resp *http.Response, cb func(read, total int64)) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+	resp.Body = &progressReader{ReadCloser: resp.Body, total: resp.ContentLength, last: time.Now(), cb: cb}
+}
@@ -0,0 +1,276 @@
+package goproxy_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy2"
+)
+
+func TestBufferRequestBody(t *testing.T) {
+	body := []byte("0123456789")
+	for _, maxBytes := range []int{5, len(body), 20} {
+		req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(body))
+		fatalOnErr(err, "NewRequest", t)
+		b, err := goproxy.BufferRequestBody(req, maxBytes)
+		fatalOnErr(err, "BufferRequestBody", t)
+		expected := body
+		if maxBytes < len(body) {
+			expected = body[:maxBytes]
+		}
+		if !bytes.Equal(b, expected) {
+			t.Errorf("maxBytes %d: expected buffered %q, got %q", maxBytes, expected, b)
+		}
+		rest, err := ioutil.ReadAll(req.Body)
+		fatalOnErr(err, "ReadAll", t)
+		if !bytes.Equal(rest, body) {
+			t.Errorf("maxBytes %d: expected full body %q upstream, got %q", maxBytes, body, rest)
+		}
+	}
+}
+
+func TestBufferRequestBodyNegativeLimit(t *testing.T) {
+	body := []byte("0123456789")
+	req, err := http.NewRequest("POST", "http://example.com", bytes.NewReader(body))
+	fatalOnErr(err, "NewRequest", t)
+	if b, err := goproxy.BufferRequestBody(req, -1); err != goproxy.ErrNegativeBodyLimit || b != nil {
+		t.Errorf("Expected ErrNegativeBodyLimit for a negative limit, got %q, %v", b, err)
+	}
+	rest, err := ioutil.ReadAll(req.Body)
+	fatalOnErr(err, "ReadAll", t)
+	if !bytes.Equal(rest, body) {
+		t.Errorf("Expected body %q to be untouched, got %q", body, rest)
+	}
+}
+
+func TestBufferRequestBodyReachesServer(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		if _, err := goproxy.BufferRequestBody(req, 3); err != nil {
+			t.Error("Cannot buffer request body", err)
+		}
+		return req, nil
+	})
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Post(srv.URL+"/query", "application/x-www-form-urlencoded", bytes.NewBufferString("result=bufferedbody"))
+	fatalOnErr(err, "Post", t)
+	if b := string(readAll(resp.Body, t)); b != "bufferedbody" {
+		t.Error("Expected body to reach server intact, got", b)
+	}
+}
+
+func TestWithProgress(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 100000)
+	resp := &http.Response{Body: ioutil.NopCloser(bytes.NewReader(body)), ContentLength: int64(len(body))}
+	var calls [][2]int64
+	goproxy.WithProgress(resp, func(read, total int64) {
+		calls = append(calls, [2]int64{read, total})
+	})
+	b, err := ioutil.ReadAll(resp.Body)
+	fatalOnErr(err, "ReadAll", t)
+	if !bytes.Equal(b, body) {
+		t.Error("Expected body to be unaltered")
+	}
+	if len(calls) == 0 || calls[len(calls)-1] != [2]int64{int64(len(body)), int64(len(body))} {
+		t.Error("Expected a final progress call with the full length, got", calls)
+	}
+}
+
+func TestSpillBuffer(t *testing.T) {
+	for _, size := range []int{10, 100} {
+		buf := goproxy.NewSpillBuffer(50)
+		data := bytes.Repeat([]byte("x"), size)
+		// written in two parts, to cross the threshold in the middle
+		buf.Write(data[:size/2])
+		buf.Write(data[size/2:])
+		if buf.Len() != int64(size) {
+			t.Errorf("Expected length %d, got %d", size, buf.Len())
+		}
+		if spilled := buf.Spilled(); spilled != (size > 50) {
+			t.Errorf("Expected %d bytes to spill to disk: %v, got %v", size, size > 50, spilled)
+		}
+		if b := readAll(buf, t); !bytes.Equal(b, data) {
+			t.Errorf("Expected the written bytes back, got %q", b)
+		}
+		if _, err := buf.Write([]byte("x")); err == nil {
+			t.Error("Expected writing after reading to fail")
+		}
+		fatalOnErr(buf.Close(), "Close", t)
+	}
+}
+
+func TestSpillBufferRemovesFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	buf := goproxy.NewSpillBuffer(1)
+	buf.Write([]byte("spilled"))
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Fatal("Expected a temporary file, got", files)
+	}
+	fatalOnErr(buf.Close(), "Close", t)
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Error("Expected the temporary file to be removed, got", files)
+	}
+}
+
+func TestTransformResponseBody(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("panda"))}
+	err := goproxy.TransformResponseBody(resp, 2, func(dst io.Writer, src io.Reader) error {
+		b, err := ioutil.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(dst, strings.ToUpper(string(b)))
+		return err
+	})
+	fatalOnErr(err, "TransformResponseBody", t)
+	if b := string(readAll(resp.Body, t)); b != "PANDA" {
+		t.Errorf("Expected the transformed body, got %q", b)
+	}
+	if resp.ContentLength != 5 || resp.Header.Get("Content-Length") != "5" {
+		t.Error("Expected the length of the transformed body, got", resp.ContentLength, resp.Header.Get("Content-Length"))
+	}
+	resp.Body.Close()
+}
+
+func TestHandleBody(t *testing.T) {
+	compress := func(w io.WriteCloser, buf *bytes.Buffer) []byte {
+		io.WriteString(w, "hello cloud")
+		w.Close()
+		return buf.Bytes()
+	}
+	var gz, zl, fl bytes.Buffer
+	rawFlate, _ := flate.NewWriter(&fl, flate.DefaultCompression)
+	for _, tc := range []struct {
+		encoding string
+		body     []byte
+		handled  bool
+	}{
+		{"", []byte("hello cloud"), true},
+		{"gzip", compress(gzip.NewWriter(&gz), &gz), true},
+		{"deflate", compress(zlib.NewWriter(&zl), &zl), true},
+		{"deflate", compress(rawFlate, &fl), true},
+		{"br", []byte("not really brotli"), false},
+	} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		resp := &http.Response{Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(tc.body)), ContentLength: int64(len(tc.body))}
+		if tc.encoding != "" {
+			resp.Header.Set("Content-Encoding", tc.encoding)
+		}
+		called := false
+		_, resp = goproxy.HandleBody(func(req *http.Request, body []byte) []byte {
+			called = true
+			return bytes.ReplaceAll(body, []byte("cloud"), []byte("butt"))
+		}).Handle(req, resp)
+		if called != tc.handled {
+			t.Errorf("%s: expected the handler to be called: %v", tc.encoding, tc.handled)
+		}
+		body := readAll(resp.Body, t)
+		if resp.ContentLength != int64(len(body)) {
+			t.Errorf("%s: expected Content-Length %d, got %d", tc.encoding, len(body), resp.ContentLength)
+		}
+		if !tc.handled {
+			if !bytes.Equal(body, tc.body) {
+				t.Errorf("%s: expected the body to be untouched, got %q", tc.encoding, body)
+			}
+			continue
+		}
+		var r io.Reader = bytes.NewReader(body)
+		switch tc.encoding {
+		case "gzip":
+			r, _ = gzip.NewReader(r)
+		case "deflate":
+			r, _ = zlib.NewReader(r)
+		}
+		if plain := string(readAll(r, t)); plain != "hello butt" {
+			t.Errorf("%s: expected the body to be rewritten and encoded again, got %q", tc.encoding, plain)
+		}
+	}
+}
+
+func TestHandleBodyLimit(t *testing.T) {
+	var bomb bytes.Buffer
+	gz := gzip.NewWriter(&bomb)
+	gz.Write(make([]byte, 1000))
+	gz.Close()
+	large := bytes.Repeat([]byte("cloud "), 20)
+	for _, tc := range []struct {
+		name          string
+		encoding      string
+		body          []byte
+		contentLength int64
+	}{
+		{"known length", "", large, int64(len(large))},
+		{"unknown length", "", large, -1},
+		{"decompression bomb", "gzip", bomb.Bytes(), int64(bomb.Len())},
+	} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		resp := &http.Response{Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(tc.body)), ContentLength: tc.contentLength}
+		if tc.encoding != "" {
+			resp.Header.Set("Content-Encoding", tc.encoding)
+		}
+		called := false
+		_, resp = goproxy.HandleBodyLimit(100, func(req *http.Request, body []byte) []byte {
+			called = true
+			return body
+		}).Handle(req, resp)
+		if called {
+			t.Errorf("%s: expected the handler not to be called for a body over the limit", tc.name)
+		}
+		if body := readAll(resp.Body, t); !bytes.Equal(body, tc.body) {
+			t.Errorf("%s: expected the body to be passed on untouched, got %d bytes", tc.name, len(body))
+		}
+		if resp.ContentLength != tc.contentLength {
+			t.Errorf("%s: expected Content-Length %d to be kept, got %d", tc.name, tc.contentLength, resp.ContentLength)
+		}
+	}
+}
+
+func TestRegisterBodyEncoding(t *testing.T) {
+	goproxy.RegisterBodyEncoding("x-base64", goproxy.BodyEncoding{
+		NewReader: func(r io.Reader) (io.Reader, error) { return base64.NewDecoder(base64.StdEncoding, r), nil },
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return base64.NewEncoder(base64.StdEncoding, w), nil },
+	})
+	body := base64.StdEncoding.EncodeToString([]byte("hello cloud"))
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp := &http.Response{Header: http.Header{"Content-Encoding": {"x-base64"}}, Body: ioutil.NopCloser(strings.NewReader(body))}
+	_, resp = goproxy.HandleBody(func(req *http.Request, body []byte) []byte {
+		return bytes.ReplaceAll(body, []byte("cloud"), []byte("butt"))
+	}).Handle(req, resp)
+	if got := string(readAll(resp.Body, t)); got != base64.StdEncoding.EncodeToString([]byte("hello butt")) {
+		t.Error("Expected the body to be decoded, rewritten and encoded with the registered encoding, got", got)
+	}
+
+	req.Header.Set("Accept-Encoding", "x-base64, br")
+	if req, _ = goproxy.AcceptSupportedEncodings.Handle(req); req.Header.Get("Accept-Encoding") != "x-base64" {
+		t.Error("Expected the registered encoding to be accepted, got", req.Header.Get("Accept-Encoding"))
+	}
+}
+
+func TestAcceptSupportedEncodings(t *testing.T) {
+	for accept, expected := range map[string]string{
+		"gzip, deflate, br":       "gzip, deflate",
+		"br;q=1.0, gzip;q=0.8, *": "gzip;q=0.8",
+		"br, zstd":                "",
+		"identity":                "identity",
+	} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		req, _ = goproxy.AcceptSupportedEncodings.Handle(req)
+		if got := req.Header.Get("Accept-Encoding"); got != expected {
+			t.Errorf("Expected Accept-Encoding %q for %q, got %q", expected, accept, got)
+		}
+	}
+}
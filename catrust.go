@@ -0,0 +1,111 @@
+package goproxy
+
+import (
+	"html"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultHandshakeFailureMaxAge is the MaxAge of HandshakeFailures returned by NewHandshakeFailures
+const DefaultHandshakeFailureMaxAge = time.Hour
+
+// HandshakeFailures tracks clients failing the TLS handshake of eavesdropped CONNECT tunnels,
+// which usually means they did not install the proxy CA. Browsers show a generic error in this
+// case, and HTTP cannot be sent before the handshake, so instead, the next plain HTTP request
+// of such a client can be answered with a page guiding the user to install the CA:
+//
+//	failures := goproxy.NewHandshakeFailures(3)
+//	failures.Track(proxy)
+//	proxy.OnRequest(failures).Do(failures.CAInstallPage("http://example.com/ca.pem"))
+//
+// Clients are identified by ClientIP.
+type HandshakeFailures struct {
+	// MaxAge is how long the failures of a client are kept after its last failure, so clients
+	// that never get to see the CA install page are eventually forgotten. Set it before Track.
+	MaxAge    time.Duration
+	threshold int
+	mu        sync.Mutex
+	counts    map[string]*handshakeFailure
+	swept     time.Time
+}
+
+type handshakeFailure struct {
+	count int
+	last  time.Time
+}
+
+// NewHandshakeFailures returns a HandshakeFailures matching clients that failed at least threshold
+// handshakes since they were last shown the CA install page, and no longer than
+// DefaultHandshakeFailureMaxAge ago.
+func NewHandshakeFailures(threshold int) *HandshakeFailures {
+	return &HandshakeFailures{MaxAge: DefaultHandshakeFailureMaxAge, threshold: threshold,
+		counts: make(map[string]*handshakeFailure)}
+}
+
+// record counts a handshake failure of ip at now, forgetting the clients whose failures expired
+// every MaxAge, so the clients tracked are at most the ones failing in the last two MaxAge.
+func (f *HandshakeFailures) record(ip string, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now.Sub(f.swept) >= f.MaxAge {
+		for client, failure := range f.counts {
+			if now.Sub(failure.last) >= f.MaxAge {
+				delete(f.counts, client)
+			}
+		}
+		f.swept = now
+	}
+	failure := f.counts[ip]
+	if failure == nil || now.Sub(failure.last) >= f.MaxAge {
+		failure = &handshakeFailure{}
+		f.counts[ip] = failure
+	}
+	failure.count++
+	failure.last = now
+}
+
+// Track makes f record the handshake failures of proxy, by chaining proxy.OnMitmHandshakeError.
+func (f *HandshakeFailures) Track(proxy *ProxyHttpServer) {
+	next := proxy.OnMitmHandshakeError
+	proxy.OnMitmHandshakeError = func(connect *http.Request, err error) {
+		f.record(ClientIP(connect), time.Now())
+		if next != nil {
+			next(connect, err)
+		}
+	}
+}
+
+// HandleReq returns true for plain HTTP requests, that is not eavesdropped, of clients that failed
+// enough handshakes.
+func (f *HandshakeFailures) HandleReq(req *http.Request) bool {
+	if req.URL.Scheme != "http" || CtxConnectHost(req.Context()) != "" {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	failure := f.counts[ClientIP(req)]
+	return failure != nil && failure.count >= f.threshold && time.Since(failure.last) < f.MaxAge
+}
+
+// HandleResp is HandleReq, it allows using HandshakeFailures as a RespCondition.
+func (f *HandshakeFailures) HandleResp(req *http.Request, resp *http.Response) bool {
+	return f.HandleReq(req)
+}
+
+// CAInstallPage returns a ReqHandler answering with a page explaining the client's secure
+// connections fail, and linking to caURL to download the proxy CA. The failures of the client
+// are forgotten, so the page is shown once per threshold failures.
+func (f *HandshakeFailures) CAInstallPage(caURL string) ReqHandler {
+	return FuncReqHandler(func(req *http.Request) (*http.Request, *http.Response) {
+		f.mu.Lock()
+		delete(f.counts, ClientIP(req))
+		f.mu.Unlock()
+		return req, NewResponse(req, ContentTypeHtml, http.StatusOK,
+			`<html><head><title>Install the proxy certificate</title></head><body>`+
+				`<h1>Secure connections through this proxy fail</h1>`+
+				`<p>Your device does not trust the certificate authority of this proxy, so HTTPS sites cannot be opened.</p>`+
+				`<p><a href="`+html.EscapeString(caURL)+`">Download the certificate</a>, install it as a trusted root certificate, and retry.</p>`+
+				`</body></html>`)
+	})
+}
@@ -0,0 +1,29 @@
+package goproxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHandshakeFailuresExpire(t *testing.T) {
+	f := NewHandshakeFailures(1)
+	f.MaxAge = time.Minute
+	now := time.Now()
+	f.record("10.0.0.1", now.Add(-2*time.Minute))
+	f.record("10.0.0.2", now)
+	if len(f.counts) != 1 || f.counts["10.0.0.2"] == nil {
+		t.Errorf("Expected only the recent failure to be kept, got %v", f.counts)
+	}
+
+	f.record("10.0.0.3", now.Add(-2*time.Minute))
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "10.0.0.3:1234"
+	if f.HandleReq(req) {
+		t.Error("Expected expired failures not to match")
+	}
+	req.RemoteAddr = "10.0.0.2:1234"
+	if !f.HandleReq(req) {
+		t.Error("Expected recent failures to match")
+	}
+}
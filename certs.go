@@ -108,4 +108,8 @@ cj/azKBaT04IOMLaN8xfSqitJYSraWMVNgGJM5vfcVaivZnNh0lZBv+qu6YkdM88
 4/avCJ8IutT+FcMM+GbGazOm5ALWqUyhrnbLGc4CQMPfe7Il6NxwcrOxT8w=
 -----END RSA PRIVATE KEY-----`)
 
+// GoproxyCa is the builtin CA, which New sets as the CA of proxies.
+//
+// Deprecated: set ProxyHttpServer.CA to forge certificates with another CA, instead of
+// replacing GoproxyCa, which affects all the proxies of the process.
 var GoproxyCa, goproxyCaErr = tls.X509KeyPair(CA_CERT, CA_KEY)
@@ -0,0 +1,135 @@
+package goproxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultCertStoreSize is the number of certificates kept by the CertStore of New
+const DefaultCertStoreSize = 1000
+
+// CertStore keeps the certificates TLSConfigFromCA forges, so that they are signed once per
+// set of hosts, and not on every eavesdropped CONNECT. Certificates are stored by the fingerprint
+// of the CA that signed them, see CAFingerprint, and the hosts they are valid for, so a store may
+// be shared by proxies forging certificates with different CAs.
+// Implementations must be safe for concurrent use.
+type CertStore interface {
+	// Get returns the certificate signed by the CA with the fingerprint ca for hosts, and false
+	// if there is none
+	Get(ca string, hosts []string) (tls.Certificate, bool)
+	// Put stores cert as the certificate signed by the CA with the fingerprint ca for hosts
+	Put(ca string, hosts []string, cert tls.Certificate)
+}
+
+// CAFingerprint returns the hex encoded SHA-256 of the certificate of ca, which CertStore
+// implementations key the certificates it signed by.
+func CAFingerprint(ca *tls.Certificate) string {
+	if len(ca.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(ca.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// certStoreKey returns the key of the certificate signed by ca for hosts, regardless of their order
+func certStoreKey(ca string, hosts []string) string {
+	c := make([]string, len(hosts))
+	copy(c, hosts)
+	sort.Strings(c)
+	return ca + "/" + strings.Join(c, ",")
+}
+
+type lruCertStore struct {
+	mu      sync.Mutex
+	maxSize int
+	order   *list.List
+	certs   map[string]*list.Element
+}
+
+type lruCertEntry struct {
+	key  string
+	cert tls.Certificate
+}
+
+// NewLRUCertStore returns an in memory CertStore keeping at most maxSize certificates, evicting
+// the least recently used one when full.
+func NewLRUCertStore(maxSize int) CertStore {
+	return &lruCertStore{maxSize: maxSize, order: list.New(), certs: make(map[string]*list.Element)}
+}
+
+func (s *lruCertStore) Get(ca string, hosts []string) (tls.Certificate, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.certs[certStoreKey(ca, hosts)]
+	if !ok {
+		return tls.Certificate{}, false
+	}
+	s.order.MoveToFront(e)
+	return e.Value.(*lruCertEntry).cert, true
+}
+
+func (s *lruCertStore) Put(ca string, hosts []string, cert tls.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := certStoreKey(ca, hosts)
+	if e, ok := s.certs[key]; ok {
+		e.Value.(*lruCertEntry).cert = cert
+		s.order.MoveToFront(e)
+		return
+	}
+	s.certs[key] = s.order.PushFront(&lruCertEntry{key: key, cert: cert})
+	for s.order.Len() > s.maxSize {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.certs, oldest.Value.(*lruCertEntry).key)
+	}
+}
+
+// certCall is a certificate being signed, waited for by concurrent CONNECTs to the same hosts
+type certCall struct {
+	done chan struct{}
+	cert tls.Certificate
+	err  error
+}
+
+// storedCert returns the certificate signed by ca for hosts from proxy.CertStore, calling sign and
+// storing its result if there is none. Concurrent calls for the same CA and hosts wait for a
+// single call of sign.
+func (proxy *ProxyHttpServer) storedCert(ca *tls.Certificate, hosts []string, sign func() (tls.Certificate, error)) (tls.Certificate, error) {
+	store := proxy.CertStore
+	if store == nil {
+		return sign()
+	}
+	fingerprint := CAFingerprint(ca)
+	if cert, ok := store.Get(fingerprint, hosts); ok {
+		return cert, nil
+	}
+	key := certStoreKey(fingerprint, hosts)
+	proxy.certCallsMu.Lock()
+	if call, ok := proxy.certCalls[key]; ok {
+		proxy.certCallsMu.Unlock()
+		<-call.done
+		return call.cert, call.err
+	}
+	if proxy.certCalls == nil {
+		proxy.certCalls = make(map[string]*certCall)
+	}
+	call := &certCall{done: make(chan struct{})}
+	proxy.certCalls[key] = call
+	proxy.certCallsMu.Unlock()
+
+	call.cert, call.err = sign()
+	if call.err == nil {
+		store.Put(fingerprint, hosts, call.cert)
+	}
+	proxy.certCallsMu.Lock()
+	delete(proxy.certCalls, key)
+	proxy.certCallsMu.Unlock()
+	close(call.done)
+	return call.cert, call.err
+}
@@ -0,0 +1,53 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+)
+
+// WeakCipherSuites returns the IDs of the cipher suites considered weak: the ones crypto/tls
+// deems insecure, such as RC4 and 3DES, and the CBC mode ones.
+func WeakCipherSuites() []uint16 {
+	var ids []uint16
+	for _, s := range tls.InsecureCipherSuites() {
+		ids = append(ids, s.ID)
+	}
+	for _, s := range tls.CipherSuites() {
+		if strings.Contains(s.Name, "_CBC_") {
+			ids = append(ids, s.ID)
+		}
+	}
+	return ids
+}
+
+// ClientCipherSuiteIn returns a ReqCondition testing whether the client negotiated one of the
+// given cipher suites with the proxy. Only requests eavesdropped in a TLS tunnel, whose req.TLS
+// holds the connection state of the client, can match.
+func ClientCipherSuiteIn(suites ...uint16) ReqConditionFunc {
+	return func(req *http.Request) bool {
+		if req.TLS == nil {
+			return false
+		}
+		for _, s := range suites {
+			if req.TLS.CipherSuite == s {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RejectWeakCipherSuites is a ReqHandler answering 403 Forbidden to requests eavesdropped in
+// TLS tunnels whose client negotiated one of the WeakCipherSuites. Other requests are let
+// through:
+//
+//	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+//	proxy.OnRequest().Do(goproxy.RejectWeakCipherSuites)
+var RejectWeakCipherSuites ReqHandler = FuncReqHandler(func(req *http.Request) (*http.Request, *http.Response) {
+	if !ClientCipherSuiteIn(WeakCipherSuites()...)(req) {
+		return req, nil
+	}
+	return req, NewResponse(req, ContentTypeText, http.StatusForbidden,
+		"Forbidden: the client negotiated a weak TLS cipher suite "+tls.CipherSuiteName(req.TLS.CipherSuite))
+})
@@ -0,0 +1,102 @@
+package goproxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// coalescedHeaders are the request headers, on top of the method and URL, that must be equal for
+// requests to be coalesced, as responses commonly vary by them
+var coalescedHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie"}
+
+// coalescedCall is an in flight request, whose response is shared by identical requests
+type coalescedCall struct {
+	done chan struct{}
+	resp *http.Response
+	body []byte
+	err  error
+}
+
+// coalescingRoundTripper sends concurrent identical GET requests once, see CoalesceRequests
+type coalescingRoundTripper struct {
+	rt    http.RoundTripper
+	mu    *sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// CoalesceRequests returns a ReqHandler making concurrent identical GET requests share a single
+// request to the origin server, e.g. to avoid a thundering herd of clients fetching the same
+// resource. Requests are identical if their URL and their Accept, Accept-Encoding,
+// Accept-Language, Authorization and Cookie headers are equal. The shared response body is read
+// to memory, so scope it to small resources with conditions:
+//
+//	proxy.OnRequest(goproxy.UrlHasPrefix("example.com/static/")).Do(goproxy.CoalesceRequests())
+//
+// Each call returns a handler with its own set of in flight requests. If the first of the
+// identical requests fails, e.g. because its client went away, all of them fail.
+func CoalesceRequests() ReqHandler {
+	mu := &sync.Mutex{}
+	calls := make(map[string]*coalescedCall)
+	return FuncReqHandler(func(req *http.Request) (*http.Request, *http.Response) {
+		rt := &coalescingRoundTripper{CtxRoundTripper(req.Context()), mu, calls}
+		return req.WithContext(CtxWithRoundTripper(req.Context(), rt)), nil
+	})
+}
+
+func coalesceKey(req *http.Request) string {
+	var key strings.Builder
+	key.WriteString(req.URL.String())
+	for _, h := range coalescedHeaders {
+		key.WriteString("\n" + strings.Join(req.Header[h], ","))
+	}
+	return key.String()
+}
+
+func (c *coalescingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" || (req.Body != nil && req.Body != http.NoBody) {
+		return c.rt.RoundTrip(req)
+	}
+	key := coalesceKey(req)
+	c.mu.Lock()
+	call, ok := c.calls[key]
+	if ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		return call.response(req)
+	}
+	call = &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	call.resp, call.err = c.rt.RoundTrip(req)
+	if call.err == nil {
+		call.body, call.err = ioutil.ReadAll(call.resp.Body)
+		call.resp.Body.Close()
+	}
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(call.done)
+	return call.response(req)
+}
+
+// response returns a copy of the shared response, for req
+func (call *coalescedCall) response(req *http.Request) (*http.Response, error) {
+	if call.err != nil {
+		return nil, call.err
+	}
+	resp := *call.resp
+	resp.Header = call.resp.Header.Clone()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(call.body))
+	resp.ContentLength = int64(len(call.body))
+	resp.TransferEncoding = nil
+	resp.Request = req
+	return &resp, nil
+}
@@ -0,0 +1,121 @@
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var errUnexpectedIdleData = errors.New("idle connection received unexpected data")
+
+// ConnPool keeps idle connections to origin servers of ConnectHTTPMitm tunnels, so that a later
+// CONNECT to the same host:port reuses them instead of dialing. It is safe for concurrent use.
+type ConnPool struct {
+	maxIdlePerHost int
+	idleTimeout    time.Duration
+	mu             sync.Mutex
+	idle           map[string][]*idleConn
+}
+
+type idleConn struct {
+	net.Conn
+	timer *time.Timer
+	// watched is closed once the read watching the idle connection returned, with readErr
+	watched chan struct{}
+	readErr error
+}
+
+// watch reads from the idle connection, to find out that the origin server closed it. Get stops
+// the read with a deadline.
+func (p *ConnPool) watch(host string, ic *idleConn) {
+	var b [1]byte
+	n, err := ic.Conn.Read(b[:])
+	if err == nil && n > 0 {
+		err = errUnexpectedIdleData
+	}
+	ic.readErr = err
+	close(ic.watched)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		p.evict(host, ic)
+	}
+}
+
+// NewConnPool returns a ConnPool keeping up to maxIdlePerHost idle connections per host:port,
+// each for at most idleTimeout. A non positive idleTimeout keeps them until the origin closes them.
+func NewConnPool(maxIdlePerHost int, idleTimeout time.Duration) *ConnPool {
+	return &ConnPool{maxIdlePerHost: maxIdlePerHost, idleTimeout: idleTimeout, idle: make(map[string][]*idleConn)}
+}
+
+// Get returns an idle connection to host, and nil if there is none. Connections the origin server
+// closed while idle are discarded.
+func (p *ConnPool) Get(host string) net.Conn {
+	for {
+		p.mu.Lock()
+		conns := p.idle[host]
+		if len(conns) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		// the most recently used connection is the least likely to be closed by the origin
+		c := conns[len(conns)-1]
+		p.idle[host] = conns[:len(conns)-1]
+		p.mu.Unlock()
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		c.Conn.SetReadDeadline(time.Now())
+		<-c.watched
+		c.Conn.SetReadDeadline(time.Time{})
+		if nerr, ok := c.readErr.(net.Error); ok && nerr.Timeout() {
+			return c.Conn
+		}
+		c.Close()
+	}
+}
+
+// Put makes c, a connection to host with no request in flight, available to Get. It is closed
+// if host already has maxIdlePerHost idle connections.
+func (p *ConnPool) Put(host string, c net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[host]) >= p.maxIdlePerHost {
+		c.Close()
+		return
+	}
+	ic := &idleConn{Conn: c, watched: make(chan struct{})}
+	if p.idleTimeout > 0 {
+		ic.timer = time.AfterFunc(p.idleTimeout, func() { p.evict(host, ic) })
+	}
+	p.idle[host] = append(p.idle[host], ic)
+	go p.watch(host, ic)
+}
+
+// evict closes ic, if it is still idle
+func (p *ConnPool) evict(host string, ic *idleConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[host]
+	for i, c := range conns {
+		if c == ic {
+			p.idle[host] = append(conns[:i], conns[i+1:]...)
+			c.Close()
+			return
+		}
+	}
+}
+
+// CloseIdle closes all the idle connections
+func (p *ConnPool) CloseIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for host, conns := range p.idle {
+		for _, c := range conns {
+			if c.timer != nil {
+				c.timer.Stop()
+			}
+			c.Close()
+		}
+		delete(p.idle, host)
+	}
+}
@@ -0,0 +1,85 @@
+package goproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// RewriteRequestCookies returns a ReqHandler replacing the cookies a request sends with the ones
+// returned by f, given the parsed Cookie headers. Cookies f drops are not sent, and the Cookie
+// header is removed if it drops them all.
+//
+//	proxy.OnRequest().Do(goproxy.RewriteRequestCookies(func(cookies []*http.Cookie) []*http.Cookie {
+//		kept := cookies[:0]
+//		for _, c := range cookies {
+//			if c.Name != "_ga" {
+//				kept = append(kept, c)
+//			}
+//		}
+//		return kept
+//	}))
+func RewriteRequestCookies(f func([]*http.Cookie) []*http.Cookie) ReqHandler {
+	return FuncReqHandler(func(req *http.Request) (*http.Request, *http.Response) {
+		if len(req.Header["Cookie"]) == 0 {
+			return req, nil
+		}
+		cookies := f(req.Cookies())
+		req.Header.Del("Cookie")
+		if len(cookies) == 0 {
+			return req, nil
+		}
+		pairs := make([]string, 0, len(cookies))
+		for _, c := range cookies {
+			// only the name and value of request cookies are sent
+			pairs = append(pairs, (&http.Cookie{Name: c.Name, Value: c.Value, Quoted: c.Quoted}).String())
+		}
+		req.Header.Set("Cookie", strings.Join(pairs, "; "))
+		return req, nil
+	})
+}
+
+// RewriteResponseCookies returns a RespHandler replacing the cookies a response sets with the
+// ones returned by f, given the parsed Set-Cookie headers, one per cookie. Cookies are written
+// back with their attributes, including the ones net/http does not know, which it keeps in
+// Cookie.Unparsed. Set-Cookie headers net/http cannot parse are not passed to f, and are kept as is.
+//
+//	proxy.OnResponse().Do(goproxy.RewriteResponseCookies(func(cookies []*http.Cookie) []*http.Cookie {
+//		for _, c := range cookies {
+//			c.Secure = true
+//		}
+//		return cookies
+//	}))
+func RewriteResponseCookies(f func([]*http.Cookie) []*http.Cookie) RespHandler {
+	return FuncRespHandler(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		if resp == nil || len(resp.Header["Set-Cookie"]) == 0 {
+			return req, resp
+		}
+		var cookies []*http.Cookie
+		var unparseable []string
+		for _, line := range resp.Header["Set-Cookie"] {
+			if c, err := http.ParseSetCookie(line); err == nil {
+				cookies = append(cookies, c)
+			} else {
+				unparseable = append(unparseable, line)
+			}
+		}
+		cookies = f(cookies)
+		resp.Header.Del("Set-Cookie")
+		for _, line := range unparseable {
+			// not to lose what net/http cannot parse, the line is sent as is
+			resp.Header.Add("Set-Cookie", line)
+		}
+		for _, c := range cookies {
+			v := c.String()
+			if v == "" {
+				// invalid cookie name
+				continue
+			}
+			for _, attr := range c.Unparsed {
+				v += "; " + attr
+			}
+			resp.Header.Add("Set-Cookie", v)
+		}
+		return req, resp
+	})
+}
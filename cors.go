@@ -0,0 +1,81 @@
+package goproxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReqIsCORSPreflight checks whether the request is a CORS preflight request, that is, an OPTIONS
+// request with Origin and Access-Control-Request-Method headers.
+var ReqIsCORSPreflight ReqConditionFunc = func(req *http.Request) bool {
+	return req.Method == "OPTIONS" &&
+		req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// CORSConfig describes the cross origin requests the proxy allows when answering CORS preflights
+type CORSConfig struct {
+	// AllowedOrigins are the origins allowed, "*" allows any origin
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	// AllowCredentials sets Access-Control-Allow-Credentials
+	AllowCredentials bool
+	// MaxAge is the time the browser may cache the preflight response, if not zero
+	MaxAge time.Duration
+}
+
+func (config *CORSConfig) allowsOrigin(origin string) bool {
+	for _, o := range config.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORSPreflightResponse returns a response to the CORS preflight request req, allowing the cross
+// origin request according to config. If the origin of req is not allowed, the response is
+// 403 Forbidden.
+func CORSPreflightResponse(req *http.Request, config CORSConfig) *http.Response {
+	origin := req.Header.Get("Origin")
+	if !config.allowsOrigin(origin) {
+		return NewResponse(req, ContentTypeText, http.StatusForbidden, "CORS origin not allowed")
+	}
+	resp := NewResponse(req, ContentTypeText, http.StatusNoContent, "")
+	resp.Header.Del("Content-Type")
+	resp.Header.Set("Access-Control-Allow-Origin", origin)
+	resp.Header.Add("Vary", "Origin")
+	if len(config.AllowedMethods) > 0 {
+		resp.Header.Set("Access-Control-Allow-Methods", strings.Join(config.AllowedMethods, ", "))
+	}
+	if len(config.AllowedHeaders) > 0 {
+		resp.Header.Set("Access-Control-Allow-Headers", strings.Join(config.AllowedHeaders, ", "))
+	}
+	if config.AllowCredentials {
+		resp.Header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if config.MaxAge > 0 {
+		resp.Header.Set("Access-Control-Max-Age", strconv.Itoa(int(config.MaxAge/time.Second)))
+	}
+	return resp
+}
+
+// AnswerCORSPreflight returns a ReqHandler answering CORS preflight requests directly from the proxy,
+// so that the proxy can act as a CORS shim in front of APIs not supporting CORS.
+//
+//	proxy.OnRequest(goproxy.DstHostIs("api.example.com"), goproxy.ReqIsCORSPreflight).Do(
+//		goproxy.AnswerCORSPreflight(goproxy.CORSConfig{
+//			AllowedOrigins: []string{"https://app.example.com"},
+//			AllowedMethods: []string{"GET", "POST"},
+//		}))
+func AnswerCORSPreflight(config CORSConfig) ReqHandler {
+	return FuncReqHandler(func(req *http.Request) (*http.Request, *http.Response) {
+		if !ReqIsCORSPreflight(req) {
+			return req, nil
+		}
+		return req, CORSPreflightResponse(req, config)
+	})
+}
@@ -2,25 +2,91 @@ package goproxy
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"net/http"
+	"sync"
 )
 
 type ctxKey int
 
 const (
-	ctxKeyReq          ctxKey = iota
-	ctxKeyResp                = iota
-	ctxKeyRoundTripper        = iota
-	ctxKeyError               = iota
-	ctxKeyProxy               = iota
-	ctxKeyConnect             = iota
+	ctxKeyReq           ctxKey = iota
+	ctxKeyResp                 = iota
+	ctxKeyRoundTripper         = iota
+	ctxKeyError                = iota
+	ctxKeyProxy                = iota
+	ctxKeyConnect              = iota
+	ctxKeyMatched              = iota
+	ctxKeySynthesized          = iota
+	ctxKeyFinish               = iota
+	ctxKeyTransferError        = iota
+	ctxKeyHandlers             = iota
+	ctxKeyTimings              = iota
+	ctxKeyDebug                = iota
+	ctxKeyOriginalDst          = iota
+	ctxKeyPinnedIPs            = iota
+	ctxKeyAccessLog            = iota
+	ctxKeyEarlyHints           = iota
+	ctxKeyUpstreamTLS          = iota
+	ctxKeySampleDraws          = iota
 )
 
 func (proxy *ProxyHttpServer) requestWithContext(r *http.Request) *http.Request {
 	ctx := context.WithValue(r.Context(), ctxKeyProxy, proxy)
+	ctx = context.WithValue(ctx, ctxKeyFinish, &finishCallbacks{})
+	ctx = context.WithValue(ctx, ctxKeyTransferError, &transferError{})
+	ctx = context.WithValue(ctx, ctxKeyHandlers, proxy.handlers())
+	ctx = context.WithValue(ctx, ctxKeyTimings, &timingsRecorder{})
+	ctx = context.WithValue(ctx, ctxKeyUpstreamTLS, &upstreamTLS{})
+	ctx = context.WithValue(ctx, ctxKeySampleDraws, &sampleDraws{})
+	if proxy.DebugMatches {
+		ctx = context.WithValue(ctx, ctxKeyMatched, &matchedHandlers{})
+	}
+	if proxy.PinCheckedIPs {
+		ctx = context.WithValue(ctx, ctxKeyPinnedIPs, &pinnedIPs{hosts: make(map[string][]net.IP)})
+	}
 	return r.WithContext(ctx)
 }
 
+// ctxHandlers returns the handlers registered when the request of the given context started
+// being handled, or the current ones, if the context has none.
+func (proxy *ProxyHttpServer) ctxHandlers(ctx context.Context) *handlerSet {
+	if set, ok := ctx.Value(ctxKeyHandlers).(*handlerSet); ok {
+		return set
+	}
+	return proxy.handlers()
+}
+
+// matchedHandlers records which of the registered handlers had their conditions met
+type matchedHandlers struct {
+	req  []int
+	resp []int
+}
+
+func ctxMatchedHandlers(ctx context.Context) *matchedHandlers {
+	v, _ := ctx.Value(ctxKeyMatched).(*matchedHandlers)
+	return v
+}
+
+// CtxMatchedReqHandlers returns the indices, by registration order, of the request handlers
+// whose conditions matched the request so far. It is only recorded when proxy.DebugMatches is set.
+func CtxMatchedReqHandlers(ctx context.Context) []int {
+	if m := ctxMatchedHandlers(ctx); m != nil {
+		return m.req
+	}
+	return nil
+}
+
+// CtxMatchedRespHandlers returns the indices, by registration order, of the response handlers
+// whose conditions matched the response so far. It is only recorded when proxy.DebugMatches is set.
+func CtxMatchedRespHandlers(ctx context.Context) []int {
+	if m := ctxMatchedHandlers(ctx); m != nil {
+		return m.resp
+	}
+	return nil
+}
+
 func CtxWithResp(ctx context.Context, r *http.Response) context.Context {
 	return context.WithValue(ctx, ctxKeyResp, r)
 }
@@ -36,25 +102,85 @@ func CtxConnectRequest(ctx context.Context) *http.Request {
 	return v
 }
 
+// CtxConnectHost returns the host the client asked to CONNECT to, when handling requests
+// eavesdropped in a CONNECT tunnel, and "" otherwise.
+func CtxConnectHost(ctx context.Context) string {
+	if r := CtxConnectRequest(ctx); r != nil {
+		return r.Host
+	}
+	return ""
+}
+
+// ctxWithDebug marks the request of the returned context for debug logging, see ReqProxyConds.Debug
+func ctxWithDebug(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyDebug, true)
+}
+
+// ctxDebug returns whether the request of the given context, or the CONNECT request of its tunnel,
+// is marked for debug logging.
+func ctxDebug(ctx context.Context) bool {
+	if debug, _ := ctx.Value(ctxKeyDebug).(bool); debug {
+		return true
+	}
+	if r := CtxConnectRequest(ctx); r != nil {
+		debug, _ := r.Context().Value(ctxKeyDebug).(bool)
+		return debug
+	}
+	return false
+}
+
+// debugLog returns the logger for debug information about the request of the given context. It is
+// Loggers.Debug, unless the request is marked for debug logging while Loggers.Debug is disabled,
+// in which case it is Loggers.Error.
+func (proxy *ProxyHttpServer) debugLog(ctx context.Context) Logger {
+	if proxy.Loggers.Debug == Logger(NopLogger) && ctxDebug(ctx) {
+		return proxy.Loggers.Error
+	}
+	return proxy.Loggers.Debug
+}
+
+func ctxWithSynthesized(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeySynthesized, true)
+}
+
+// CtxSynthesized returns true if the response to the request was returned by a request handler,
+// rather than by the destination server.
+func CtxSynthesized(ctx context.Context) bool {
+	v, _ := ctx.Value(ctxKeySynthesized).(bool)
+	return v
+}
+
 func CtxResp(ctx context.Context) *http.Response {
-	v, ok := ctx.Value(ctxKeyResp).(*http.Response)
+	v, ok := CtxRespOK(ctx)
 	if !ok {
 		panic("required value in context missing")
 	}
 	return v
 }
 
+// CtxRespOK is like CtxResp, but returns false instead of panicking if the response is missing
+func CtxRespOK(ctx context.Context) (*http.Response, bool) {
+	v, ok := ctx.Value(ctxKeyResp).(*http.Response)
+	return v, ok
+}
+
 func CtxWithReq(ctx context.Context, r *http.Request) context.Context {
 	return context.WithValue(ctx, ctxKeyReq, r)
 }
 
 func CtxReq(ctx context.Context) *http.Request {
-	v, ok := ctx.Value(ctxKeyReq).(*http.Request)
+	v, ok := CtxReqOK(ctx)
 	if !ok {
 		panic("required value in context missing")
 	}
 	return v
 }
+
+// CtxReqOK is like CtxReq, but returns false instead of panicking if the request is missing
+func CtxReqOK(ctx context.Context) (*http.Request, bool) {
+	v, ok := ctx.Value(ctxKeyReq).(*http.Request)
+	return v, ok
+}
 func CtxWithRoundTripper(ctx context.Context, rt http.RoundTripper) context.Context {
 	return context.WithValue(ctx, ctxKeyRoundTripper, rt)
 }
@@ -63,7 +189,7 @@ func CtxRoundTripper(ctx context.Context) http.RoundTripper {
 	v, ok := ctx.Value(ctxKeyRoundTripper).(http.RoundTripper)
 	if !ok {
 		proxy := ctxProxy(ctx)
-		return proxy.Tr
+		return proxy.roundTripper()
 	}
 	return v
 }
@@ -72,17 +198,103 @@ func CtxWithError(ctx context.Context, err error) context.Context {
 	return context.WithValue(ctx, ctxKeyError, err)
 }
 
+// CtxError returns the error of handling the request of the given context. An error set with
+// CtxWithError, such as the error sending the request to the origin server, takes precedence.
+// Otherwise, it is the first error copying the response to the client, or closing its body,
+// which are recorded as they happen, and are visible to callbacks registered with CtxOnFinish.
 func CtxError(ctx context.Context) error {
 	v, ok := ctx.Value(ctxKeyError).(error)
-	if !ok {
-		return nil
+	if ok {
+		return v
+	}
+	if te, ok := ctx.Value(ctxKeyTransferError).(*transferError); ok {
+		te.mu.Lock()
+		defer te.mu.Unlock()
+		return te.err
+	}
+	return nil
+}
+
+// transferError holds the first error transferring the response of a request
+type transferError struct {
+	mu  sync.Mutex
+	err error
+}
+
+// recordTransferError records err as the transfer error of the request of the given context,
+// unless an earlier one was recorded.
+func recordTransferError(ctx context.Context, err error) {
+	te, ok := ctx.Value(ctxKeyTransferError).(*transferError)
+	if !ok || err == nil {
+		return
+	}
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	if te.err == nil {
+		te.err = err
 	}
-	return v
 }
 func ctxProxy(ctx context.Context) *ProxyHttpServer {
-	proxy, ok := ctx.Value(ctxKeyProxy).(*ProxyHttpServer)
+	proxy, ok := CtxProxyOK(ctx)
 	if !ok {
 		panic("required value in context missing")
 	}
 	return proxy
 }
+
+// CtxProxyOK returns the proxy handling the request of the given context, and false if the
+// context does not belong to a request handled by a proxy, e.g. when handlers are called in tests.
+func CtxProxyOK(ctx context.Context) (*ProxyHttpServer, bool) {
+	proxy, ok := ctx.Value(ctxKeyProxy).(*ProxyHttpServer)
+	return proxy, ok
+}
+
+// finishCallbacks holds the callbacks to run when handling a request is done
+type finishCallbacks struct {
+	mu   sync.Mutex
+	fs   []func()
+	done bool
+}
+
+// CtxOnFinish registers f to be called once the response to the request of the given context was
+// written to the client, or failed to be written. Use it to release per request resources, such as
+// files opened by handlers. Callbacks are called in reverse order of registration, and a panicking
+// callback does not prevent the others from running.
+// It returns false, and f is never called, if the context does not belong to a request
+// handled by the proxy, or if handling the request is already done.
+func CtxOnFinish(ctx context.Context, f func()) bool {
+	callbacks, ok := ctx.Value(ctxKeyFinish).(*finishCallbacks)
+	if !ok {
+		return false
+	}
+	callbacks.mu.Lock()
+	defer callbacks.mu.Unlock()
+	if callbacks.done {
+		return false
+	}
+	callbacks.fs = append(callbacks.fs, f)
+	return true
+}
+
+// finish runs the callbacks registered with CtxOnFinish for the request of the given context.
+// It is safe to call it more than once, callbacks run only on the first call.
+func (proxy *ProxyHttpServer) finish(ctx context.Context) {
+	callbacks, ok := ctx.Value(ctxKeyFinish).(*finishCallbacks)
+	if !ok {
+		return
+	}
+	callbacks.mu.Lock()
+	fs := callbacks.fs
+	callbacks.fs, callbacks.done = nil, true
+	callbacks.mu.Unlock()
+	for i := len(fs) - 1; i >= 0; i-- {
+		func() {
+			defer func() {
+				if e := recover(); e != nil {
+					proxy.Loggers.Error.Log("event", "finish callback panic", "error", fmt.Sprint(e))
+				}
+			}()
+			fs[i]()
+		}()
+	}
+}
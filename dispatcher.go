@@ -1,10 +1,17 @@
 package goproxy
 
 import (
+	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy2/regretable"
 )
 
 // ReqCondition.HandleReq will decide whether or not to use the ReqHandler on an HTTP request
@@ -41,6 +48,17 @@ func (c RespConditionFunc) HandleResp(req *http.Request, resp *http.Response) bo
 	return c(req, resp)
 }
 
+// ReqCond returns a RespCondition testing only the request with c. The response, which might be
+// nil, is ignored. Any ReqCondition is already a RespCondition, ReqCond makes the intent explicit
+// when using request conditions in OnResponse, e.g.
+//
+//	proxy.OnResponse(goproxy.ReqCond(goproxy.ReqHostIs("example.com")))
+func ReqCond(c ReqCondition) RespConditionFunc {
+	return func(req *http.Request, resp *http.Response) bool {
+		return c.HandleReq(req)
+	}
+}
+
 // UrlHasPrefix returns a ReqCondition checking wether the destination URL the proxy client has requested
 // has the given prefix, with or without the host.
 // For example UrlHasPrefix("host/x") will match requests of the form 'GET host/x', and will match
@@ -95,6 +113,19 @@ func ReqHostIs(hosts ...string) ReqConditionFunc {
 	}
 }
 
+// ReqMethodIs returns a ReqCondition testing whether the request method is one of the given
+// methods, case insensitively. With no methods, it never matches.
+func ReqMethodIs(methods ...string) ReqConditionFunc {
+	return func(req *http.Request) bool {
+		for _, m := range methods {
+			if strings.EqualFold(req.Method, m) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 var localHostIpv4 = regexp.MustCompile(`127\.0\.0\.\d+`)
 
 // IsLocalHost checks whether the destination host is explicitly local host
@@ -106,6 +137,74 @@ var IsLocalHost ReqConditionFunc = func(req *http.Request) bool {
 		req.URL.Host == "localhost"
 }
 
+// ReqProtoIs returns a ReqCondition testing whether the client sent the request with the given
+// HTTP protocol version, e.g. ReqProtoIs(2, 0) for HTTP/2 clients. For eavesdropped CONNECT
+// requests, the version is the one used inside the tunnel.
+func ReqProtoIs(major, minor int) ReqConditionFunc {
+	return func(req *http.Request) bool {
+		return req.ProtoMajor == major && req.ProtoMinor == minor
+	}
+}
+
+// ReqHasBody checks whether the request has a body, that is, a positive Content-Length, a chunked
+// Transfer-Encoding, or an unknown length (-1). Use it to scope body inspecting handlers, and avoid
+// needless buffering of GET and HEAD requests.
+var ReqHasBody ReqConditionFunc = func(req *http.Request) bool {
+	if req.ContentLength > 0 || req.ContentLength == -1 {
+		return true
+	}
+	for _, te := range req.TransferEncoding {
+		if te == "chunked" {
+			return true
+		}
+	}
+	// a zero length with a body, in a request created by the user, means the length is unknown
+	return req.Body != nil && req.Body != http.NoBody
+}
+
+// ReqBodyLargerThan returns a ReqCondition testing whether the request body is longer than n
+// bytes, by its Content-Length, without reading it. Bodies of unknown length, such as chunked
+// uploads, do not match, see ReqBodyLargerThanOr.
+//
+//	proxy.OnRequest(goproxy.ReqMethodIs("POST"), goproxy.ReqBodyLargerThan(10<<20)).DoFunc(...)
+func ReqBodyLargerThan(n int64) ReqConditionFunc {
+	return ReqBodyLargerThanOr(n, false)
+}
+
+// ReqBodyLargerThanOr returns a ReqCondition like ReqBodyLargerThan, matching bodies of unknown
+// length if unknown is true.
+func ReqBodyLargerThanOr(n int64, unknown bool) ReqConditionFunc {
+	return func(req *http.Request) bool {
+		if req.ContentLength < 0 {
+			return unknown
+		}
+		return req.ContentLength > n
+	}
+}
+
+// ReqIsConditional checks whether the request is conditional, that is, whether it has an
+// If-None-Match, If-Modified-Since, If-Match or If-Unmodified-Since header, as sent by clients
+// revalidating their cached copy.
+var ReqIsConditional ReqConditionFunc = func(req *http.Request) bool {
+	for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		if req.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// IsDomainFronting checks whether a request eavesdropped in a CONNECT tunnel is directed, by its Host
+// header, to a different host than the one the tunnel was opened to, e.g. CONNECT cdn.example.com,
+// and then Host: evil.example.com. Ports are ignored. Requests not in a tunnel never match.
+var IsDomainFronting ReqConditionFunc = func(req *http.Request) bool {
+	connectHost := CtxConnectHost(req.Context())
+	if connectHost == "" {
+		return false
+	}
+	return !strings.EqualFold(stripPort(connectHost), stripPort(req.Host))
+}
+
 // UrlMatches returns a ReqCondition testing whether the destination URL
 // of the request matches the given regexp, with or without prefix
 func UrlMatches(re *regexp.Regexp) ReqConditionFunc {
@@ -115,6 +214,24 @@ func UrlMatches(re *regexp.Regexp) ReqConditionFunc {
 	}
 }
 
+// ReqHeaderMatches returns a ReqCondition testing whether any value of the request header name
+// matches the given regexp, e.g. ReqHeaderMatches("User-Agent", regexp.MustCompile("curl/")).
+func ReqHeaderMatches(name string, re *regexp.Regexp) ReqConditionFunc {
+	name = http.CanonicalHeaderKey(name)
+	return func(req *http.Request) bool {
+		return headerMatches(req.Header[name], re)
+	}
+}
+
+func headerMatches(values []string, re *regexp.Regexp) bool {
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
 // DstHostIs returns a ReqCondition testing wether the host in the request url is the given string
 func DstHostIs(host string) ReqConditionFunc {
 	return func(req *http.Request) bool {
@@ -134,6 +251,20 @@ func SrcIpIs(ips ...string) ReqCondition {
 	})
 }
 
+// ClientIPIs returns a ReqCondition testing whether the IP of the client, as returned by ClientIP, is
+// one of the given strings. Unlike SrcIpIs, it uses ProxyHttpServer.ClientIPFunc when set.
+func ClientIPIs(ips ...string) ReqCondition {
+	return ReqConditionFunc(func(req *http.Request) bool {
+		clientIP := ClientIP(req)
+		for _, ip := range ips {
+			if clientIP == ip {
+				return true
+			}
+		}
+		return false
+	})
+}
+
 // Not returns a ReqCondition negating the given ReqCondition
 func Not(r ReqCondition) ReqConditionFunc {
 	return func(req *http.Request) bool {
@@ -159,6 +290,172 @@ func ContentTypeIs(typ string, types ...string) RespCondition {
 	})
 }
 
+// RespHeaderMatches returns a RespCondition testing whether any value of the response header name
+// matches the given regexp. It never matches a nil response.
+func RespHeaderMatches(name string, re *regexp.Regexp) RespCondition {
+	name = http.CanonicalHeaderKey(name)
+	return RespConditionFunc(func(req *http.Request, resp *http.Response) bool {
+		return resp != nil && headerMatches(resp.Header[name], re)
+	})
+}
+
+// RespStatusCodeIs returns a RespCondition testing whether the response status code is one of
+// the given codes. It never matches a nil response.
+//
+//	proxy.OnResponse(goproxy.RespStatusCodeIs(500, 502, 503)).DoFunc(...)
+func RespStatusCodeIs(codes ...int) RespCondition {
+	codeSet := make(map[int]bool)
+	for _, code := range codes {
+		codeSet[code] = true
+	}
+	return RespConditionFunc(func(req *http.Request, resp *http.Response) bool {
+		return resp != nil && codeSet[resp.StatusCode]
+	})
+}
+
+// RespStatusCodeInRange returns a RespCondition testing whether the response status code is
+// between lo and hi, inclusive, e.g. RespStatusCodeInRange(400, 499) for client errors. It never
+// matches a nil response.
+func RespStatusCodeInRange(lo, hi int) RespCondition {
+	return RespConditionFunc(func(req *http.Request, resp *http.Response) bool {
+		return resp != nil && resp.StatusCode >= lo && resp.StatusCode <= hi
+	})
+}
+
+// RespBodyMatches returns a RespCondition testing whether the response body matches the given
+// regexp. Up to maxBytes of the body are buffered for the test, and then restored, so that the
+// following handlers and the client still get the full body, with its Content-Length. Bodies
+// longer than maxBytes never match, and are streamed as is. A negative maxBytes is taken as 0.
+func RespBodyMatches(re *regexp.Regexp, maxBytes int) RespCondition {
+	if maxBytes < 0 {
+		maxBytes = 0
+	}
+	return RespConditionFunc(func(req *http.Request, resp *http.Response) bool {
+		if resp == nil || resp.Body == nil {
+			return false
+		}
+		regret := regretable.NewRegretableReaderCloserSize(resp.Body, maxBytes+1)
+		resp.Body = PeekedBody(resp.Body, regret)
+		body, err := ioutil.ReadAll(io.LimitReader(regret, int64(maxBytes)+1))
+		regret.Regret()
+		if err != nil || len(body) > maxBytes {
+			return false
+		}
+		return re.Match(body)
+	})
+}
+
+// SampleRate returns a ReqCondition matching a random fraction p of the requests, e.g. 0.01 for 1%
+// of the requests. Use it to bound the overhead of logging in high volume deployments.
+//
+//	sampled := goproxy.SampleRate(0.01)
+//	proxy.OnRequest(sampled).DoFunc(logRequest)
+//	proxy.OnResponse(sampled).DoFunc(logResponse)
+//
+// A request is drawn once per condition, from a fast pseudo random generator seeded by the current
+// time, so every evaluation of the condition for the same request, e.g. by a request handler and
+// a response handler, agrees. See SampleRateSeed for a reproducible sample, and ErrorsAndSample to
+// keep every failed request as well.
+func SampleRate(p float64) ReqConditionFunc {
+	return SampleRateSeed(p, time.Now().UnixNano())
+}
+
+// SampleRateSeed is like SampleRate, but draws from a generator with the given seed, so that
+// the same sequence of requests is always sampled the same way.
+func SampleRateSeed(p float64, seed int64) ReqConditionFunc {
+	var mu sync.Mutex
+	rnd := rand.New(rand.NewSource(seed))
+	draw := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return rnd.Float64() < p
+	}
+	return func(req *http.Request) bool {
+		draws, ok := req.Context().Value(ctxKeySampleDraws).(*sampleDraws)
+		if !ok {
+			// not handled by a proxy, e.g. a condition called in tests
+			return draw()
+		}
+		draws.mu.Lock()
+		defer draws.mu.Unlock()
+		sampled, ok := draws.draws[rnd]
+		if !ok {
+			sampled = draw()
+			if draws.draws == nil {
+				draws.draws = make(map[*rand.Rand]bool)
+			}
+			draws.draws[rnd] = sampled
+		}
+		return sampled
+	}
+}
+
+// ErrorsAndSample returns a RespCondition matching the responses to failed requests, whose
+// response is nil or has an error status, 400 and above, and the other responses whose request
+// sampled matches, e.g. to log all errors plus 1% of the successes:
+//
+//	proxy.OnResponse(goproxy.ErrorsAndSample(goproxy.SampleRate(0.01))).DoFunc(logResponse)
+func ErrorsAndSample(sampled ReqCondition) RespConditionFunc {
+	return func(req *http.Request, resp *http.Response) bool {
+		if resp == nil || resp.StatusCode >= 400 {
+			return true
+		}
+		return sampled.HandleReq(req)
+	}
+}
+
+// sampleDraws holds the draws of the SampleRate conditions for a request, by their generator
+type sampleDraws struct {
+	mu    sync.Mutex
+	draws map[*rand.Rand]bool
+}
+
+// TimeWindow returns a ReqCondition testing whether the request arrives between the clock times of
+// start (inclusive) and end (exclusive), in the time zone of start. Only the clock part of start and
+// end is used. A window whose end is before its start spans midnight, e.g. 22:00-06:00.
+// If days are given, the window must also start on one of the given week days, so that a Friday
+// 22:00-06:00 window matches on Saturday at 02:00.
+//
+//	workHours := goproxy.TimeWindow(time.Date(0, 1, 1, 8, 0, 0, 0, time.Local),
+//		time.Date(0, 1, 1, 18, 0, 0, 0, time.Local),
+//		time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday)
+//	proxy.OnRequest(goproxy.DstHostIs("www.reddit.com"), workHours).DoFunc(...)
+func TimeWindow(start, end time.Time, days ...time.Weekday) ReqConditionFunc {
+	return func(req *http.Request) bool {
+		return inTimeWindow(time.Now(), start, end, days)
+	}
+}
+
+func clockSeconds(t time.Time) int {
+	h, m, s := t.Clock()
+	return h*3600 + m*60 + s
+}
+
+func inTimeWindow(now, start, end time.Time, days []time.Weekday) bool {
+	now = now.In(start.Location())
+	t, from, to := clockSeconds(now), clockSeconds(start), clockSeconds(end.In(start.Location()))
+	// the day the window started on, the previous one after midnight
+	startDay := now
+	if from <= to {
+		if t < from || t >= to {
+			return false
+		}
+	} else if t < to {
+		startDay = now.AddDate(0, 0, -1)
+	} else if t < from {
+		return false
+	}
+	if len(days) == 0 {
+		return true
+	}
+	for _, day := range days {
+		if startDay.Weekday() == day {
+			return true
+		}
+	}
+	return false
+}
+
 // ProxyHttpServer.OnRequest Will return a temporary ReqProxyConds struct, aggregating the given condtions.
 // You will use the ReqProxyConds struct to register a ReqHandler, that would filter
 // the request, only if all the given ReqCondition matched.
@@ -188,6 +485,9 @@ func (pcond *ReqProxyConds) DoFunc(f func(req *http.Request) (*http.Request, *ht
 //	// given request to the proxy, will test if cond1.HandleReq(req) && cond2.HandleReq(req) are true
 //	// if they are, will call handler.Handle(req)
 func (pcond *ReqProxyConds) Do(h ReqHandler) {
+	pcond.proxy.handlersMu.Lock()
+	defer pcond.proxy.handlersMu.Unlock()
+	ix := len(pcond.proxy.reqHandlers)
 	pcond.proxy.reqHandlers = append(pcond.proxy.reqHandlers,
 		FuncReqHandler(func(r *http.Request) (*http.Request, *http.Response) {
 			for _, cond := range pcond.reqConds {
@@ -195,10 +495,27 @@ func (pcond *ReqProxyConds) Do(h ReqHandler) {
 					return r, nil
 				}
 			}
+			if m := ctxMatchedHandlers(r.Context()); m != nil {
+				m.req = append(m.req, ix)
+			}
 			return h.Handle(r)
 		}))
 }
 
+// Debug makes the proxy log debug information about requests meeting the conditions, even if the
+// debug logger is disabled, in which case it goes to the error logger. It applies to log lines
+// after the handler ran, and for CONNECT requests, to the requests eavesdropped in the tunnel.
+//
+//	proxy.OnRequest(goproxy.ReqHostIs("example.com:443")).Debug()
+func (pcond *ReqProxyConds) Debug() {
+	pcond.Do(FuncReqHandler(func(r *http.Request) (*http.Request, *http.Response) {
+		return r.WithContext(ctxWithDebug(r.Context())), nil
+	}))
+	pcond.HandleConnect(FuncHttpsHandler(func(r *http.Request, host string) (*http.Request, *ConnectAction, string) {
+		return r.WithContext(ctxWithDebug(r.Context())), nil, ""
+	}))
+}
+
 // HandleConnect is used when proxy receives an HTTP CONNECT request,
 // it'll then use the HttpsHandler to determine what should it
 // do with this request. The handler returns a ConnectAction struct, the Action field in the ConnectAction
@@ -211,6 +528,8 @@ func (pcond *ReqProxyConds) Do(h ReqHandler) {
 // will use the default tls configuration.
 //	proxy.OnRequest().HandleConnect(goproxy.AlwaysReject) // rejects all CONNECT requests
 func (pcond *ReqProxyConds) HandleConnect(h HttpsHandler) {
+	pcond.proxy.handlersMu.Lock()
+	defer pcond.proxy.handlersMu.Unlock()
 	pcond.proxy.httpsHandlers = append(pcond.proxy.httpsHandlers,
 		FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *ConnectAction, string) {
 			for _, cond := range pcond.reqConds {
@@ -239,6 +558,8 @@ func (pcond *ReqProxyConds) HandleConnectFunc(f func(r *http.Request, host strin
 }
 
 func (pcond *ReqProxyConds) HijackConnect(f func(req *http.Request, client net.Conn)) {
+	pcond.proxy.handlersMu.Lock()
+	defer pcond.proxy.handlersMu.Unlock()
 	pcond.proxy.httpsHandlers = append(pcond.proxy.httpsHandlers,
 		FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *ConnectAction, string) {
 			for _, cond := range pcond.reqConds {
@@ -267,6 +588,9 @@ func (pcond *ProxyConds) DoFunc(f func(req *http.Request, resp *http.Response) (
 // ProxyConds.Do will register the RespHandler on the proxy, h.Handle(resp,ctx) will be called on every
 // request that matches the conditions aggregated in pcond.
 func (pcond *ProxyConds) Do(h RespHandler) {
+	pcond.proxy.handlersMu.Lock()
+	defer pcond.proxy.handlersMu.Unlock()
+	ix := len(pcond.proxy.respHandlers)
 	pcond.proxy.respHandlers = append(pcond.proxy.respHandlers,
 		FuncRespHandler(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
 			for _, cond := range pcond.reqConds {
@@ -279,6 +603,9 @@ func (pcond *ProxyConds) Do(h RespHandler) {
 					return req, resp
 				}
 			}
+			if m := ctxMatchedHandlers(req.Context()); m != nil {
+				m.resp = append(m.resp, ix)
+			}
 			return h.Handle(req, resp)
 		}))
 }
@@ -286,6 +613,13 @@ func (pcond *ProxyConds) Do(h RespHandler) {
 // OnResponse is used when adding a response-filter to the HTTP proxy, usual pattern is
 //	proxy.OnResponse(cond1,cond2).Do(handler) // handler.Handle(resp,ctx) will be used
 //				// if cond1.HandleResp(resp) && cond2.HandleResp(resp)
+//
+// Request and response conditions can be mixed, and are checked in the order they are given,
+// until one does not match. Every ReqCondition, such as UrlHasPrefix, is also a RespCondition
+// testing only the request, the others test the response, which might be nil. For example, to
+// handle responses to API requests with a JSON body:
+//
+//	proxy.OnResponse(goproxy.UrlHasPrefix("/api"), goproxy.ContentTypeIs("application/json")).Do(handler)
 func (proxy *ProxyHttpServer) OnResponse(conds ...RespCondition) *ProxyConds {
 	return &ProxyConds{proxy, make([]ReqCondition, 0), conds}
 }
@@ -0,0 +1,312 @@
+package goproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInTimeWindow(t *testing.T) {
+	clock := func(h, m int) time.Time { return time.Date(2017, 8, 28, h, m, 0, 0, time.UTC) } // Monday
+	friday := func(h, m int) time.Time { return time.Date(2017, 9, 1, h, m, 0, 0, time.UTC) }
+	testCases := []struct {
+		now, start, end time.Time
+		days            []time.Weekday
+		expected        bool
+	}{
+		{clock(9, 0), clock(8, 0), clock(18, 0), nil, true},
+		{clock(8, 0), clock(8, 0), clock(18, 0), nil, true},
+		{clock(18, 0), clock(8, 0), clock(18, 0), nil, false},
+		{clock(7, 59), clock(8, 0), clock(18, 0), nil, false},
+		{clock(23, 0), clock(22, 0), clock(6, 0), nil, true},
+		{clock(5, 0), clock(22, 0), clock(6, 0), nil, true},
+		{clock(12, 0), clock(22, 0), clock(6, 0), nil, false},
+		{clock(9, 0), clock(8, 0), clock(18, 0), []time.Weekday{time.Monday}, true},
+		{clock(9, 0), clock(8, 0), clock(18, 0), []time.Weekday{time.Saturday, time.Sunday}, false},
+		// a Friday night window
+		{friday(23, 0), clock(22, 0), clock(6, 0), []time.Weekday{time.Friday}, true},
+		{friday(23, 0).AddDate(0, 0, 1), clock(22, 0), clock(6, 0), []time.Weekday{time.Friday}, false},
+		{friday(2, 0).AddDate(0, 0, 1), clock(22, 0), clock(6, 0), []time.Weekday{time.Friday}, true},
+		{friday(2, 0), clock(22, 0), clock(6, 0), []time.Weekday{time.Friday}, false},
+		{friday(12, 0), clock(22, 0), clock(6, 0), []time.Weekday{time.Friday}, false},
+	}
+	for _, tc := range testCases {
+		if actual := inTimeWindow(tc.now, tc.start, tc.end, tc.days); actual != tc.expected {
+			t.Errorf("inTimeWindow(%v, %v-%v, %v) = %v, expected %v",
+				tc.now.Format("15:04"), tc.start.Format("15:04"), tc.end.Format("15:04"), tc.days, actual, tc.expected)
+		}
+	}
+}
+
+func TestReqHasBody(t *testing.T) {
+	get, _ := http.NewRequest("GET", "http://example.com", nil)
+	post, _ := http.NewRequest("POST", "http://example.com", strings.NewReader("body"))
+	unknown, _ := http.NewRequest("POST", "http://example.com", ioutil.NopCloser(strings.NewReader("body")))
+	chunked, _ := http.NewRequest("POST", "http://example.com", nil)
+	chunked.TransferEncoding = []string{"chunked"}
+	for _, tc := range []struct {
+		req      *http.Request
+		expected bool
+	}{{get, false}, {post, true}, {unknown, true}, {chunked, true}} {
+		if actual := ReqHasBody(tc.req); actual != tc.expected {
+			t.Errorf("ReqHasBody(%s, ContentLength=%d) = %v, expected %v", tc.req.Method, tc.req.ContentLength, actual, tc.expected)
+		}
+	}
+}
+
+func TestReqMethodIs(t *testing.T) {
+	post, _ := http.NewRequest("POST", "http://example.com/", nil)
+	for _, tc := range []struct {
+		methods  []string
+		expected bool
+	}{
+		{[]string{"POST", "PUT"}, true},
+		{[]string{"post"}, true},
+		{[]string{"Get", "pUt"}, false},
+		{nil, false},
+	} {
+		if actual := ReqMethodIs(tc.methods...)(post); actual != tc.expected {
+			t.Errorf("ReqMethodIs(%q) on POST = %v, expected %v", tc.methods, actual, tc.expected)
+		}
+	}
+}
+
+func TestRespStatusCode(t *testing.T) {
+	for _, tc := range []struct {
+		cond     RespCondition
+		resp     *http.Response
+		expected bool
+	}{
+		{RespStatusCodeIs(500, 502, 503), &http.Response{StatusCode: 502}, true},
+		{RespStatusCodeIs(500, 502, 503), &http.Response{StatusCode: 501}, false},
+		{RespStatusCodeIs(500), nil, false},
+		{RespStatusCodeInRange(400, 499), &http.Response{StatusCode: 400}, true},
+		{RespStatusCodeInRange(400, 499), &http.Response{StatusCode: 499}, true},
+		{RespStatusCodeInRange(400, 499), &http.Response{StatusCode: 500}, false},
+		{RespStatusCodeInRange(400, 499), nil, false},
+	} {
+		if actual := tc.cond.HandleResp(nil, tc.resp); actual != tc.expected {
+			t.Errorf("Condition on %+v = %v, expected %v", tc.resp, actual, tc.expected)
+		}
+	}
+}
+
+func TestHeaderMatches(t *testing.T) {
+	re := regexp.MustCompile(`no-store`)
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.Header.Add("Cache-Control", "max-age=0")
+	req.Header.Add("Cache-Control", "no-store")
+	if !ReqHeaderMatches("cache-control", re)(req) {
+		t.Error("Expected a later value of a lower case header name to match")
+	}
+	if ReqHeaderMatches("Pragma", re)(req) {
+		t.Error("Expected a missing header not to match")
+	}
+	resp := &http.Response{Header: http.Header{"Cache-Control": {"private", "no-store"}}}
+	if !RespHeaderMatches("CACHE-CONTROL", re).HandleResp(req, resp) {
+		t.Error("Expected the response header to match")
+	}
+	if RespHeaderMatches("Cache-Control", re).HandleResp(req, nil) {
+		t.Error("Expected a nil response not to match")
+	}
+}
+
+func TestReqBodyLargerThan(t *testing.T) {
+	for _, tc := range []struct {
+		cond          ReqConditionFunc
+		contentLength int64
+		expected      bool
+	}{
+		{ReqBodyLargerThan(10), 11, true},
+		{ReqBodyLargerThan(10), 10, false},
+		{ReqBodyLargerThan(10), 0, false},
+		{ReqBodyLargerThan(10), -1, false},
+		{ReqBodyLargerThanOr(10, true), -1, true},
+		{ReqBodyLargerThanOr(10, true), 5, false},
+	} {
+		req, _ := http.NewRequest("POST", "http://example.com/", nil)
+		req.ContentLength = tc.contentLength
+		if actual := tc.cond(req); actual != tc.expected {
+			t.Errorf("Condition on ContentLength=%d = %v, expected %v", tc.contentLength, actual, tc.expected)
+		}
+	}
+}
+
+func TestReqIsConditional(t *testing.T) {
+	for _, tc := range []struct {
+		header   string
+		expected bool
+	}{
+		{"", false},
+		{"Accept", false},
+		{"If-None-Match", true},
+		{"If-Modified-Since", true},
+		{"If-Match", true},
+		{"If-Unmodified-Since", true},
+	} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		if tc.header != "" {
+			req.Header.Set(tc.header, "x")
+		}
+		if actual := ReqIsConditional(req); actual != tc.expected {
+			t.Errorf("ReqIsConditional with header %q = %v, expected %v", tc.header, actual, tc.expected)
+		}
+	}
+}
+
+func TestReqCond(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	isGet := ReqConditionFunc(func(req *http.Request) bool { return req.Method == "GET" })
+	if !ReqCond(isGet).HandleResp(req, nil) || !ReqCond(isGet).HandleResp(req, &http.Response{StatusCode: 500}) {
+		t.Error("Expected ReqCond to test the request, whatever the response")
+	}
+}
+
+func TestReqProtoIs(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if !ReqProtoIs(1, 1)(req) || ReqProtoIs(2, 0)(req) {
+		t.Error("Expected new requests to be HTTP/1.1 only")
+	}
+	req.ProtoMajor, req.ProtoMinor = 2, 0
+	if !ReqProtoIs(2, 0)(req) {
+		t.Error("Expected HTTP/2 request to match ReqProtoIs(2, 0)")
+	}
+}
+
+func TestSrcIpIsClientIPIs(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	req.RemoteAddr = "[::1]:1234"
+	if !SrcIpIs("[::1]").HandleReq(req) || SrcIpIs("::1").HandleReq(req) {
+		t.Error("Expected SrcIpIs to match the host part of RemoteAddr as is")
+	}
+	if !ClientIPIs("::1").HandleReq(req) || ClientIPIs("[::1]").HandleReq(req) {
+		t.Error("Expected ClientIPIs to match the client IP")
+	}
+
+	proxy := New()
+	proxy.ClientIPFunc = func(req *http.Request) string { return "10.0.0.1" }
+	req = proxy.requestWithContext(req)
+	if !SrcIpIs("[::1]").HandleReq(req) || SrcIpIs("10.0.0.1").HandleReq(req) {
+		t.Error("Expected SrcIpIs to ignore ClientIPFunc")
+	}
+	if !ClientIPIs("10.0.0.1").HandleReq(req) {
+		t.Error("Expected ClientIPIs to use ClientIPFunc")
+	}
+}
+
+func TestDstIsPrivate(t *testing.T) {
+	testCases := []struct {
+		url      string
+		expected bool
+	}{
+		{"http://127.0.0.1/", true},
+		{"http://10.1.2.3:8080/", true},
+		{"http://172.20.0.1/", true},
+		{"http://192.168.1.1/", true},
+		{"http://169.254.169.254/latest/meta-data", true},
+		{"http://[::1]/", true},
+		{"http://[fd00::1]/", true},
+		{"http://8.8.8.8/", false},
+		{"http://172.32.0.1/", false},
+		{"http://[2001:4860:4860::8888]/", false},
+	}
+	for _, tc := range testCases {
+		req, _ := http.NewRequest("GET", tc.url, nil)
+		if actual := DstIsPrivate(req); actual != tc.expected {
+			t.Errorf("DstIsPrivate(%s) = %v, expected %v", tc.url, actual, tc.expected)
+		}
+	}
+	req, _ := http.NewRequest("GET", "http://unresolvable.invalid/", nil)
+	if !DstIsPrivate(req) || DstIsPrivateOr(false)(req) {
+		t.Error("Expected unresolvable hosts to match DstIsPrivate, and not DstIsPrivateOr(false)")
+	}
+}
+
+func TestOnResponseMixedConditions(t *testing.T) {
+	proxy := New()
+	pcond := proxy.OnResponse(UrlHasPrefix("/api"), ContentTypeIs("application/json"))
+	called := false
+	pcond.DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		called = true
+		return req, resp
+	})
+	for _, tc := range []struct {
+		url, contentType string
+		expected         bool
+	}{
+		{"http://example.com/api/x", "application/json", true},
+		{"http://example.com/web/x", "application/json", false},
+		{"http://example.com/api/x", "text/html", false},
+	} {
+		called = false
+		req, _ := http.NewRequest("GET", tc.url, nil)
+		resp := &http.Response{Header: http.Header{"Content-Type": {tc.contentType}}}
+		proxy.runRespHandlers(req, resp)
+		if called != tc.expected {
+			t.Errorf("Handler called %v for %s %s, expected %v", called, tc.url, tc.contentType, tc.expected)
+		}
+	}
+}
+
+func TestErrorsAndSample(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	for _, tc := range []struct {
+		resp     *http.Response
+		expected bool
+	}{
+		{nil, true},
+		{&http.Response{StatusCode: http.StatusBadGateway}, true},
+		{&http.Response{StatusCode: http.StatusNotFound}, true},
+		{&http.Response{StatusCode: http.StatusOK}, false},
+		{&http.Response{StatusCode: http.StatusNotModified}, false},
+	} {
+		status := "nil"
+		if tc.resp != nil {
+			status = http.StatusText(tc.resp.StatusCode)
+		}
+		if actual := ErrorsAndSample(SampleRate(0))(req, tc.resp); actual != tc.expected {
+			t.Errorf("Without sampling, ErrorsAndSample(%s) = %v, expected %v", status, actual, tc.expected)
+		}
+		if !ErrorsAndSample(SampleRate(1))(req, tc.resp) {
+			t.Errorf("With every request sampled, expected ErrorsAndSample(%s) to match", status)
+		}
+	}
+}
+
+func TestOnResponseConditionsOrder(t *testing.T) {
+	var order []string
+	respCond := func(name string, match bool) RespConditionFunc {
+		return func(req *http.Request, resp *http.Response) bool {
+			order = append(order, name)
+			return match
+		}
+	}
+	reqCond := func(name string, match bool) ReqConditionFunc {
+		return func(req *http.Request) bool {
+			order = append(order, name)
+			return match
+		}
+	}
+	for _, tc := range []struct {
+		conds    []RespCondition
+		expected string
+	}{
+		{[]RespCondition{respCond("resp1", true), reqCond("req1", true), respCond("resp2", true)}, "resp1,req1,resp2"},
+		{[]RespCondition{respCond("resp1", false), reqCond("req1", true)}, "resp1"},
+		{[]RespCondition{reqCond("req1", true), respCond("resp1", false), reqCond("req2", true)}, "req1,resp1"},
+	} {
+		proxy := New()
+		proxy.OnResponse(tc.conds...).DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+			return req, resp
+		})
+		order = nil
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		proxy.runRespHandlers(req, &http.Response{Header: http.Header{}})
+		if got := strings.Join(order, ","); got != tc.expected {
+			t.Errorf("Expected the conditions to be checked in order %s, got %s", tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package goproxy
+
+import (
+	"net/http"
+	"sort"
+)
+
+// changedHeaders returns the names of the headers that differ between before and after
+func changedHeaders(before, after http.Header) []string {
+	var changed []string
+	for k, vs := range after {
+		if !equalValues(before[k], vs) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// dryRunRequest runs the request handlers against a copy of r, and logs what they would have done
+func (proxy *ProxyHttpServer) dryRunRequest(r *http.Request) {
+	clone := r.Clone(r.Context())
+	clone.Body = http.NoBody
+	req, resp := proxy.runReqHandlers(clone)
+	if resp != nil {
+		proxy.Loggers.Debug.Log("event", "dry run", "url", r.URL.String(), "action", "respond", "status", resp.StatusCode)
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		return
+	}
+	if req.Method != r.Method || req.URL.String() != r.URL.String() {
+		proxy.Loggers.Debug.Log("event", "dry run", "url", r.URL.String(), "action", "rewrite", "method", req.Method, "newurl", req.URL.String())
+	}
+	if changed := changedHeaders(r.Header, req.Header); len(changed) > 0 {
+		proxy.Loggers.Debug.Log("event", "dry run", "url", r.URL.String(), "action", "request headers", "headers", changed)
+	}
+	if req.Body != http.NoBody {
+		proxy.Loggers.Debug.Log("event", "dry run", "url", r.URL.String(), "action", "request body")
+	}
+}
+
+// dryRunResponse runs the response handlers against a copy of resp, and logs what they would have done
+func (proxy *ProxyHttpServer) dryRunResponse(req *http.Request, resp *http.Response) {
+	var clone *http.Response
+	if resp != nil {
+		c := *resp
+		c.Header = resp.Header.Clone()
+		c.Body = http.NoBody
+		clone = &c
+	}
+	url := ""
+	if req != nil {
+		url = req.URL.String()
+		req = req.Clone(req.Context())
+		req.Body = http.NoBody
+	}
+	_, newResp := proxy.runRespHandlers(req, clone)
+	switch {
+	case newResp == nil:
+		if resp != nil {
+			proxy.Loggers.Debug.Log("event", "dry run", "url", url, "action", "drop response")
+		}
+		return
+	case resp == nil || newResp != clone:
+		proxy.Loggers.Debug.Log("event", "dry run", "url", url, "action", "respond", "status", newResp.StatusCode)
+	case newResp.StatusCode != resp.StatusCode:
+		proxy.Loggers.Debug.Log("event", "dry run", "url", url, "action", "status", "status", newResp.StatusCode)
+	}
+	if resp != nil {
+		if changed := changedHeaders(resp.Header, newResp.Header); len(changed) > 0 {
+			proxy.Loggers.Debug.Log("event", "dry run", "url", url, "action", "response headers", "headers", changed)
+		}
+	}
+	if newResp.Body != http.NoBody {
+		proxy.Loggers.Debug.Log("event", "dry run", "url", url, "action", "response body")
+		if newResp.Body != nil {
+			newResp.Body.Close()
+		}
+	}
+}
+
+var connectActionNames = map[ConnectActionLiteral]string{
+	ConnectAccept:          "accept",
+	ConnectReject:          "reject",
+	ConnectMitm:            "mitm",
+	ConnectHijack:          "hijack",
+	ConnectHTTPMitm:        "http mitm",
+	ConnectProxyAuthHijack: "proxy auth hijack",
+}
+
+// dryRunConnect logs what the CONNECT handlers would have done with r, which is todo to host
+func (proxy *ProxyHttpServer) dryRunConnect(r *http.Request, todo *ConnectAction, host string) {
+	if todo.Action == ConnectAccept && host == r.URL.Host {
+		return
+	}
+	proxy.Loggers.Debug.Log("event", "dry run", "url", r.URL.Host, "action", "connect", "connect", connectActionNames[todo.Action], "host", host)
+}
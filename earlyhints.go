@@ -0,0 +1,79 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrEarlyHintsUnsupported is returned by CtxWriteEarlyHints when the client of the request
+// cannot be sent interim responses.
+var ErrEarlyHintsUnsupported = errors.New("early hints are not supported for this request")
+
+// earlyHintsWriter sends a 103 Early Hints interim response with the given header
+type earlyHintsWriter func(header http.Header) error
+
+// ctxWithEarlyHints makes CtxWriteEarlyHints send interim responses of the request of the
+// returned context with write, if the client speaks HTTP/1.1 or later.
+func ctxWithEarlyHints(req *http.Request, write earlyHintsWriter) *http.Request {
+	if !req.ProtoAtLeast(1, 1) {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), ctxKeyEarlyHints, write))
+}
+
+// CtxWriteEarlyHints sends a 103 Early Hints interim response with header, e.g. Link headers of
+// resources to preload, to the client of the request of the given context, ahead of the final
+// response. Call it from request handlers, before the response is written. Headers of the final
+// response are not affected. It returns ErrEarlyHintsUnsupported for HTTP/1.0 clients, and for
+// contexts not belonging to requests handled by the proxy.
+//
+//	proxy.OnRequest(goproxy.UrlIs("example.com/")).DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+//		goproxy.CtxWriteEarlyHints(req.Context(), http.Header{"Link": {"</style.css>; rel=preload; as=style"}})
+//		return req, nil
+//	})
+func CtxWriteEarlyHints(ctx context.Context, header http.Header) error {
+	write, ok := ctx.Value(ctxKeyEarlyHints).(earlyHintsWriter)
+	if !ok {
+		return ErrEarlyHintsUnsupported
+	}
+	return write(header)
+}
+
+// responseWriterEarlyHints returns an earlyHintsWriter writing interim responses with w
+func responseWriterEarlyHints(w http.ResponseWriter) earlyHintsWriter {
+	return func(header http.Header) error {
+		// the header of w is also the header of the final response, restore it once sent
+		saved := make(http.Header)
+		for k := range header {
+			saved[k] = w.Header()[k]
+			w.Header()[k] = header[k]
+		}
+		w.WriteHeader(http.StatusEarlyHints)
+		for k, vs := range saved {
+			if vs == nil {
+				w.Header().Del(k)
+			} else {
+				w.Header()[k] = vs
+			}
+		}
+		return nil
+	}
+}
+
+// connEarlyHints returns an earlyHintsWriter writing interim responses to the client connection
+// of an eavesdropped CONNECT tunnel.
+func connEarlyHints(w io.Writer) earlyHintsWriter {
+	return func(header http.Header) error {
+		if _, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", http.StatusEarlyHints, http.StatusText(http.StatusEarlyHints)); err != nil {
+			return err
+		}
+		if err := header.Write(w); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\r\n")
+		return err
+	}
+}
@@ -0,0 +1,55 @@
+package goproxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// EchoHandler returns a ReqHandler answering requests with a JSON description of the request as
+// the proxy would have sent it, instead of sending it. Use it to check what handlers do to
+// requests:
+//
+//	proxy.OnRequest(goproxy.UrlHasPrefix("/__echo")).Do(goproxy.EchoHandler())
+//
+// The description has the method, url, proto, host and headers of the request, and its body,
+// base64 encoded, in body_base64. The body is streamed back, and never held in memory.
+func EchoHandler() ReqHandler {
+	return FuncReqHandler(func(req *http.Request) (*http.Request, *http.Response) {
+		head, err := json.Marshal(struct {
+			Method  string      `json:"method"`
+			URL     string      `json:"url"`
+			Proto   string      `json:"proto"`
+			Host    string      `json:"host"`
+			Headers http.Header `json:"headers"`
+		}{req.Method, req.URL.String(), req.Proto, req.Host, req.Header})
+		if err != nil {
+			return req, NewResponse(req, ContentTypeText, http.StatusInternalServerError, err.Error())
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			// the head ends with '}', replace it to add the body
+			if _, err := pw.Write(head[:len(head)-1]); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			io.WriteString(pw, `,"body_base64":"`)
+			if req.Body != nil {
+				enc := base64.NewEncoder(base64.StdEncoding, pw)
+				_, err = io.Copy(enc, req.Body)
+				req.Body.Close()
+				if err == nil {
+					err = enc.Close()
+				}
+				if err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+			io.WriteString(pw, "\"}\n")
+			pw.Close()
+		}()
+		return req, NewResponseFromReader(req, http.StatusOK, "application/json", -1, pr)
+	})
+}
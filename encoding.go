@@ -0,0 +1,230 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// errorReader fails every read with err
+type errorReader struct{ err error }
+
+func (r errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+// DefaultHandleBodyLimit is the largest body, encoded or decoded, HandleBody passes to its function
+const DefaultHandleBodyLimit = 16 << 20
+
+// HandleBody returns a RespHandler replacing response bodies with the one f returns, given the
+// body decoded from its Content-Encoding. The new body is encoded with the same encoding, and
+// Content-Length is set to its length. gzip and deflate are supported, and br once ext/brotli is
+// imported, see RegisterBodyEncoding. Bodies with other encodings, or larger than
+// DefaultHandleBodyLimit, encoded or decoded, are passed on untouched, without calling f. The proxy
+// transport only asks origin servers for gzip, but requests forwarded as is, e.g. in HTTP MITM
+// tunnels, accept what the client does; register AcceptSupportedEncodings for those.
+//
+//	proxy.OnRequest().Do(goproxy.AcceptSupportedEncodings)
+//	proxy.OnResponse(goproxy.ContentTypeIs("text/html")).Do(goproxy.HandleBody(func(req *http.Request, body []byte) []byte {
+//		return bytes.ReplaceAll(body, []byte("cloud"), []byte("butt"))
+//	}))
+func HandleBody(f func(req *http.Request, body []byte) []byte) RespHandler {
+	return HandleBodyLimit(DefaultHandleBodyLimit, f)
+}
+
+// HandleBodyLimit is like HandleBody, but passes on bodies larger than maxBytes, encoded or
+// decoded, untouched. The body is held in memory, so that f can transform it, and the limit
+// keeps large responses, or small ones decompressing to huge bodies, from exhausting it.
+func HandleBodyLimit(maxBytes int64, f func(req *http.Request, body []byte) []byte) RespHandler {
+	return FuncRespHandler(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		if resp == nil || resp.Body == nil || resp.Body == http.NoBody {
+			return req, resp
+		}
+		encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+		if !supportedEncoding(encoding) || resp.ContentLength > maxBytes {
+			return req, resp
+		}
+		orig := resp.Body
+		raw, err := ioutil.ReadAll(io.LimitReader(orig, maxBytes+1))
+		if err != nil {
+			// send what was read, failing like the original body
+			orig.Close()
+			resp.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(raw), errorReader{err}))
+			return req, resp
+		}
+		if int64(len(raw)) > maxBytes {
+			// send what was read, and the rest of the body, as is
+			resp.Body = PeekedBody(orig, readCloser{io.MultiReader(bytes.NewReader(raw), orig), orig})
+			return req, resp
+		}
+		orig.Close()
+		plain, err := decodeBody(encoding, raw, maxBytes)
+		if err == errDecodedBodyTooLarge {
+			resp.Body = ioutil.NopCloser(bytes.NewReader(raw))
+			return req, resp
+		}
+		if err != nil {
+			if proxy, ok := CtxProxyOK(req.Context()); ok {
+				proxy.Loggers.Error.Log("event", "HandleBody decode", "url", req.URL.String(), "encoding", encoding, "error", err.Error())
+			}
+			resp.Body = ioutil.NopCloser(bytes.NewReader(raw))
+			return req, resp
+		}
+		body, err := encodeBody(encoding, f(req, plain))
+		if err != nil {
+			if proxy, ok := CtxProxyOK(req.Context()); ok {
+				proxy.Loggers.Error.Log("event", "HandleBody encode", "url", req.URL.String(), "encoding", encoding, "error", err.Error())
+			}
+			resp.Body = ioutil.NopCloser(bytes.NewReader(raw))
+			return req, resp
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		resp.TransferEncoding = nil
+		return req, resp
+	})
+}
+
+// BodyEncoding decodes and encodes bodies with a content coding, see RegisterBodyEncoding
+type BodyEncoding struct {
+	// NewReader returns a reader decoding the bytes read from r
+	NewReader func(r io.Reader) (io.Reader, error)
+	// NewWriter returns a writer encoding the bytes written to it to w. Close flushes them.
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+var (
+	bodyEncodingsMu sync.RWMutex
+	bodyEncodings   = map[string]BodyEncoding{
+		"gzip":    gzipEncoding,
+		"x-gzip":  gzipEncoding,
+		"deflate": deflateEncoding,
+	}
+)
+
+var gzipEncoding = BodyEncoding{
+	NewReader: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+}
+
+var deflateEncoding = BodyEncoding{
+	NewReader: func(r io.Reader) (io.Reader, error) {
+		// deflate is meant to be zlib wrapped, but some servers send raw deflate data
+		br := bufio.NewReader(r)
+		if h, err := br.Peek(2); err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	},
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil },
+}
+
+// RegisterBodyEncoding makes HandleBody decode and encode bodies with the content coding name, and
+// AcceptSupportedEncodings keep it, e.g. br, registered by importing ext/brotli. gzip and deflate
+// are registered by default. Register encodings before serving requests, e.g. in init functions.
+func RegisterBodyEncoding(name string, enc BodyEncoding) {
+	bodyEncodingsMu.Lock()
+	defer bodyEncodingsMu.Unlock()
+	bodyEncodings[strings.ToLower(name)] = enc
+}
+
+// bodyEncoding returns the registered encoding name
+func bodyEncoding(name string) (BodyEncoding, bool) {
+	bodyEncodingsMu.RLock()
+	defer bodyEncodingsMu.RUnlock()
+	enc, ok := bodyEncodings[name]
+	return enc, ok
+}
+
+// AcceptSupportedEncodings is a ReqHandler removing the content codings HandleBody does not decode,
+// such as zstd, or br unless ext/brotli is imported, from the Accept-Encoding header of requests, so that origin servers answer
+// with one it does.
+var AcceptSupportedEncodings ReqHandler = FuncReqHandler(func(req *http.Request) (*http.Request, *http.Response) {
+	accept := req.Header.Get("Accept-Encoding")
+	if accept == "" {
+		return req, nil
+	}
+	var kept []string
+	for _, coding := range strings.Split(accept, ",") {
+		coding = strings.TrimSpace(coding)
+		name := coding
+		if i := strings.IndexByte(name, ';'); i >= 0 {
+			name = name[:i]
+		}
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" && supportedEncoding(name) {
+			kept = append(kept, coding)
+		}
+	}
+	if len(kept) == 0 {
+		// without the header, the body is not encoded
+		req.Header.Del("Accept-Encoding")
+	} else {
+		req.Header.Set("Accept-Encoding", strings.Join(kept, ", "))
+	}
+	return req, nil
+})
+
+func supportedEncoding(encoding string) bool {
+	if encoding == "" || encoding == "identity" {
+		return true
+	}
+	_, ok := bodyEncoding(encoding)
+	return ok
+}
+
+var errDecodedBodyTooLarge = errors.New("decoded body too large")
+
+// decodeBody decodes body from encoding, one of the supportedEncoding ones. It fails with
+// errDecodedBodyTooLarge if the decoded body is longer than maxBytes.
+func decodeBody(encoding string, body []byte, maxBytes int64) ([]byte, error) {
+	enc, ok := bodyEncoding(encoding)
+	if !ok {
+		return body, nil
+	}
+	r, err := enc.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := ioutil.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(plain)) > maxBytes {
+		return nil, errDecodedBodyTooLarge
+	}
+	return plain, nil
+}
+
+// encodeBody encodes body with encoding, one of the supportedEncoding ones
+func encodeBody(encoding string, body []byte) ([]byte, error) {
+	if encoding == "" || encoding == "identity" {
+		return body, nil
+	}
+	enc, ok := bodyEncoding(encoding)
+	if !ok {
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	var buf bytes.Buffer
+	w, err := enc.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"log"
 	"net/http"
 	"time"
@@ -11,17 +10,13 @@ import (
 
 func main() {
 	proxy := goproxy.New()
-	proxy.OnRequest(goproxy.DstHostIs("www.reddit.com")).DoFunc(
-		func(r *http.Request, ctx context.Context) (*http.Request, *http.Response) {
-			h, _, _ := time.Now().Clock()
-			if h >= 8 && h <= 17 {
-				return r, goproxy.NewResponse(r,
-					goproxy.ContentTypeText, http.StatusForbidden,
-					"Don't waste your time!")
-			} else {
-				ctx.Warnf("clock: %d, you can waste your time...", h)
-			}
-			return r, nil
+	workHours := goproxy.TimeWindow(time.Date(0, 1, 1, 8, 0, 0, 0, time.Local),
+		time.Date(0, 1, 1, 18, 0, 0, 0, time.Local))
+	proxy.OnRequest(goproxy.DstHostIs("www.reddit.com"), workHours).DoFunc(
+		func(r *http.Request) (*http.Request, *http.Response) {
+			return r, goproxy.NewResponse(r,
+				goproxy.ContentTypeText, http.StatusForbidden,
+				"Don't waste your time!")
 		})
 	log.Fatalln(http.ListenAndServe(":8080", proxy))
 }
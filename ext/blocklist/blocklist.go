@@ -0,0 +1,206 @@
+// extension to goproxy blocking requests to the domains of large lists, such as ad and tracker
+// blocklists in hosts file format.
+package goproxy_blocklist
+
+import (
+	"bufio"
+	"hash/maphash"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/elazarl/goproxy2"
+)
+
+// entry flags
+const (
+	// blockDomain blocks the domain itself, and its subdomains
+	blockDomain = 1 << iota
+	// blockSubdomains blocks the subdomains of the domain only, as *.example.com
+	blockSubdomains
+)
+
+// hostsFileNames are the names hosts files map to the local host, which are not blocked
+var hostsFileNames = map[string]bool{"localhost": true, "localhost.localdomain": true, "local": true,
+	"broadcasthost": true, "ip6-localhost": true, "ip6-loopback": true, "0.0.0.0": true}
+
+// Blocklist is a set of blocked domains, matching a host in time proportional to its number of
+// labels, regardless of the size of the list. Domains are kept as 64 bit hashes, so large lists
+// take little memory. The domains are added while building the list, with Load or Add, and can
+// be replaced at any time with Reload.
+type Blocklist struct {
+	m atomic.Pointer[matcher]
+}
+
+// matcher is a set of blocked domains, never modified once used by a Blocklist
+type matcher struct {
+	seed    maphash.Seed
+	domains map[uint64]uint8
+}
+
+func newMatcher() *matcher {
+	return &matcher{seed: maphash.MakeSeed(), domains: make(map[uint64]uint8)}
+}
+
+// New returns an empty Blocklist
+func New() *Blocklist {
+	b := &Blocklist{}
+	b.m.Store(newMatcher())
+	return b
+}
+
+// Load reads a Blocklist from r, either in hosts file format, as "0.0.0.0 ads.example.com", or as
+// a list of domains, one per line. Text after # is ignored. See Add for the format of domains.
+func Load(r io.Reader) (*Blocklist, error) {
+	m, err := loadMatcher(r)
+	if err != nil {
+		return nil, err
+	}
+	b := &Blocklist{}
+	b.m.Store(m)
+	return b, nil
+}
+
+// LoadFile reads a Blocklist from the file at path, see Load
+func LoadFile(path string) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// Reload replaces the domains of b with the ones read from r, in the format of Load. Requests
+// being matched keep using the previous domains, later ones use the new domains. If reading r
+// fails, b is left unchanged. It is safe to call while b is in use, e.g. periodically:
+//
+//	for range time.Tick(time.Hour) {
+//		if err := b.ReloadFile("/etc/goproxy/blocklist"); err != nil {
+//			log.Println("blocklist reload:", err)
+//		}
+//	}
+func (b *Blocklist) Reload(r io.Reader) error {
+	m, err := loadMatcher(r)
+	if err != nil {
+		return err
+	}
+	b.m.Store(m)
+	return nil
+}
+
+// ReloadFile replaces the domains of b with the ones of the file at path, see Reload
+func (b *Blocklist) ReloadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.Reload(f)
+}
+
+func loadMatcher(r io.Reader) (*matcher, error) {
+	m := newMatcher()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			// hosts file line, the domains follow the address
+			for _, domain := range fields[1:] {
+				if !hostsFileNames[domain] {
+					m.add(domain)
+				}
+			}
+			continue
+		}
+		m.add(fields[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Add blocks domain and its subdomains, or only its subdomains if domain starts with "*.", as
+// "*.example.com". Domains are case insensitive. Add is meant to build a Blocklist, it must not
+// be called once the list is in use, use Reload instead.
+func (b *Blocklist) Add(domain string) {
+	b.m.Load().add(domain)
+}
+
+func (m *matcher) add(domain string) {
+	flag := uint8(blockDomain)
+	if strings.HasPrefix(domain, "*.") {
+		domain, flag = domain[2:], blockSubdomains
+	}
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if domain == "" {
+		return
+	}
+	h := maphash.String(m.seed, domain)
+	m.domains[h] |= flag
+}
+
+// Len returns the number of blocked domains
+func (b *Blocklist) Len() int {
+	return len(b.m.Load().domains)
+}
+
+// Blocks returns whether host, possibly with a port, is blocked
+func (b *Blocklist) Blocks(host string) bool {
+	return b.m.Load().blocks(host)
+}
+
+func (m *matcher) blocks(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for sub := false; ; sub = true {
+		if flag, ok := m.domains[maphash.String(m.seed, host)]; ok {
+			if flag&blockDomain != 0 || sub && flag&blockSubdomains != 0 {
+				return true
+			}
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+// HandleReq makes a Blocklist a goproxy.ReqCondition, matching requests to blocked hosts
+func (b *Blocklist) HandleReq(req *http.Request) bool {
+	return b.Blocks(req.URL.Host)
+}
+
+func (b *Blocklist) HandleResp(req *http.Request, resp *http.Response) bool {
+	return b.HandleReq(req)
+}
+
+// Register makes proxy answer requests to blocked hosts with 403 Forbidden, and reject CONNECT
+// requests to them. Register it before other handlers.
+func (b *Blocklist) Register(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest(b).DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		return req, blockedResponse(req)
+	})
+	proxy.OnRequest(b).HandleConnect(goproxy.FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *goproxy.ConnectAction, string) {
+		req = req.WithContext(goproxy.CtxWithResp(req.Context(), blockedResponse(req)))
+		return req, goproxy.RejectConnect, host
+	}))
+}
+
+func blockedResponse(req *http.Request) *http.Response {
+	return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "Blocked by the proxy")
+}
@@ -0,0 +1,132 @@
+package goproxy_blocklist
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/elazarl/goproxy2"
+)
+
+const hostsFile = `# ad servers
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.net # trailing comment
+::1 ip6-localhost
+Metrics.Example.org
+*.wild.example.com
+`
+
+func TestBlocks(t *testing.T) {
+	b, err := Load(strings.NewReader(hostsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != 4 {
+		t.Error("Expected 4 blocked domains, got", b.Len())
+	}
+	for host, expected := range map[string]bool{
+		"ads.example.com":         true,
+		"ads.example.com:443":     true,
+		"x.ads.example.com":       true,
+		"ADS.example.com.":        true,
+		"example.com":             false,
+		"notads.example.com":      false,
+		"tracker.example.net":     true,
+		"metrics.example.org":     true,
+		"localhost":               false,
+		"wild.example.com":        false,
+		"a.wild.example.com":      true,
+		"a.b.wild.example.com:80": true,
+	} {
+		if blocked := b.Blocks(host); blocked != expected {
+			t.Errorf("Expected %s to be blocked: %v, got %v", host, expected, blocked)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	b := New()
+	b.Add("blocked.test")
+	proxy := goproxy.New()
+	b.Register(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	resp, err := client.Get("http://www.blocked.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected blocked requests to be forbidden, got", resp.Status)
+	}
+	if _, err := client.Get("https://blocked.test/"); err == nil || !strings.Contains(err.Error(), "Forbidden") {
+		t.Error("Expected CONNECT to blocked hosts to be rejected, got", err)
+	}
+	resp, err = client.Get("http://" + originURL.Host + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Expected other requests to go through, got", resp.Status)
+	}
+}
+
+func TestReload(t *testing.T) {
+	b, err := Load(strings.NewReader("old.example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				b.Blocks("old.example.com")
+			}
+		}
+	}()
+	if err := b.Reload(strings.NewReader("new.example.com\n")); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	wg.Wait()
+	if b.Blocks("old.example.com") || !b.Blocks("new.example.com") {
+		t.Error("Expected the reloaded domains to replace the previous ones")
+	}
+	if err := b.ReloadFile("/no/such/blocklist"); err == nil {
+		t.Error("Expected reloading a missing file to fail")
+	}
+	if !b.Blocks("new.example.com") {
+		t.Error("Expected a failed reload to keep the domains")
+	}
+}
+
+func BenchmarkBlocks(b *testing.B) {
+	list := New()
+	for i := 0; i < 1000000; i++ {
+		list.Add(fmt.Sprintf("ads%d.example.com", i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		list.Blocks("static.cdn.ads999.example.com")
+	}
+}
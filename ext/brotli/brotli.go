@@ -0,0 +1,19 @@
+// extension to goproxy that will allow HandleBody to transform brotli compressed response bodies.
+// It registers the br content coding with goproxy.RegisterBodyEncoding when imported:
+//
+//	import _ "github.com/elazarl/goproxy2/ext/brotli"
+package goproxy_brotli
+
+import (
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/elazarl/goproxy2"
+)
+
+func init() {
+	goproxy.RegisterBodyEncoding("br", goproxy.BodyEncoding{
+		NewReader: func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return brotli.NewWriter(w), nil },
+	})
+}
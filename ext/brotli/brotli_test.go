@@ -0,0 +1,40 @@
+package goproxy_brotli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/elazarl/goproxy2"
+)
+
+func TestHandleBodyBrotli(t *testing.T) {
+	var buf bytes.Buffer
+	w := brotli.NewWriter(&buf)
+	w.Write([]byte("hello cloud"))
+	w.Close()
+
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	resp := &http.Response{Header: http.Header{"Content-Encoding": {"br"}}, Body: ioutil.NopCloser(&buf)}
+	_, resp = goproxy.HandleBody(func(req *http.Request, body []byte) []byte {
+		return bytes.ReplaceAll(body, []byte("cloud"), []byte("butt"))
+	}).Handle(req, resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(body)))
+	if err != nil {
+		t.Fatal("Expected a brotli encoded body:", err)
+	}
+	if string(plain) != "hello butt" {
+		t.Errorf("Expected the body to be rewritten, got %q", plain)
+	}
+
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	if req, _ = goproxy.AcceptSupportedEncodings.Handle(req); req.Header.Get("Accept-Encoding") != "gzip, br" {
+		t.Error("Expected br to be accepted, got", req.Header.Get("Accept-Encoding"))
+	}
+}
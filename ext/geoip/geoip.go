@@ -0,0 +1,136 @@
+// extension to goproxy that will allow you to match requests by the country or the
+// autonomous system of their destination, using a MaxMind GeoIP2/GeoLite2 database.
+package goproxy_geoip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy2"
+	"github.com/oschwald/geoip2-golang"
+)
+
+// CacheTTL is the time a resolved destination host is kept in the DNS cache
+var CacheTTL = 5 * time.Minute
+
+// CacheSize is the maximum number of hosts kept in the DNS cache. Clients choose the hosts, so
+// the cache is bounded, not to grow without limit.
+var CacheSize = 1000
+
+// DB looks up the location of IPs. It is implemented by *geoip2.Reader.
+type DB interface {
+	Country(ip net.IP) (*geoip2.Country, error)
+	ASN(ip net.IP) (*geoip2.ASN, error)
+}
+
+var _ DB = (*geoip2.Reader)(nil)
+
+type cacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+var dnsCache = struct {
+	sync.Mutex
+	hosts map[string]cacheEntry
+}{hosts: make(map[string]cacheEntry)}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
+
+// resolve returns the IPs of the destination host of the request, caching the results
+// to avoid a DNS lookup on every request.
+func resolve(req *http.Request) []net.IP {
+	host := stripPort(req.URL.Host)
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	now := time.Now()
+	dnsCache.Lock()
+	entry, ok := dnsCache.hosts[host]
+	dnsCache.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.ips
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(req.Context(), host)
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	dnsCache.Lock()
+	cacheIPs(host, cacheEntry{ips, now.Add(CacheTTL)}, now)
+	dnsCache.Unlock()
+	return ips
+}
+
+// cacheIPs adds entry for host to dnsCache, which must be locked. When the cache is full,
+// expired entries are removed, and if none expired, arbitrary ones.
+func cacheIPs(host string, entry cacheEntry, now time.Time) {
+	hosts := dnsCache.hosts
+	if _, ok := hosts[host]; !ok && len(hosts) >= CacheSize {
+		for h, e := range hosts {
+			if !now.Before(e.expires) {
+				delete(hosts, h)
+			}
+		}
+		for h := range hosts {
+			if len(hosts) < CacheSize {
+				break
+			}
+			delete(hosts, h)
+		}
+	}
+	hosts[host] = entry
+}
+
+// DstCountryIs returns a ReqCondition testing whether the destination host of the request
+// resolves to an IP located in one of the given countries, by their ISO 3166-1 code, e.g. "US".
+func DstCountryIs(db DB, codes ...string) goproxy.ReqConditionFunc {
+	codeSet := make(map[string]bool)
+	for _, code := range codes {
+		codeSet[strings.ToUpper(code)] = true
+	}
+	return func(req *http.Request) bool {
+		for _, ip := range resolve(req) {
+			country, err := db.Country(ip)
+			if err != nil {
+				continue
+			}
+			if codeSet[country.Country.IsoCode] {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// DstASNIs returns a ReqCondition testing whether the destination host of the request
+// resolves to an IP belonging to one of the given autonomous system numbers.
+func DstASNIs(db DB, asns ...uint) goproxy.ReqConditionFunc {
+	asnSet := make(map[uint]bool)
+	for _, asn := range asns {
+		asnSet[asn] = true
+	}
+	return func(req *http.Request) bool {
+		for _, ip := range resolve(req) {
+			asn, err := db.ASN(ip)
+			if err != nil {
+				continue
+			}
+			if asnSet[asn.AutonomousSystemNumber] {
+				return true
+			}
+		}
+		return false
+	}
+}
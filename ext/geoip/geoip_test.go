@@ -0,0 +1,97 @@
+package goproxy_geoip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// memoryDB is a DB locating the IPs in its maps
+type memoryDB struct {
+	countries map[string]string
+	asns      map[string]uint
+}
+
+var errNotFound = errors.New("not found")
+
+func (db memoryDB) Country(ip net.IP) (*geoip2.Country, error) {
+	code, ok := db.countries[ip.String()]
+	if !ok {
+		return nil, errNotFound
+	}
+	country := &geoip2.Country{}
+	country.Country.IsoCode = code
+	return country, nil
+}
+
+func (db memoryDB) ASN(ip net.IP) (*geoip2.ASN, error) {
+	asn, ok := db.asns[ip.String()]
+	if !ok {
+		return nil, errNotFound
+	}
+	return &geoip2.ASN{AutonomousSystemNumber: asn}, nil
+}
+
+var db = memoryDB{
+	countries: map[string]string{"192.0.2.1": "US", "2001:db8::1": "FR"},
+	asns:      map[string]uint{"192.0.2.1": 64496},
+}
+
+func newRequest(t *testing.T, url string) *http.Request {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestDstCountryIs(t *testing.T) {
+	cond := DstCountryIs(db, "us", "FR")
+	for url, expected := range map[string]bool{
+		"http://192.0.2.1/":         true,
+		"http://192.0.2.1:8080/":    true,
+		"http://[2001:db8::1]:443/": true,
+		"http://192.0.2.2/":         false,
+	} {
+		if cond(newRequest(t, url)) != expected {
+			t.Errorf("Expected DstCountryIs of %s to be %v", url, expected)
+		}
+	}
+}
+
+func TestDstASNIs(t *testing.T) {
+	cond := DstASNIs(db, 64496)
+	if !cond(newRequest(t, "http://192.0.2.1/")) {
+		t.Error("Expected the ASN of 192.0.2.1 to match")
+	}
+	if cond(newRequest(t, "http://[2001:db8::1]/")) {
+		t.Error("Expected an IP without an ASN not to match")
+	}
+}
+
+func TestCacheBounded(t *testing.T) {
+	defer func(size int) { CacheSize = size }(CacheSize)
+	CacheSize = 3
+	dnsCache.Lock()
+	defer dnsCache.Unlock()
+	saved := dnsCache.hosts
+	defer func() { dnsCache.hosts = saved }()
+	dnsCache.hosts = make(map[string]cacheEntry)
+
+	now := time.Now()
+	cacheIPs("expired.invalid", cacheEntry{expires: now.Add(-time.Second)}, now)
+	for i := 0; i < 10; i++ {
+		cacheIPs(fmt.Sprint("host", i, ".invalid"), cacheEntry{expires: now.Add(time.Hour)}, now)
+		if n := len(dnsCache.hosts); n > CacheSize {
+			t.Fatal("Expected the cache to keep at most", CacheSize, "hosts, got", n)
+		}
+	}
+	if _, ok := dnsCache.hosts["host9.invalid"]; !ok {
+		t.Error("Expected the last resolved host to be cached")
+	}
+}
@@ -4,7 +4,6 @@ package goproxy_html
 import (
 	"bytes"
 	"context"
-	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -49,6 +48,8 @@ func HandleString(f func(s string, ctx context.Context) string) goproxy.RespHand
 
 // Will receive an input stream which would convert the response to utf-8
 // The given function must close the reader r, in order to close the response body.
+// The transformed body is buffered in a goproxy.SpillBuffer, which spills to disk past
+// goproxy.DefaultSpillThreshold bytes, so large pages do not exhaust the memory of the proxy.
 func HandleStringReader(f func(r io.Reader, ctx context.Context) io.Reader) goproxy.RespHandler {
 	return goproxy.FuncRespHandler(func(resp *http.Response, ctx context.Context) *http.Response {
 		if ctx.Error != nil {
@@ -59,6 +60,7 @@ func HandleStringReader(f func(r io.Reader, ctx context.Context) io.Reader) gopr
 			charsetName = "utf-8"
 		}
 
+		var transformed io.Reader
 		if strings.ToLower(charsetName) != "utf-8" {
 			r, err := charset.NewReader(charsetName, resp.Body)
 			if err != nil {
@@ -70,36 +72,17 @@ func HandleStringReader(f func(r io.Reader, ctx context.Context) io.Reader) gopr
 				ctx.Warnf("Can't translate to %v from utf-8: %v", charsetName, err)
 				return resp
 			}
-			if err != nil {
-				ctx.Warnf("Cannot translate to %v: %v", charsetName, err)
-				return resp
-			}
-			newr := charset.NewTranslatingReader(f(r, ctx), tr)
-			resp.Body = &readFirstCloseBoth{ioutil.NopCloser(newr), resp.Body}
+			transformed = charset.NewTranslatingReader(f(r, ctx), tr)
 		} else {
 			//no translation is needed, already at utf-8
-			resp.Body = &readFirstCloseBoth{ioutil.NopCloser(f(resp.Body, ctx)), resp.Body}
+			transformed = f(resp.Body, ctx)
+		}
+		if err := goproxy.TransformResponseBody(resp, 0, func(dst io.Writer, src io.Reader) error {
+			_, err := io.Copy(dst, transformed)
+			return err
+		}); err != nil {
+			ctx.Warnf("Cannot transform response body: %v", err)
 		}
 		return resp
 	})
 }
-
-type readFirstCloseBoth struct {
-	r io.ReadCloser
-	c io.Closer
-}
-
-func (rfcb *readFirstCloseBoth) Read(b []byte) (nr int, err error) {
-	return rfcb.r.Read(b)
-}
-func (rfcb *readFirstCloseBoth) Close() error {
-	err1 := rfcb.r.Close()
-	err2 := rfcb.c.Close()
-	if err1 != nil && err2 != nil {
-		return errors.New(err1.Error() + ", " + err2.Error())
-	}
-	if err1 != nil {
-		return err1
-	}
-	return err2
-}
@@ -1,13 +1,14 @@
 package goproxy_image
 
 import (
-	"bytes"
 	"image"
 	_ "image/gif"
 	"image/jpeg"
 	"image/png"
-	"io/ioutil"
+	"io"
+	"mime"
 	"net/http"
+	"strings"
 
 	. "github.com/elazarl/goproxy2"
 	"github.com/elazarl/goproxy2/regretable"
@@ -21,9 +22,46 @@ var RespIsImage = ContentTypeIs("image/gif",
 
 // "image/tiff" tiff support is in external package, and rarely used, so we omitted it
 
+// HandleImage returns a RespHandler calling f with the decoded images of image responses, and
+// answering with the image f returns. The decoded image is held in memory, so this is not meant
+// for huge images; only the encoded result is buffered in a SpillBuffer, which spills to disk.
 func HandleImage(f func(req *http.Request, img image.Image) image.Image) RespHandler {
+	return handleImage(f, false)
+}
+
+// HandleImageSniffing is like HandleImage, but decides whether the response is an image by sniffing
+// its first bytes with http.DetectContentType. Use it to transform images served with a wrong
+// Content-Type, such as application/octet-stream. Responses of unknown length are only sniffed
+// if they have no Content-Type, or an image or octet-stream one, not to hold streamed responses.
+func HandleImageSniffing(f func(req *http.Request, img image.Image) image.Image) RespHandler {
+	return handleImage(f, true)
+}
+
+// sniffedImageTypes are the sniffed content types HandleImageSniffing transforms
+var sniffedImageTypes = map[string]bool{"image/gif": true, "image/jpeg": true, "image/png": true}
+
+// sniffable returns whether resp may be an image, and is worth sniffing: it has no Content-Type,
+// an image or octet-stream one, or a known length. Other responses, e.g. streamed HTML pages, are
+// passed on without waiting for their first bytes.
+func sniffable(resp *http.Response) bool {
+	if resp.ContentLength == 0 {
+		return false
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" || resp.ContentLength > 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "image/") || mediaType == "application/octet-stream" ||
+		mediaType == "binary/octet-stream"
+}
+
+func handleImage(f func(req *http.Request, img image.Image) image.Image, sniff bool) RespHandler {
 	return FuncRespHandler(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
-		if !RespIsImage.HandleResp(req, resp) {
+		if resp == nil || (!sniff && !RespIsImage.HandleResp(req, resp)) {
 			return req, resp
 		}
 		if resp.StatusCode != 200 {
@@ -31,43 +69,63 @@ func HandleImage(f func(req *http.Request, img image.Image) image.Image) RespHan
 			return req, resp
 		}
 		contentType := resp.Header.Get("Content-Type")
+		if sniff && !sniffable(resp) {
+			return req, resp
+		}
 
 		const kb = 1024
 		regret := regretable.NewRegretableReaderCloserSize(resp.Body, 16*kb)
-		resp.Body = regret
+		// when it is not an image, the body is restored as is, with its length
+		resp.Body = PeekedBody(resp.Body, regret)
+		if sniff {
+			head := make([]byte, 512)
+			n, _ := io.ReadFull(regret, head)
+			regret.Regret()
+			contentType = http.DetectContentType(head[:n])
+			if !sniffedImageTypes[contentType] {
+				return req, resp
+			}
+			resp.Header.Set("Content-Type", contentType)
+		}
 		img, imgType, err := image.Decode(resp.Body)
 		if err != nil {
 			regret.Regret()
 			return req, resp
 		}
 		result := f(req, img)
-		buf := bytes.NewBuffer([]byte{})
+		// the decoded image is in memory anyway, but the encoded one is spilled to disk if large
+		buf := NewSpillBuffer(0)
 		switch contentType {
 		// No gif image encoder in go - convert to png
 		case "image/gif", "image/png":
 			if err := png.Encode(buf, result); err != nil {
+				buf.Close()
 				return req, resp
 			}
 			resp.Header.Set("Content-Type", "image/png")
 		case "image/jpeg", "image/pjpeg":
 			if err := jpeg.Encode(buf, result, nil); err != nil {
+				buf.Close()
 				return req, resp
 			}
 		case "application/octet-stream":
 			switch imgType {
 			case "jpeg":
 				if err := jpeg.Encode(buf, result, nil); err != nil {
+					buf.Close()
 					return req, resp
 				}
 			case "png", "gif":
 				if err := png.Encode(buf, result); err != nil {
+					buf.Close()
 					return req, resp
 				}
 			}
 		default:
 			panic("unhandlable type" + contentType)
 		}
-		resp.Body = ioutil.NopCloser(buf)
+		resp.Body.Close()
+		resp.Body = buf
 		return req, resp
 	})
 }
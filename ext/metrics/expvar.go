@@ -0,0 +1,82 @@
+// extension to goproxy publishing the metrics of a proxy with expvar, served as JSON on
+// /debug/vars by the net/http default mux. It is meant as an example of goproxy.Metrics
+// adapters, e.g. for Prometheus.
+package goproxy_metrics
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elazarl/goproxy2"
+)
+
+// DefaultLatencyBuckets are the upper bounds of the latency histogram buckets of NewExpvar
+var DefaultLatencyBuckets = []time.Duration{10 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second}
+
+// Expvar is a goproxy.Metrics counting requests, responses by status class, errors and CONNECT
+// requests by action, and keeping a histogram of latencies, in an expvar.Map:
+//
+//	requests                   proxied requests received
+//	responses_2xx, ...         responses sent, by status class
+//	errors                     requests failing to reach their origin, or to be sent back
+//	connect_accept, ...        CONNECT requests, by action
+//	latency_le_10ms, ...       responses sent within the bucket bound, cumulative
+//	latency_le_inf             all the responses sent
+//	latency_sum_ms             the sum of the latencies of all the responses
+type Expvar struct {
+	// Map holds the published metrics
+	Map     *expvar.Map
+	buckets []time.Duration
+}
+
+// NewExpvar returns an Expvar publishing its metrics as the expvar name, with the
+// DefaultLatencyBuckets. Like expvar.Publish, it panics if name is already used.
+//
+//	proxy.Metrics = goproxy_metrics.NewExpvar("goproxy")
+func NewExpvar(name string) *Expvar {
+	return &Expvar{Map: expvar.NewMap(name), buckets: DefaultLatencyBuckets}
+}
+
+func (e *Expvar) ObserveRequest(req *http.Request) {
+	e.Map.Add("requests", 1)
+}
+
+func (e *Expvar) ObserveResponse(req *http.Request, resp *http.Response, latency time.Duration) {
+	e.Map.Add("responses_"+strconv.Itoa(resp.StatusCode/100)+"xx", 1)
+	for _, b := range e.buckets {
+		if latency <= b {
+			e.Map.Add("latency_le_"+b.String(), 1)
+		}
+	}
+	e.Map.Add("latency_le_inf", 1)
+	e.Map.AddFloat("latency_sum_ms", float64(latency)/float64(time.Millisecond))
+}
+
+func (e *Expvar) ObserveError(req *http.Request, err error) {
+	e.Map.Add("errors", 1)
+}
+
+func (e *Expvar) ObserveConnect(host string, action *goproxy.ConnectAction) {
+	e.Map.Add("connect_"+actionName(action.Action), 1)
+}
+
+func actionName(action goproxy.ConnectActionLiteral) string {
+	switch action {
+	case goproxy.ConnectAccept:
+		return "accept"
+	case goproxy.ConnectReject:
+		return "reject"
+	case goproxy.ConnectMitm:
+		return "mitm"
+	case goproxy.ConnectHijack:
+		return "hijack"
+	case goproxy.ConnectHTTPMitm:
+		return "http_mitm"
+	case goproxy.ConnectProxyAuthHijack:
+		return "proxy_auth_hijack"
+	}
+	return "unknown"
+}
@@ -0,0 +1,44 @@
+package goproxy_metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/elazarl/goproxy2"
+)
+
+func TestExpvar(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(w, req)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+
+	proxy := goproxy.New()
+	metrics := NewExpvar("goproxy_test")
+	proxy.Metrics = metrics
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	for _, path := range []string{"/", "/", "/missing"} {
+		resp, err := client.Get(origin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	for name, expected := range map[string]string{"requests": "3", "responses_2xx": "2", "responses_4xx": "1", "latency_le_inf": "3"} {
+		if v := metrics.Map.Get(name); v == nil || v.String() != expected {
+			t.Errorf("Expected %s to be %s, got %v", name, expected, v)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// extension to goproxy that will allow you to save the traffic going through the proxy as a
+// mitmproxy flow file, to inspect it with mitmproxy tools, e.g. mitmweb -r capture.flows
+package goproxy_mitmflow
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy2"
+)
+
+// FlowFormatVersion is the mitmproxy flow format version of the written flows, the one of
+// mitmproxy 7. Newer mitmproxy versions upgrade flows of older versions when reading them.
+const FlowFormatVersion = 14
+
+// DefaultMaxBodySize is the number of bytes of request and response bodies saved in flows, if
+// Writer.MaxBodySize is zero.
+const DefaultMaxBodySize = 1 << 20
+
+// Writer writes the requests and responses going through a proxy to a mitmproxy flow file.
+type Writer struct {
+	// MaxBodySize is the number of bytes of every body saved in flows. Longer bodies are truncated
+	// in the flow, but sent in full. If zero, DefaultMaxBodySize is used.
+	MaxBodySize int
+	mu          sync.Mutex
+	w           io.Writer
+}
+
+// NewWriter returns a Writer writing flows to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+type ctxKey int
+
+const ctxKeyFlow ctxKey = 0
+
+// flow is a request and its response, as they are captured
+type flow struct {
+	id               string
+	req              *http.Request
+	reqBody          []byte
+	reqStart, reqEnd time.Time
+	resp             *http.Response
+	respBody         []byte
+	respStart        time.Time
+	err              error
+}
+
+// Capture registers handlers on proxy saving every request and its response as a flow, once the
+// response was sent to the client. Register it before handlers modifying requests, to save them
+// as they were sent by clients.
+//
+//	f, _ := os.Create("capture.flows")
+//	goproxy_mitmflow.NewWriter(f).Capture(proxy)
+func (fw *Writer) Capture(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		f := &flow{id: newID(), req: req, reqStart: time.Now()}
+		f.reqBody, _ = goproxy.BufferRequestBody(req, fw.maxBodySize())
+		f.reqEnd = time.Now()
+		req = req.WithContext(context.WithValue(req.Context(), ctxKeyFlow, f))
+		goproxy.CtxOnFinish(req.Context(), func() {
+			if err := fw.write(f); err != nil {
+				proxy.Loggers.Error.Log("event", "mitmflow write", "error", err.Error())
+			}
+		})
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		f, ok := req.Context().Value(ctxKeyFlow).(*flow)
+		if !ok {
+			return req, resp
+		}
+		f.respStart = time.Now()
+		if resp == nil {
+			f.err = goproxy.CtxError(req.Context())
+			return req, resp
+		}
+		f.resp = resp
+		f.respBody, resp.Body = bufferBody(resp.Body, fw.maxBodySize())
+		return req, resp
+	})
+}
+
+func (fw *Writer) maxBodySize() int {
+	if fw.MaxBodySize > 0 {
+		return fw.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+func (fw *Writer) write(f *flow) error {
+	var buf bytes.Buffer
+	if err := writeTnetstring(&buf, f.state()); err != nil {
+		return err
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	_, err := buf.WriteTo(fw.w)
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// bufferBody reads up to maxBytes from body, and returns them with a body reading the whole original
+func bufferBody(body io.ReadCloser, maxBytes int) ([]byte, io.ReadCloser) {
+	prefix := make([]byte, maxBytes)
+	n, err := io.ReadFull(body, prefix)
+	prefix = prefix[:n]
+	var rest io.Reader = body
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		rest = &errReader{err}
+	}
+	return prefix, readCloser{io.MultiReader(bytes.NewReader(prefix), rest), body}
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func newID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func timestamp(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+func headers(h http.Header) []interface{} {
+	var rv []interface{}
+	for k, vs := range h {
+		for _, v := range vs {
+			rv = append(rv, []interface{}{[]byte(k), []byte(v)})
+		}
+	}
+	return rv
+}
+
+func address(addr string) interface{} {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	p, _ := strconv.Atoi(port)
+	return []interface{}{host, p}
+}
+
+// state returns the flow in the structure mitmproxy serializes flows
+func (f *flow) state() map[string]interface{} {
+	req := f.req
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	nport, _ := strconv.Atoi(port)
+	path := req.URL.RequestURI()
+	state := map[string]interface{}{
+		"version":     FlowFormatVersion,
+		"type":        "http",
+		"id":          f.id,
+		"intercepted": false,
+		"is_replay":   nil,
+		"marked":      false,
+		"metadata":    map[string]interface{}{},
+		"error":       nil,
+		"client_conn": map[string]interface{}{
+			"id":                  newID(),
+			"address":             address(req.RemoteAddr),
+			"peername":            address(req.RemoteAddr),
+			"sockname":            nil,
+			"tls_established":     false,
+			"timestamp_start":     timestamp(f.reqStart),
+			"timestamp_end":       nil,
+			"timestamp_tls_setup": nil,
+			"sni":                 nil,
+			"alpn":                nil,
+			"tls_version":         nil,
+			"cipher_name":         nil,
+			"mitmcert":            nil,
+			"tls_extensions":      []interface{}{},
+		},
+		"server_conn": map[string]interface{}{
+			"id":                  newID(),
+			"address":             []interface{}{req.URL.Hostname(), nport},
+			"ip_address":          nil,
+			"source_address":      nil,
+			"tls_established":     req.URL.Scheme == "https",
+			"timestamp_start":     timestamp(f.reqStart),
+			"timestamp_end":       nil,
+			"timestamp_tcp_setup": nil,
+			"timestamp_tls_setup": nil,
+			"sni":                 req.URL.Hostname(),
+			"alpn":                nil,
+			"tls_version":         nil,
+			"via":                 nil,
+		},
+		"request": map[string]interface{}{
+			"http_version":    []byte(req.Proto),
+			"headers":         headers(req.Header),
+			"content":         f.reqBody,
+			"trailers":        nil,
+			"timestamp_start": timestamp(f.reqStart),
+			"timestamp_end":   timestamp(f.reqEnd),
+			"host":            req.URL.Hostname(),
+			"port":            nport,
+			"method":          []byte(req.Method),
+			"scheme":          []byte(req.URL.Scheme),
+			"authority":       []byte(""),
+			"path":            []byte(path),
+		},
+		"response": nil,
+	}
+	if f.resp != nil {
+		state["response"] = map[string]interface{}{
+			"http_version":    []byte(f.resp.Proto),
+			"headers":         headers(f.resp.Header),
+			"content":         f.respBody,
+			"trailers":        nil,
+			"timestamp_start": timestamp(f.respStart),
+			"timestamp_end":   timestamp(time.Now()),
+			"status_code":     f.resp.StatusCode,
+			"reason":          []byte(http.StatusText(f.resp.StatusCode)),
+		}
+	}
+	if f.err != nil {
+		state["error"] = map[string]interface{}{
+			"msg":       f.err.Error(),
+			"timestamp": timestamp(f.respStart),
+		}
+	}
+	return state
+}
@@ -0,0 +1,64 @@
+package goproxy_mitmflow
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/elazarl/goproxy2"
+)
+
+func TestWriteTnetstring(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeTnetstring(&buf, map[string]interface{}{
+		"b": []interface{}{[]byte("ab"), 12, true, nil},
+		"a": 1.5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "38:1:a;3:1.5^1:b;20:2:ab,2:12#4:true!0:~]}"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestCapture(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(w, req.Body)
+	}))
+	defer origin.Close()
+
+	var flows bytes.Buffer
+	proxy := goproxy.New()
+	NewWriter(&flows).Capture(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+
+	resp, err := client.Post(origin.URL+"/echo?x=1", "text/plain", strings.NewReader("panda"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "panda" {
+		t.Error("Expected body to be sent in full, got", string(b))
+	}
+
+	flow := flows.String()
+	for _, s := range []string{"4:path;9:/echo?x=1,", "7:content;5:panda,", "11:status_code;3:200#", "4:type;4:http;"} {
+		if !strings.Contains(flow, s) {
+			t.Errorf("Expected flow to contain %q, got %q", s, flow)
+		}
+	}
+	if !strings.HasSuffix(flow, "}") {
+		t.Error("Expected flow to be a dict, got", flow)
+	}
+}
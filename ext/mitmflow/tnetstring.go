@@ -0,0 +1,61 @@
+package goproxy_mitmflow
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// writeTnetstring writes v to buf as a tnetstring, the serialization mitmproxy uses for flows.
+// Supported types are nil, bool, int, int64, float64, string, []byte, []interface{} and
+// map[string]interface{}. Maps are written with sorted keys.
+func writeTnetstring(buf *bytes.Buffer, v interface{}) error {
+	var payload []byte
+	var tag byte
+	switch v := v.(type) {
+	case nil:
+		tag = '~'
+	case bool:
+		payload, tag = []byte(strconv.FormatBool(v)), '!'
+	case int:
+		payload, tag = []byte(strconv.Itoa(v)), '#'
+	case int64:
+		payload, tag = []byte(strconv.FormatInt(v, 10)), '#'
+	case float64:
+		payload, tag = []byte(strconv.FormatFloat(v, 'f', -1, 64)), '^'
+	case string:
+		payload, tag = []byte(v), ';'
+	case []byte:
+		payload, tag = v, ','
+	case []interface{}:
+		var items bytes.Buffer
+		for _, item := range v {
+			if err := writeTnetstring(&items, item); err != nil {
+				return err
+			}
+		}
+		payload, tag = items.Bytes(), ']'
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var items bytes.Buffer
+		for _, k := range keys {
+			writeTnetstring(&items, k)
+			if err := writeTnetstring(&items, v[k]); err != nil {
+				return err
+			}
+		}
+		payload, tag = items.Bytes(), '}'
+	default:
+		return fmt.Errorf("cannot write %T as tnetstring", v)
+	}
+	buf.WriteString(strconv.Itoa(len(payload)))
+	buf.WriteByte(':')
+	buf.Write(payload)
+	buf.WriteByte(tag)
+	return nil
+}
@@ -0,0 +1,96 @@
+// extension to goproxy that will allow you to inspect multipart/form-data uploads, part by part,
+// as they stream through the proxy.
+package goproxy_multipart
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+
+	"github.com/elazarl/goproxy2"
+)
+
+// Part describes a single part of a multipart/form-data request body
+type Part struct {
+	Header   textproto.MIMEHeader
+	FormName string
+	FileName string
+	// Peek holds up to the first peekSize bytes of the part body. It is only valid
+	// during the call to the inspecting function.
+	Peek []byte
+}
+
+// InspectParts returns a ReqHandler calling f with every part of multipart/form-data requests, as
+// the request body is streamed to the destination server. Only the first peekSize bytes of every part
+// are buffered, so large file uploads are never held in memory.
+// If f returns an error, the upload is aborted, and the request to the destination server fails.
+// Since the body is reconstructed part by part, its length might change, and it is sent chunked.
+// The original body is closed once the new one is read to its end, closed, or the proxy is done
+// with the request.
+//
+//	proxy.OnRequest().Do(goproxy_multipart.InspectParts(512, func(req *http.Request, part *goproxy_multipart.Part) error {
+//		if strings.HasSuffix(part.FileName, ".exe") {
+//			return errors.New("executable uploads are forbidden")
+//		}
+//		return nil
+//	}))
+func InspectParts(peekSize int, f func(req *http.Request, part *Part) error) goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request) (*http.Request, *http.Response) {
+		if req.Body == nil {
+			return req, nil
+		}
+		mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+			return req, nil
+		}
+		body := req.Body
+		pr, pw := io.Pipe()
+		go func() {
+			defer body.Close()
+			pw.CloseWithError(streamParts(req, body, pw, params["boundary"], peekSize, f))
+		}()
+		// if the request is never sent, e.g. a later handler answers it, nothing reads the pipe,
+		// closing it stops the goroutine
+		goproxy.CtxOnFinish(req.Context(), func() { pr.Close() })
+		req.Body = pr
+		req.ContentLength = -1
+		req.Header.Del("Content-Length")
+		return req, nil
+	})
+}
+
+func streamParts(req *http.Request, r io.Reader, w io.Writer, boundary string, peekSize int, f func(req *http.Request, part *Part) error) error {
+	reader := multipart.NewReader(r, boundary)
+	writer := multipart.NewWriter(w)
+	if err := writer.SetBoundary(boundary); err != nil {
+		return err
+	}
+	peek := make([]byte, peekSize)
+	for {
+		p, err := reader.NextRawPart()
+		if err == io.EOF {
+			return writer.Close()
+		}
+		if err != nil {
+			return err
+		}
+		n, err := io.ReadFull(p, peek)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		part := &Part{Header: p.Header, FormName: p.FormName(), FileName: p.FileName(), Peek: peek[:n]}
+		if err := f(req, part); err != nil {
+			return err
+		}
+		dst, err := writer.CreatePart(p.Header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(dst, io.MultiReader(bytes.NewReader(peek[:n]), p)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package goproxy_multipart
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy2"
+)
+
+func newUpload(t *testing.T) (*http.Request, []byte) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	w.WriteField("name", "panda")
+	fw, err := w.CreateFormFile("file", "panda.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(bytes.Repeat([]byte("MZ"), 1000))
+	w.Close()
+	expected := body.Bytes()
+	req, err := http.NewRequest("POST", "http://example.com/upload", bytes.NewReader(expected))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req, expected
+}
+
+func TestInspectParts(t *testing.T) {
+	req, expected := newUpload(t)
+	var names, files, peeks []string
+	req, _ = InspectParts(4, func(req *http.Request, part *Part) error {
+		names = append(names, part.FormName)
+		files = append(files, part.FileName)
+		peeks = append(peeks, string(part.Peek))
+		return nil
+	}).Handle(req)
+	actual, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal("Cannot read inspected body", err)
+	}
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("Expected body to be reconstructed as is\n%q\ngot\n%q", expected, actual)
+	}
+	if strings.Join(names, ",") != "name,file" || strings.Join(files, ",") != ",panda.exe" ||
+		strings.Join(peeks, ",") != "pand,MZMZ" {
+		t.Error("Unexpected parts", names, files, peeks)
+	}
+}
+
+func TestInspectPartsAbort(t *testing.T) {
+	forbidden := errors.New("no executables")
+	req, _ := newUpload(t)
+	req, _ = InspectParts(4, func(req *http.Request, part *Part) error {
+		if strings.HasSuffix(part.FileName, ".exe") {
+			return forbidden
+		}
+		return nil
+	}).Handle(req)
+	if _, err := ioutil.ReadAll(req.Body); err != forbidden {
+		t.Error("Expected upload to be aborted, got", err)
+	}
+}
+
+type closeNotifier struct {
+	*bytes.Reader
+	closed chan struct{}
+}
+
+func (c closeNotifier) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestInspectPartsUnsentRequest(t *testing.T) {
+	upload, expected := newUpload(t)
+	body := closeNotifier{bytes.NewReader(expected), make(chan struct{})}
+	req, err := http.NewRequest("POST", "http://example.com/upload", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = upload.Header
+
+	proxy := goproxy.New()
+	proxy.OnRequest().Do(InspectParts(4, func(req *http.Request, part *Part) error { return nil }))
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "blocked")
+	})
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	select {
+	case <-body.closed:
+	case <-time.After(time.Second):
+		t.Error("Expected the original body to be closed when the request is not sent")
+	}
+}
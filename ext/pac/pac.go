@@ -0,0 +1,134 @@
+// extension to goproxy choosing the upstream proxy of every request with a PAC (proxy
+// auto-config) file, evaluated with the pure Go JavaScript engine goja.
+package goproxy_pac
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/dop251/goja"
+	"github.com/elazarl/goproxy2"
+)
+
+// Script is a compiled PAC file. It is safe for concurrent use, calls are serialized, as a
+// JavaScript runtime is single threaded.
+type Script struct {
+	mu   sync.Mutex
+	vm   *goja.Runtime
+	find goja.Callable
+}
+
+// Compile runs the PAC file script, which must define FindProxyForURL(url, host). The PAC
+// functions to test hosts are available to it, except for the date and time ones.
+func Compile(script string) (*Script, error) {
+	vm := goja.New()
+	for name, f := range builtins {
+		if err := vm.Set(name, f); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := vm.RunString(script); err != nil {
+		return nil, err
+	}
+	find, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, errors.New("pac: FindProxyForURL is not defined")
+	}
+	return &Script{vm: vm, find: find}, nil
+}
+
+// FindProxyForURL returns the result of the FindProxyForURL function of the PAC file, as
+// "PROXY proxy.example.com:8080; DIRECT".
+func (s *Script) FindProxyForURL(url, host string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, err := s.find(goja.Undefined(), s.vm.ToValue(url), s.vm.ToValue(host))
+	if err != nil {
+		return "", err
+	}
+	return v.String(), nil
+}
+
+// SetPAC compiles the PAC file script, and makes proxy connect to origin servers through the
+// upstream proxies it chooses, see goproxy.ProxyHttpServer.SetPACFunc. DIRECT, PROXY and SOCKS
+// results are supported, and the connection is direct if evaluating the script fails.
+//
+//	if err := goproxy_pac.SetPAC(proxy, pacFile); err != nil {
+//		log.Fatal(err)
+//	}
+func SetPAC(proxy *goproxy.ProxyHttpServer, script string) error {
+	s, err := Compile(script)
+	if err != nil {
+		return err
+	}
+	proxy.SetPACFunc(s.FindProxyForURL)
+	return nil
+}
+
+// builtins are the functions PAC files may call, see
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_PAC_file
+var builtins = map[string]interface{}{
+	"isPlainHostName": func(host string) bool {
+		return !strings.Contains(host, ".")
+	},
+	"dnsDomainIs": func(host, domain string) bool {
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(domain))
+	},
+	"localHostOrDomainIs": func(host, hostdom string) bool {
+		host, hostdom = strings.ToLower(host), strings.ToLower(hostdom)
+		return host == hostdom || !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+".")
+	},
+	"isResolvable": func(host string) bool {
+		_, err := net.LookupHost(host)
+		return err == nil
+	},
+	"dnsResolve": dnsResolve,
+	"isInNet": func(host, pattern, mask string) bool {
+		ip := net.ParseIP(dnsResolve(host))
+		network, m := net.ParseIP(pattern), net.ParseIP(mask)
+		if ip == nil || network == nil || m == nil {
+			return false
+		}
+		ip, network, m = ip.To4(), network.To4(), m.To4()
+		if ip == nil || network == nil || m == nil {
+			return false
+		}
+		return ip.Mask(net.IPMask(m)).Equal(network.Mask(net.IPMask(m)))
+	},
+	"myIpAddress": func() string {
+		// the address of the interface routing to the internet, no packet is sent
+		c, err := net.Dial("udp", "8.8.8.8:53")
+		if err != nil {
+			return "127.0.0.1"
+		}
+		defer c.Close()
+		return c.LocalAddr().(*net.UDPAddr).IP.String()
+	},
+	"dnsDomainLevels": func(host string) int {
+		return strings.Count(host, ".")
+	},
+	"shExpMatch": func(str, shexp string) bool {
+		re, err := regexp.Compile("^" + strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(regexp.QuoteMeta(shexp)) + "$")
+		return err == nil && re.MatchString(str)
+	},
+}
+
+// dnsResolve returns the first IPv4 address of host, or "" if it cannot be resolved
+func dnsResolve(host string) string {
+	if ip := net.ParseIP(host); ip != nil {
+		return host
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return ""
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,42 @@
+package goproxy_pac
+
+import "testing"
+
+const pacFile = `
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || dnsDomainIs(host, ".intranet.example.com")) {
+		return "DIRECT";
+	}
+	if (shExpMatch(url, "https://*.example.org/*")) {
+		return "SOCKS socks.example.com:1080";
+	}
+	return "PROXY proxy.example.com:8080; DIRECT";
+}
+`
+
+func TestFindProxyForURL(t *testing.T) {
+	s, err := Compile(pacFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ url, host, expected string }{
+		{"http://wiki/", "wiki", "DIRECT"},
+		{"http://a.intranet.example.com/", "a.intranet.example.com", "DIRECT"},
+		{"https://www.example.org/", "www.example.org", "SOCKS socks.example.com:1080"},
+		{"http://example.net/", "example.net", "PROXY proxy.example.com:8080; DIRECT"},
+	} {
+		result, err := s.FindProxyForURL(tc.url, tc.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.expected {
+			t.Errorf("Expected %s for %s, got %s", tc.expected, tc.url, result)
+		}
+	}
+}
+
+func TestCompileWithoutFindProxyForURL(t *testing.T) {
+	if _, err := Compile("var x = 1;"); err == nil {
+		t.Error("Expected PAC files without FindProxyForURL to be rejected")
+	}
+}
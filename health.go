@@ -0,0 +1,49 @@
+package goproxy
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// healthCheckHandler answers requests to path with a fixed response, and passes the others to next
+type healthCheckHandler struct {
+	path   string
+	status int
+	body   []byte
+	length []string
+	next   http.Handler
+}
+
+// SetHealthCheck makes the proxy answer non-proxy requests to path, such as the /healthz checks
+// of a load balancer, with status and body. The response is prepared once, and served without
+// running any handler. Other non-proxy requests are still served by NonproxyHandler, so call it
+// after replacing NonproxyHandler.
+func (proxy *ProxyHttpServer) SetHealthCheck(path string, status int, body string) {
+	proxy.NonproxyHandler = &healthCheckHandler{
+		path:   path,
+		status: status,
+		body:   []byte(body),
+		length: []string{strconv.Itoa(len(body))},
+		next:   proxy.NonproxyHandler,
+	}
+}
+
+func (h *healthCheckHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != h.path {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	header := w.Header()
+	header["Content-Type"] = contentTypeTextHeader
+	header["Content-Length"] = h.length
+	header["Cache-Control"] = noCacheHeader
+	w.WriteHeader(h.status)
+	if r.Method != http.MethodHead {
+		w.Write(h.body)
+	}
+}
+
+var (
+	contentTypeTextHeader = []string{ContentTypeText + "; charset=utf-8"}
+	noCacheHeader         = []string{"no-cache"}
+)
@@ -0,0 +1,67 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// SetHostConcurrencyLimit limits the number of requests to host, with or without a port, that
+// are in flight at once to n. Requests beyond the limit wait for a previous one to finish, and
+// are answered with 503 Service Unavailable if the client gives up first. Use it to protect
+// fragile backends. A non positive n removes the limit.
+func (proxy *ProxyHttpServer) SetHostConcurrencyLimit(host string, n int) {
+	proxy.hostLimitsMu.Lock()
+	defer proxy.hostLimitsMu.Unlock()
+	host = hostLimitKey(host)
+	if n <= 0 {
+		delete(proxy.hostLimits, host)
+		return
+	}
+	if proxy.hostLimits == nil {
+		proxy.hostLimits = make(map[string]chan struct{})
+	}
+	proxy.hostLimits[host] = make(chan struct{}, n)
+}
+
+// hostLimitKey returns the name host is limited by, without its port, and IPv6 brackets
+func hostLimitKey(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return strings.ToLower(h)
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// acquireHostSlot waits until req may be sent under the concurrency limit of its host, if any.
+// The slot is released once the response was written to the client. It returns an error if the
+// request context is done before that.
+func (proxy *ProxyHttpServer) acquireHostSlot(req *http.Request) error {
+	proxy.hostLimitsMu.Lock()
+	host := req.URL.Host
+	if host == "" {
+		// requests read from HTTP MITM tunnels have a relative URL
+		host = req.Host
+	}
+	sem, ok := proxy.hostLimits[hostLimitKey(host)]
+	proxy.hostLimitsMu.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case sem <- struct{}{}:
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+	release := func() { <-sem }
+	if !CtxOnFinish(req.Context(), release) {
+		release()
+	}
+	return nil
+}
+
+// hostLimitResponse returns the response to a request that could not be sent because of the
+// concurrency limit of its host.
+func (proxy *ProxyHttpServer) hostLimitResponse(req *http.Request, err error) *http.Response {
+	proxy.Loggers.Error.Log("event", "host concurrency limit", "host", req.Host, "error", err.Error())
+	return NewResponse(req, ContentTypeText, http.StatusServiceUnavailable, "too many concurrent requests to "+req.Host)
+}
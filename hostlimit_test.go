@@ -0,0 +1,17 @@
+package goproxy
+
+import "testing"
+
+func TestHostLimitKey(t *testing.T) {
+	for host, expected := range map[string]string{
+		"Example.com":      "example.com",
+		"example.com:8080": "example.com",
+		"[::1]:80":         "::1",
+		"[::1]":            "::1",
+		"::1":              "::1",
+	} {
+		if key := hostLimitKey(host); key != expected {
+			t.Errorf("Expected the key of %s to be %s, got %s", host, expected, key)
+		}
+	}
+}
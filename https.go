@@ -2,9 +2,13 @@ package goproxy
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
@@ -15,6 +19,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type ConnectActionLiteral int
@@ -29,10 +34,12 @@ const (
 )
 
 var (
-	OkConnect       = &ConnectAction{Action: ConnectAccept, TLSConfig: TLSConfigFromCA(&GoproxyCa)}
-	MitmConnect     = &ConnectAction{Action: ConnectMitm, TLSConfig: TLSConfigFromCA(&GoproxyCa)}
-	HTTPMitmConnect = &ConnectAction{Action: ConnectHTTPMitm, TLSConfig: TLSConfigFromCA(&GoproxyCa)}
-	RejectConnect   = &ConnectAction{Action: ConnectReject, TLSConfig: TLSConfigFromCA(&GoproxyCa)}
+	// the default actions forge certificates with the CA of the proxy
+	proxyTLSConfig  = TLSConfigFromCA(nil)
+	OkConnect       = &ConnectAction{Action: ConnectAccept, TLSConfig: proxyTLSConfig}
+	MitmConnect     = &ConnectAction{Action: ConnectMitm, TLSConfig: proxyTLSConfig}
+	HTTPMitmConnect = &ConnectAction{Action: ConnectHTTPMitm, TLSConfig: proxyTLSConfig}
+	RejectConnect   = &ConnectAction{Action: ConnectReject, TLSConfig: proxyTLSConfig}
 	httpsRegexp     = regexp.MustCompile(`^https:\/\/`)
 )
 
@@ -40,6 +47,9 @@ type ConnectAction struct {
 	Action    ConnectActionLiteral
 	Hijack    func(req *http.Request, client net.Conn)
 	TLSConfig func(req *http.Request, host string) (*tls.Config, error)
+	// BytesPerSec, if positive, limits the rate of data sent in each direction of an accepted
+	// CONNECT tunnel, to simulate slow links.
+	BytesPerSec int
 }
 
 func stripPort(s string) string {
@@ -54,10 +64,56 @@ func (proxy *ProxyHttpServer) dial(ctx context.Context, network, addr string) (c
 	if proxy.Tr.DialContext != nil {
 		return proxy.Tr.DialContext(ctx, network, addr)
 	}
-	return net.Dial(network, addr)
+	return proxy.netDial(ctx, network, addr)
 }
 
-func (proxy *ProxyHttpServer) connectDial(ctx context.Context, network, addr string) (c net.Conn, err error) {
+// netDial creates a network connection, applying the proxy socket settings such as DialControl
+// and LocalAddr.
+// It is the default DialContext of the proxy transport. Since Transport prefers DialContext
+// to Dial, a Tr.Dial set by the user is called instead.
+func (proxy *ProxyHttpServer) netDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if proxy.Tr.Dial != nil {
+		return proxy.Tr.Dial(network, addr)
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   proxy.DialControl,
+		LocalAddr: proxy.LocalAddr,
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ips := ctxPinnedIPs(ctx, host); len(ips) > 0 {
+			// dial the IPs checked by DstIsPrivate, and not whatever host resolves to now
+			for _, ip := range ips {
+				var c net.Conn
+				if c, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+					return c, nil
+				}
+			}
+			return nil, err
+		}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// DialRoute is a route of ProxyHttpServer.DialRouter, dialing the CONNECT targets of the
+// requests matching Cond with Dial. A nil Dial connects directly.
+type DialRoute struct {
+	Cond ReqCondition
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// connectDial connects to addr, the target of the CONNECT request connect
+func (proxy *ProxyHttpServer) connectDial(ctx context.Context, connect *http.Request, network, addr string) (c net.Conn, err error) {
+	for _, route := range proxy.DialRouter {
+		if !route.Cond.HandleReq(connect) {
+			continue
+		}
+		if route.Dial == nil {
+			return proxy.dial(ctx, network, addr)
+		}
+		return route.Dial(ctx, network, addr)
+	}
 	if proxy.ConnectDial == nil {
 		return proxy.dial(ctx, network, addr)
 	}
@@ -76,104 +132,290 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 	if e != nil {
 		panic("Cannot hijack connection " + e.Error())
 	}
+	tun := proxy.openTunnel(proxyClient)
+	if tun == nil {
+		proxy.debugLog(r.Context()).Log("event", "connect during shutdown", "host", r.URL.Host)
+		io.WriteString(proxyClient, "HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\n\r\n")
+		proxyClient.Close()
+		return
+	}
+	defer tun.release()
 
-	proxy.Loggers.Debug.Log("event", "connect handlers", "nhandlers", len(proxy.httpsHandlers))
+	proxy.MITMEvents.connect(r)
+	httpsHandlers := proxy.ctxHandlers(r.Context()).https
+	proxy.debugLog(r.Context()).Log("event", "connect handlers", "client", ClientIP(r), "nhandlers", len(httpsHandlers))
 	todo, host := OkConnect, r.URL.Host
-	for i, h := range proxy.httpsHandlers {
+	connect := r
+	if proxy.DryRun {
+		// the handlers decide for a copy, the CONNECT is accepted as is
+		r = r.Clone(r.Context())
+	}
+	for i, h := range httpsHandlers {
 		req, newtodo, newhost := h.HandleConnect(r, host)
 		r = req
 
 		// If found a result, break the loop immediately
 		if newtodo != nil {
 			todo, host = newtodo, newhost
-			proxy.Loggers.Debug.Log("event", "connect handler result", "nhandler", i, "host", host, "action", todo)
+			proxy.debugLog(r.Context()).Log("event", "connect handler result", "nhandler", i, "host", host, "action", todo)
 			break
 		}
 	}
+	if proxy.DryRun {
+		proxy.dryRunConnect(connect, todo, host)
+		r, todo, host = connect, OkConnect, connect.URL.Host
+	}
 	r = r.WithContext(ctxWithConnectRequest(r.Context(), r))
+	proxy.MITMEvents.decision(r, host, todo)
+	proxy.metrics().ObserveConnect(host, todo)
+	if todo.Action == ConnectAccept || todo.Action == ConnectMitm || todo.Action == ConnectHTTPMitm {
+		if proxy.isSelfAddr(r, host) {
+			proxy.Loggers.Error.Log("event", "connect loop", "host", host)
+			if _, err := io.WriteString(proxyClient, "HTTP/1.1 508 Loop Detected\r\n\r\n"); err != nil {
+				proxy.Loggers.Error.Log("event", "connect loop write", "error", err.Error())
+			}
+			proxyClient.Close()
+			return
+		}
+	}
 	switch todo.Action {
 	case ConnectAccept:
 		if !hasPort.MatchString(host) {
 			host += ":80"
 		}
-		targetSiteCon, err := proxy.connectDial(r.Context(), "tcp", host)
+		targetSiteCon, err := proxy.connectDial(r.Context(), r, "tcp", host)
+		proxy.MITMEvents.originDial(r, host, err)
 		if err != nil {
 			proxy.Loggers.Error.Log("event", "accept connect error", "host", host, "error", err.Error())
 			proxy.httpError(proxyClient, err)
 			return
 		}
-		proxy.Loggers.Debug.Log("event", "accept connect", "host", host)
+		tun.add(targetSiteCon)
+		proxy.debugLog(r.Context()).Log("event", "accept connect", "host", host)
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 
 		targetTCP, targetOK := targetSiteCon.(CloseWriteReader)
 		proxyClientTCP, clientOK := proxyClient.(CloseWriteReader)
-		if targetOK && clientOK {
-			proxy.Loggers.Debug.Log("event", "connect", "type", "TCP")
-			go proxy.copyAndClose(targetTCP, proxyClientTCP)
-			go proxy.copyAndClose(proxyClientTCP, targetTCP)
+		if targetOK && clientOK && todo.BytesPerSec <= 0 {
+			proxy.debugLog(r.Context()).Log("event", "connect", "type", "TCP")
+			tun.goTunnel(func() {
+				var wg sync.WaitGroup
+				var sent, received int64
+				wg.Add(2)
+				go func() {
+					sent = proxy.copyAndClose(targetTCP, proxyClientTCP)
+					wg.Done()
+				}()
+				go func() {
+					received = proxy.copyAndClose(proxyClientTCP, targetTCP)
+					wg.Done()
+				}()
+				wg.Wait()
+				proxy.debugLog(r.Context()).Log("event", "connect done", "host", host, "sent", sent, "received", received)
+				proxy.MITMEvents.tunnelDone(r, host, sent, received)
+			})
 		} else {
-			proxy.Loggers.Debug.Log("event", "connect", "type", "reader")
-			go func() {
+			proxy.debugLog(r.Context()).Log("event", "connect", "type", "reader")
+			tun.goTunnel(func() {
 				var wg sync.WaitGroup
+				var sent, received int64
+				var fromClient, fromTarget io.Reader = proxyClient, targetSiteCon
+				if todo.BytesPerSec > 0 {
+					// the CONNECT request context is done once it is hijacked, the tunnel ends when closed
+					fromClient = NewThrottledReader(context.Background(), proxyClient, todo.BytesPerSec)
+					fromTarget = NewThrottledReader(context.Background(), targetSiteCon, todo.BytesPerSec)
+				}
 				wg.Add(2)
-				go proxy.copyOrWarn(targetSiteCon, proxyClient, &wg)
-				go proxy.copyOrWarn(proxyClient, targetSiteCon, &wg)
+				go func() {
+					sent = proxy.copyOrWarn(targetSiteCon, fromClient)
+					wg.Done()
+				}()
+				go func() {
+					received = proxy.copyOrWarn(proxyClient, fromTarget)
+					wg.Done()
+				}()
 				wg.Wait()
 				proxyClient.Close()
 				targetSiteCon.Close()
-
-			}()
+				proxy.debugLog(r.Context()).Log("event", "connect done", "host", host, "sent", sent, "received", received)
+				proxy.MITMEvents.tunnelDone(r, host, sent, received)
+			})
 		}
 
 	case ConnectHijack:
-		proxy.Loggers.Debug.Log("event", "hijack connect", "host", host)
+		proxy.debugLog(r.Context()).Log("event", "hijack connect", "host", host)
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 		todo.Hijack(r, proxyClient)
 	case ConnectHTTPMitm:
-		proxy.Loggers.Debug.Log("event", "connect HTTP MITM", "host", host)
+		proxy.debugLog(r.Context()).Log("event", "connect HTTP MITM", "host", host)
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
-		targetSiteCon, err := proxy.connectDial(r.Context(), "tcp", host)
+		var targetSiteCon net.Conn
+		var err error
+		if proxy.ConnectPool != nil {
+			targetSiteCon = proxy.ConnectPool.Get(host)
+		}
+		if targetSiteCon == nil {
+			err = proxy.retryMitmDial(r.Context(), func() (err error) {
+				targetSiteCon, err = proxy.connectDial(r.Context(), r, "tcp", host)
+				proxy.MITMEvents.originDial(r, host, err)
+				return err
+			})
+		}
+		client := proxy.newBufioReader(proxyClient)
 		if err != nil {
 			proxy.Loggers.Error.Log("event", "mitm error dial", "host", host, "error", err.Error())
+			// the client was told the tunnel is open, answer its request
+			if req, rerr := http.ReadRequest(client); rerr == nil {
+				proxy.writeGatewayError(proxyClient, req, err)
+			}
+			proxyClient.Close()
 			return
 		}
-		for {
-			client := bufio.NewReader(proxyClient)
-			remote := bufio.NewReader(targetSiteCon)
-			req, err := http.ReadRequest(client)
-			req = req.WithContext(ctxWithConnectRequest(req.Context(), r))
-			if err != nil && err != io.EOF {
-				proxy.Loggers.Error.Log("event", "HTTP MITM ReadRequest", "error", err.Error())
-			}
-			if err != nil {
-				return
-			}
-			req, resp := proxy.filterRequest(req)
-			if resp == nil {
-				if err := req.Write(targetSiteCon); err != nil {
-					proxy.httpError(proxyClient, err)
-					return
+		tun.add(targetSiteCon)
+		remoteLimit := &headerLimitReader{r: targetSiteCon, n: -1}
+		remote := proxy.newBufioReader(remoteLimit)
+		// reusable is whether the remote connection has no request in flight, and may be pooled
+		reusable := true
+		var releaseOnce sync.Once
+		releaseRemote := func() {
+			releaseOnce.Do(func() {
+				if reusable && proxy.ConnectPool != nil && remote.Buffered() == 0 {
+					proxy.ConnectPool.Put(host, targetSiteCon)
+				} else {
+					targetSiteCon.Close()
+				}
+			})
+		}
+		defer releaseRemote()
+		for nreq := 1; ; nreq++ {
+			// a closure per request, so that its deferred calls run when it is done, and do not
+			// pile up until the tunnel closes
+			more := func() bool {
+				req, err := http.ReadRequest(client)
+				if err != io.EOF {
+					proxy.MITMEvents.request(r, req, err)
+				}
+				if err != nil && err != io.EOF {
+					proxy.Loggers.Error.Log("event", "HTTP MITM ReadRequest", "error", err.Error())
+					proxy.writeBadRequest(proxyClient, r, err)
 				}
-				resp, err = http.ReadResponse(remote, req)
 				if err != nil {
+					return false
+				}
+				// the client asked to close the tunnel after this request
+				clientClose := req.Close
+				req = proxy.requestWithContext(req)
+				req = req.WithContext(ctxWithConnectRequest(req.Context(), r))
+				req = ctxWithEarlyHints(req, connEarlyHints(proxyClient))
+				req.RemoteAddr = r.RemoteAddr
+				start := time.Now()
+				proxy.metrics().ObserveRequest(req)
+				finishCtx := req.Context()
+				// runs callbacks of requests failing in the middle, finish is called explicitly otherwise
+				defer proxy.finish(finishCtx)
+				req, resp := proxy.filterRequest(req)
+				if resp == nil {
+					if err := proxy.acquireHostSlot(req); err != nil {
+						resp = proxy.hostLimitResponse(req, err)
+					}
+				}
+				var originBody io.ReadCloser
+				var originClose bool
+				if resp == nil {
+					reusable = false
+					if req.Close {
+						// closing the tunnel is up to the proxy, the remote connection may be pooled
+						req.Close = false
+						req.Header.Del("Connection")
+					}
+					if proxy.RequestTimeout > 0 {
+						targetSiteCon.SetDeadline(time.Now().Add(proxy.RequestTimeout))
+					}
+					err = req.Write(targetSiteCon)
+					if err == nil {
+						remoteLimit.n = proxy.maxResponseHeaderBytes()
+						resp, err = proxy.readResponse(remote, req)
+						remoteLimit.n = -1
+					}
+					if err != nil {
+						// like ServeHTTP, give the response handlers a chance to substitute a response
+						proxy.Loggers.Error.Log("event", "HTTP MITM RoundTrip", "host", host, "error", err.Error())
+						proxy.metrics().ObserveError(req, err)
+						req = req.WithContext(CtxWithError(req.Context(), err))
+						req, resp = proxy.filterResponse(req, nil)
+						if resp == nil {
+							proxy.writeGatewayError(proxyClient, req, err)
+							proxyClient.Close()
+							return false
+						}
+						// the connection to the remote site is unusable, send the response and close
+						if err := resp.Write(proxyClient); err != nil {
+							proxy.Loggers.Error.Log("event", "HTTP MITM write response", "error", err.Error())
+						}
+						resp.Body.Close()
+						proxyClient.Close()
+						return false
+					}
+					defer resp.Body.Close()
+					originBody, originClose = resp.Body, resp.Close
+				}
+				req, resp = proxy.filterResponse(req, resp)
+				resp = proxy.validResponse(req, resp)
+				http11 := req.ProtoAtLeast(1, 1)
+				if !http11 {
+					// answer HTTP/1.0 clients in their version, which has no chunked encoding
+					resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.0", 1, 0
+					if resp.ContentLength < 0 && len(resp.TransferEncoding) > 0 {
+						resp.TransferEncoding = nil
+						resp.Close = true
+					}
+				}
+				last := clientClose || resp.Close || proxy.MaxRequestsPerTunnel > 0 && nreq >= proxy.MaxRequestsPerTunnel
+				if last {
+					resp.Close = true
+				} else if !http11 {
+					// HTTP/1.0 connections are closed after every response, unless kept alive explicitly
+					resp.Header.Set("Connection", "keep-alive")
+				}
+				err = resp.Write(proxyClient)
+				if resp.Body != nil && resp.Body != originBody {
+					// Write only closes the body when it succeeds, and the body of the handlers, e.g. a
+					// SpillBuffer removing its file when closed, must not outlive the request
+					resp.Body.Close()
+				}
+				if err != nil {
+					proxy.metrics().ObserveError(req, err)
 					proxy.httpError(proxyClient, err)
-					return
+					return false
 				}
-				defer resp.Body.Close()
-			}
-			req, resp = proxy.filterResponse(req, resp)
-			if err := resp.Write(proxyClient); err != nil {
-				proxy.httpError(proxyClient, err)
+				proxy.metrics().ObserveResponse(req, resp, time.Since(start))
+				if originBody != nil {
+					// closing the body reads what is left of it, so that the next response can be read
+					reusable = !originClose && originBody.Close() == nil
+					if proxy.RequestTimeout > 0 {
+						targetSiteCon.SetDeadline(time.Time{})
+					}
+				}
+				proxy.finish(finishCtx)
+				if last {
+					proxy.debugLog(req.Context()).Log("event", "HTTP MITM close", "host", host, "nreq", nreq, "client close", clientClose)
+					releaseRemote()
+					proxyClient.Close()
+					return false
+				}
+				return true
+			}()
+			if !more {
 				return
 			}
 		}
 	case ConnectMitm:
-		proxy.Loggers.Debug.Log("event", "connect TLS MITM", "host", host)
+		proxy.debugLog(r.Context()).Log("event", "connect TLS MITM", "host", host)
 		proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
 		// this goes in a separate goroutine, so that the net/http server won't think we're
 		// still handling the request even after hijacking the connection. Those HTTP CONNECT
 		// request can take forever, and the server will be stuck when "closed".
-		// TODO: Allow Server.Close() mechanism to shut down this connection as nicely as possible
+		// proxy.Shutdown waits for it instead.
 		tlsConfig := defaultTLSConfig
 		if todo.TLSConfig != nil {
 			var err error
@@ -183,97 +425,199 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				return
 			}
 		}
-		go func() {
+		tun.goTunnel(func() {
 			//TODO: cache connections to the remote website
 			rawClientTls := tls.Server(proxyClient, tlsConfig)
-			if err := rawClientTls.Handshake(); err != nil {
+			err := rawClientTls.Handshake()
+			proxy.MITMEvents.clientHandshake(r, host, err)
+			if err != nil {
 				proxy.Loggers.Error.Log("event", "TLS MITM Handshake", "error", err.Error())
+				if proxy.OnMitmHandshakeError != nil {
+					proxy.OnMitmHandshakeError(r, err)
+				}
 				return
 			}
 			defer rawClientTls.Close()
-			clientTlsReader := bufio.NewReader(rawClientTls)
-			for !isEof(clientTlsReader) {
-				req, err := http.ReadRequest(clientTlsReader)
-				req = proxy.requestWithContext(req)
-				req = req.WithContext(ctxWithConnectRequest(req.Context(), r))
-				if err != nil && err != io.EOF {
-					return
-				}
-				if err != nil {
-					proxy.Loggers.Error.Log("event", "HTTP MITM ReadRequest", "host", r.Host, "error", err.Error())
-					return
-				}
-				req.RemoteAddr = r.RemoteAddr // since we're converting the request, need to carry over the original connecting IP as well
-				proxy.Loggers.Debug.Log("event", "TLS MITM req", "host", r.Host)
+			clientTlsReader := proxy.newBufioReader(rawClientTls)
+			for nreq := 1; !isEof(clientTlsReader); nreq++ {
+				// a closure per request, so that its deferred calls run when it is done, and do not
+				// pile up until the tunnel closes
+				more := func() bool {
+					req, err := http.ReadRequest(clientTlsReader)
+					if err != io.EOF {
+						proxy.MITMEvents.request(r, req, err)
+					}
+					if err != nil {
+						proxy.Loggers.Error.Log("event", "HTTP MITM ReadRequest", "host", r.Host, "error", err.Error())
+						if err != io.EOF {
+							proxy.writeBadRequest(rawClientTls, r, err)
+						}
+						return false
+					}
+					// the client asked to close the tunnel after this request
+					clientClose := req.Close
+					req = proxy.requestWithContext(req)
+					req = req.WithContext(ctxWithConnectRequest(req.Context(), r))
+					req = ctxWithEarlyHints(req, connEarlyHints(rawClientTls))
+					state := rawClientTls.ConnectionState()
+					req.TLS = &state
+					start := time.Now()
+					proxy.metrics().ObserveRequest(req)
+					finishCtx := req.Context()
+					// runs callbacks of requests failing in the middle, finish is called explicitly otherwise
+					defer proxy.finish(finishCtx)
+					req.RemoteAddr = r.RemoteAddr // since we're converting the request, need to carry over the original connecting IP as well
+					proxy.debugLog(req.Context()).Log("event", "TLS MITM req", "host", r.Host)
 
-				if !httpsRegexp.MatchString(req.URL.String()) {
-					req.URL, err = url.Parse("https://" + r.Host + req.URL.String())
-				}
+					if !httpsRegexp.MatchString(req.URL.String()) {
+						req.URL, err = url.Parse("https://" + r.Host + req.URL.String())
+					}
 
-				req, resp := proxy.filterRequest(req)
-				if resp == nil {
-					if err != nil {
-						proxy.Loggers.Error.Log("event", "HTTP MITM request URL", "url", "https://"+r.Host+req.URL.Path, "error", err.Error())
-						return
+					req, resp := proxy.filterRequest(req)
+					if resp == nil && err == nil && isWebSocketUpgrade(req) {
+						// the connection is no longer HTTP once upgraded
+						proxy.serveWebSocket(r, host, rawClientTls, clientTlsReader, req)
+						return false
 					}
-					removeProxyHeaders(req)
-					rt := CtxRoundTripper(req.Context())
-					resp, err = rt.RoundTrip(req)
-					if err != nil {
-						proxy.Loggers.Error.Log("event", "HTTP MITM RoundTrip", "error", err.Error())
-						return
+					if resp == nil && err == nil {
+						if err := proxy.acquireHostSlot(req); err != nil {
+							resp = proxy.hostLimitResponse(req, err)
+						}
 					}
-					proxy.Loggers.Debug.Log("event", "TLS MITM resp", "host", r.Host, "status", resp.Status)
-				}
-				req, resp = proxy.filterResponse(req, resp)
-				defer resp.Body.Close()
+					if resp == nil {
+						if err != nil {
+							proxy.Loggers.Error.Log("event", "HTTP MITM request URL", "url", "https://"+r.Host+req.URL.Path, "error", err.Error())
+							return false
+						}
+						removeProxyHeaders(req)
+						req = proxy.withRequestTimeout(req)
+						resp, err = proxy.mitmRoundTrip(proxy.mitmRoundTripper(req.Context()), proxy.MITMEvents.withOriginDialEvent(r, host, req))
+						if err != nil {
+							proxy.Loggers.Error.Log("event", "HTTP MITM RoundTrip", "error", err.Error())
+							proxy.metrics().ObserveError(req, err)
+							// like ServeHTTP, give the response handlers a chance to substitute a response
+							req = req.WithContext(CtxWithError(req.Context(), err))
+							if req, resp = proxy.filterResponse(req, nil); resp != nil {
+								resp.Close = true
+								if err := resp.Write(rawClientTls); err != nil {
+									proxy.Loggers.Error.Log("event", "HTTP MITM write response", "error", err.Error())
+								}
+								resp.Body.Close()
+								return false
+							}
+							proxy.writeGatewayError(rawClientTls, req, err)
+							return false
+						}
+						proxy.debugLog(req.Context()).Log("event", "TLS MITM resp", "host", r.Host, "status", resp.Status)
+					}
+					req, resp = proxy.filterResponse(req, resp)
+					resp = proxy.validResponse(req, resp)
+					defer resp.Body.Close()
 
-				text := resp.Status
-				statusCode := strconv.Itoa(resp.StatusCode) + " "
-				if strings.HasPrefix(text, statusCode) {
-					text = text[len(statusCode):]
-				}
-				// always use 1.1 to support chunked encoding
-				if _, err := io.WriteString(rawClientTls, "HTTP/1.1"+" "+statusCode+text+"\r\n"); err != nil {
-					proxy.Loggers.Error.Log("event", "HTTP MITM write response", "error", err.Error())
-					return
-				}
-				// Since we don't know the length of resp, return chunked encoded response
-				// TODO: use a more reasonable scheme
-				resp.Header.Del("Content-Length")
-				resp.Header.Set("Transfer-Encoding", "chunked")
-				// Force connection close otherwise chrome will keep CONNECT tunnel open forever
-				resp.Header.Set("Connection", "close")
-				if err := resp.Header.Write(rawClientTls); err != nil {
-					proxy.Loggers.Error.Log("event", "HTTP MITM response write header", "error", err.Error())
-					return
-				}
-				if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
-					proxy.Loggers.Error.Log("event", "HTTP MITM response write \\r\\n", "error", err.Error())
-					return
-				}
-				chunked := newChunkedWriter(rawClientTls)
-				if _, err := io.Copy(chunked, resp.Body); err != nil {
-					proxy.Loggers.Error.Log("event", "HTTP MITM response write body", "error", err.Error())
-					return
-				}
-				if err := chunked.Close(); err != nil {
-					proxy.Loggers.Error.Log("event", "HTTP MITM response close chunked", "error", err.Error())
-					return
-				}
-				if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
-					proxy.Loggers.Error.Log("event", "HTTP MITM response write body", "error", err.Error())
+					text := resp.Status
+					statusCode := strconv.Itoa(resp.StatusCode) + " "
+					if strings.HasPrefix(text, statusCode) {
+						text = text[len(statusCode):]
+					}
+					// answer with the version of the client, HTTP/1.0 clients do not know chunked encoding
+					http11 := req.ProtoAtLeast(1, 1)
+					proto := "HTTP/1.1"
+					if !http11 {
+						proto = "HTTP/1.0"
+					}
+					if _, err := io.WriteString(rawClientTls, proto+" "+statusCode+text+"\r\n"); err != nil {
+						proxy.Loggers.Error.Log("event", "HTTP MITM write response", "error", err.Error())
+						proxy.metrics().ObserveError(req, err)
+						return false
+					}
+					// The transport already decoded the framing of the origin, including chunked encoding,
+					// and failed on unsupported transfer encodings, so the body is re-framed here.
+					bodyAllowed := req.Method != "HEAD" && resp.StatusCode >= 200 &&
+						resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+					last := clientClose || proxy.MaxRequestsPerTunnel > 0 && nreq >= proxy.MaxRequestsPerTunnel
+					if bodyAllowed {
+						// Since we don't know the length of resp, return chunked encoded response,
+						// or, to HTTP/1.0 clients, a body ending with the connection
+						// TODO: use a more reasonable scheme
+						resp.Header.Del("Content-Length")
+						if http11 {
+							resp.Header.Set("Transfer-Encoding", "chunked")
+						} else {
+							resp.Header.Del("Transfer-Encoding")
+							last = true
+						}
+					} else {
+						// a chunked terminator would be taken as the start of the next response
+						resp.Header.Del("Transfer-Encoding")
+					}
+					switch {
+					case last:
+						resp.Header.Set("Connection", "close")
+					case !http11:
+						// HTTP/1.0 connections are closed after every response, unless kept alive explicitly
+						resp.Header.Set("Connection", "keep-alive")
+					default:
+						// the connection header of the origin is hop by hop, keep the tunnel open
+						resp.Header.Del("Connection")
+					}
+					if err := resp.Header.Write(rawClientTls); err != nil {
+						proxy.Loggers.Error.Log("event", "HTTP MITM response write header", "error", err.Error())
+						proxy.metrics().ObserveError(req, err)
+						return false
+					}
+					if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
+						proxy.Loggers.Error.Log("event", "HTTP MITM response write \\r\\n", "error", err.Error())
+						proxy.metrics().ObserveError(req, err)
+						return false
+					}
+					if bodyAllowed && !http11 {
+						// the end of the connection ends the body
+						if _, err := io.Copy(rawClientTls, resp.Body); err != nil {
+							proxy.Loggers.Error.Log("event", "HTTP MITM response write body", "error", err.Error())
+							recordTransferError(req.Context(), err)
+							proxy.metrics().ObserveError(req, err)
+							return false
+						}
+					} else if bodyAllowed {
+						chunked := newChunkedWriter(rawClientTls)
+						if _, err := io.Copy(chunked, resp.Body); err != nil {
+							proxy.Loggers.Error.Log("event", "HTTP MITM response write body", "error", err.Error())
+							recordTransferError(req.Context(), err)
+							proxy.metrics().ObserveError(req, err)
+							return false
+						}
+						if err := chunked.Close(); err != nil {
+							proxy.Loggers.Error.Log("event", "HTTP MITM response close chunked", "error", err.Error())
+							proxy.metrics().ObserveError(req, err)
+							return false
+						}
+						if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
+							proxy.Loggers.Error.Log("event", "HTTP MITM response write body", "error", err.Error())
+							proxy.metrics().ObserveError(req, err)
+							return false
+						}
+					}
+					proxy.metrics().ObserveResponse(req, resp, time.Since(start))
+					proxy.finish(finishCtx)
+					if last {
+						// the response already had Connection: close
+						proxy.debugLog(r.Context()).Log("event", "TLS MITM close", "host", r.Host, "nreq", nreq, "client close", clientClose)
+						return false
+					}
+					return true
+				}()
+				if !more {
 					return
 				}
 			}
-			proxy.Loggers.Debug.Log("event", "TLS MITM EOF")
-		}()
+			proxy.debugLog(r.Context()).Log("event", "TLS MITM EOF")
+		})
 	case ConnectProxyAuthHijack:
 		proxyClient.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n"))
 		todo.Hijack(r, proxyClient)
 	case ConnectReject:
-		if CtxResp(r.Context()) != nil {
-			if err := CtxResp(r.Context()).Write(proxyClient); err != nil {
+		if resp, ok := CtxRespOK(r.Context()); ok && resp != nil {
+			if err := resp.Write(proxyClient); err != nil {
 				proxy.Loggers.Error.Log("event", "HTTP CONNECT reject write", "error", err.Error())
 			}
 		}
@@ -281,6 +625,187 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// isSelfAddr returns true if connecting to host would connect to the proxy itself, that
+// is, to the address the request r arrived on, or any address of the host if the proxy listens
+// on all of them with Serve. Such a connection would loop forever. Loopback addresses are only
+// the proxy if it listens on them, not to reject other services of the host on the same port.
+func (proxy *ProxyHttpServer) isSelfAddr(r *http.Request, host string) bool {
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	localHost, localPort, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return false
+	}
+	if !hasPort.MatchString(host) {
+		host += ":80"
+	}
+	targetHost, targetPort, err := net.SplitHostPort(host)
+	if err != nil || targetPort != localPort {
+		return false
+	}
+	localIP := net.ParseIP(localHost)
+	if localIP == nil {
+		return false
+	}
+	proxy.tunnelsMu.Lock()
+	all := proxy.listensOnAll || localIP.IsUnspecified()
+	proxy.tunnelsMu.Unlock()
+	var ips []net.IP
+	if ip := net.ParseIP(strings.Trim(targetHost, "[]")); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(r.Context(), targetHost)
+		if err != nil {
+			return false
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		if ip.Equal(localIP) || (ip.IsLoopback() && (localIP.IsLoopback() || all)) || (all && isInterfaceIP(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isInterfaceIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validHeaders returns an error if a header name or value contains characters allowing to inject
+// headers or to split the response, such as CR and LF.
+func validHeaders(h http.Header) error {
+	for k, vs := range h {
+		if k == "" {
+			return errors.New("empty header name")
+		}
+		for _, c := range []byte(k) {
+			if c <= ' ' || c >= 0x7f || c == ':' {
+				return fmt.Errorf("invalid character %q in header name %q", c, k)
+			}
+		}
+		for _, v := range vs {
+			for _, c := range []byte(v) {
+				if (c < ' ' && c != '\t') || c == 0x7f {
+					return fmt.Errorf("invalid character %q in value of header %q", c, k)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validResponse returns resp if its headers are safe to write to the client as is, and a
+// 502 Bad Gateway response otherwise. Handlers setting headers from untrusted input could
+// otherwise split the response in the MITM paths, where responses are written by hand.
+func (proxy *ProxyHttpServer) validResponse(req *http.Request, resp *http.Response) *http.Response {
+	err := validHeaders(resp.Header)
+	if err == nil {
+		return resp
+	}
+	proxy.Loggers.Error.Log("event", "invalid response header", "url", req.URL.String(), "error", err.Error())
+	resp.Body.Close()
+	return NewResponse(req, ContentTypeText, http.StatusBadGateway, "invalid response header")
+}
+
+// writeBadRequest answers a request of an eavesdropped CONNECT tunnel that could not be parsed,
+// with the response of proxy.BadRequestResponse, or 400 Bad Request by default.
+func (proxy *ProxyHttpServer) writeBadRequest(w io.Writer, connect *http.Request, err error) {
+	var resp *http.Response
+	if proxy.BadRequestResponse != nil {
+		resp = proxy.BadRequestResponse(connect, err)
+	}
+	if resp == nil {
+		resp = NewResponse(connect, ContentTypeText, http.StatusBadRequest, "Bad Request: "+err.Error())
+	}
+	defer resp.Body.Close()
+	resp.Close = true
+	if err := resp.Write(w); err != nil {
+		proxy.Loggers.Error.Log("event", "HTTP MITM write bad request", "error", err.Error())
+	}
+}
+
+// defaultMaxResponseHeaderBytes is the response header size limit used if
+// proxy.MaxResponseHeaderBytes is zero
+const defaultMaxResponseHeaderBytes = 1 << 20
+
+var errResponseHeaderTooLarge = errors.New("response headers too large")
+
+func (proxy *ProxyHttpServer) maxResponseHeaderBytes() int64 {
+	if proxy.MaxResponseHeaderBytes > 0 {
+		return proxy.MaxResponseHeaderBytes
+	}
+	return defaultMaxResponseHeaderBytes
+}
+
+// readResponse reads the response to req from an origin server. With proxy.TolerateHTTP09, a
+// response not starting with a status line is read as the body of a 200 OK response, ending with
+// the connection.
+func (proxy *ProxyHttpServer) readResponse(r *bufio.Reader, req *http.Request) (*http.Response, error) {
+	if proxy.TolerateHTTP09 {
+		prefix, _ := r.Peek(len("HTTP/"))
+		if len(prefix) > 0 && !bytes.HasPrefix([]byte("HTTP/"), prefix) {
+			proxy.debugLog(req.Context()).Log("event", "HTTP/0.9 response", "host", req.Host)
+			return &http.Response{
+				Status:        "200 OK",
+				StatusCode:    http.StatusOK,
+				Proto:         "HTTP/1.0",
+				ProtoMajor:    1,
+				ProtoMinor:    0,
+				Header:        make(http.Header),
+				Body:          ioutil.NopCloser(r),
+				ContentLength: -1,
+				Close:         true,
+				Request:       req,
+			}, nil
+		}
+	}
+	return http.ReadResponse(r, req)
+}
+
+// headerLimitReader fails reads after n bytes were read, unless n is negative. It is put under
+// the buffered reader of a connection, to limit the bytes read while parsing headers.
+type headerLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *headerLimitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return l.r.Read(p)
+	}
+	if l.n == 0 {
+		return 0, errResponseHeaderTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// newBufioReader returns a buffered reader for reading MITM traffic, of size proxy.ReadBufferSize
+func (proxy *ProxyHttpServer) newBufioReader(r io.Reader) *bufio.Reader {
+	if proxy.ReadBufferSize > 0 {
+		return bufio.NewReaderSize(r, proxy.ReadBufferSize)
+	}
+	return bufio.NewReader(r)
+}
+
 func (proxy *ProxyHttpServer) httpError(w io.WriteCloser, err error) {
 	if _, err := io.WriteString(w, "HTTP/1.1 502 Bad Gateway\r\n\r\n"); err != nil {
 		proxy.Loggers.Error.Log("event", "HTTP Error write", "error", err.Error())
@@ -290,11 +815,125 @@ func (proxy *ProxyHttpServer) httpError(w io.WriteCloser, err error) {
 	}
 }
 
-func (proxy *ProxyHttpServer) copyOrWarn(dst io.Writer, src io.Reader, wg *sync.WaitGroup) {
-	if _, err := io.Copy(dst, src); err != nil {
+// mitmRoundTripper returns the RoundTripper sending the requests of TLS eavesdropped CONNECT
+// tunnels: the one set with CtxWithRoundTripper or SetRoundTripper, or Tr, with IdleConnTimeout
+// and offering MitmUpstreamNextProtos.
+func (proxy *ProxyHttpServer) mitmRoundTripper(ctx context.Context) http.RoundTripper {
+	if rt, ok := ctx.Value(ctxKeyRoundTripper).(http.RoundTripper); ok {
+		return rt
+	}
+	if rt := proxy.customRoundTripper(); rt != nil {
+		return rt
+	}
+	base := proxy.transport()
+	if len(proxy.MitmUpstreamNextProtos) == 0 {
+		return base
+	}
+	proxy.mitmTrMu.Lock()
+	defer proxy.mitmTrMu.Unlock()
+	// the clone is kept, so that its connections are reused, until Tr or the protocols change
+	if proxy.mitmTr == nil || proxy.mitmTrBase != base || !equalValues(proxy.mitmTrProtos, proxy.MitmUpstreamNextProtos) {
+		if proxy.mitmTr != nil {
+			proxy.mitmTr.CloseIdleConnections()
+		}
+		protos := append([]string(nil), proxy.MitmUpstreamNextProtos...)
+		tr := base.Clone()
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = &tls.Config{}
+		}
+		tr.TLSClientConfig.NextProtos = protos
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		for _, proto := range protos {
+			if proto == "h2" {
+				// an empty TLSNextProto disables HTTP/2, let the transport configure it instead
+				tr.TLSNextProto = nil
+				tr.ForceAttemptHTTP2 = true
+			}
+		}
+		proxy.mitmTr, proxy.mitmTrBase, proxy.mitmTrProtos = tr, base, protos
+	}
+	return proxy.mitmTr
+}
+
+// writeGatewayError answers req, sent in an eavesdropped CONNECT tunnel, with 502 Bad Gateway
+// for failing to reach its origin server with err, or 504 Gateway Timeout if err is a timeout.
+// The tunnel is closed after it.
+func (proxy *ProxyHttpServer) writeGatewayError(w io.Writer, req *http.Request, err error) {
+	status := gatewayErrorStatus(err)
+	resp := NewResponse(req, ContentTypeText, status, http.StatusText(status)+": "+err.Error())
+	resp.Close = true
+	if err := resp.Write(w); err != nil {
+		proxy.Loggers.Error.Log("event", "HTTP MITM write bad gateway", "error", err.Error())
+	}
+}
+
+// retryMitmDial calls dial, retrying failures up to proxy.MitmDialRetries times, with exponential
+// backoff, unless ctx is done first. It returns the error of the last call.
+func (proxy *ProxyHttpServer) retryMitmDial(ctx context.Context, dial func() error) error {
+	backoff := proxy.MitmDialBackoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	for retry := 0; ; retry++ {
+		err := dial()
+		if err == nil || retry >= proxy.MitmDialRetries {
+			return err
+		}
+		proxy.debugLog(ctx).Log("event", "mitm dial retry", "retry", retry+1, "error", err.Error())
+		timer := time.NewTimer(backoff << uint(retry))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// mitmRoundTrip sends req, from an eavesdropped CONNECT tunnel, with rt. Failures to connect to
+// the origin server are retried as in retryMitmDial, if the body of req can be replayed.
+func (proxy *ProxyHttpServer) mitmRoundTrip(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	var resp *http.Response
+	var rtErr error
+	first := true
+	proxy.retryMitmDial(req.Context(), func() error {
+		if !first && req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil
+			}
+			req.Body = body
+		}
+		first = false
+		resp, rtErr = rt.RoundTrip(withTimings(req))
+		if resp != nil && resp.TLS != nil {
+			recordUpstreamTLS(req.Context(), resp.TLS)
+		}
+		if isDialError(rtErr) {
+			return rtErr
+		}
+		// succeeded, or the request may have reached the origin
+		return nil
+	})
+	return resp, rtErr
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// copyOrWarn copies src to dst, logging any error, and returns the number of bytes copied.
+func (proxy *ProxyHttpServer) copyOrWarn(dst io.Writer, src io.Reader) int64 {
+	n, err := io.Copy(dst, src)
+	if err != nil {
 		proxy.Loggers.Error.Log("event", "io.Copy", "error", err.Error())
 	}
-	wg.Done()
+	return n
 }
 
 type CloseWriteReader interface {
@@ -303,13 +942,17 @@ type CloseWriteReader interface {
 	CloseRead() error
 }
 
-func (proxy *ProxyHttpServer) copyAndClose(dst, src CloseWriteReader) {
-	if _, err := io.Copy(dst, src); err != nil {
+// copyAndClose copies src to dst, half closing both when done, and returns the number
+// of bytes copied.
+func (proxy *ProxyHttpServer) copyAndClose(dst, src CloseWriteReader) int64 {
+	n, err := io.Copy(dst, src)
+	if err != nil {
 		proxy.Loggers.Error.Log("event", "io.Copy&Close", "error", err.Error())
 	}
 
 	dst.CloseWrite()
 	src.CloseRead()
+	return n
 }
 
 func dialerFromEnv(proxy *ProxyHttpServer) func(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -317,17 +960,30 @@ func dialerFromEnv(proxy *ProxyHttpServer) func(ctx context.Context, network, ad
 	if https_proxy == "" {
 		https_proxy = os.Getenv("https_proxy")
 	}
+	if https_proxy == "" {
+		https_proxy = os.Getenv("ALL_PROXY")
+	}
+	if https_proxy == "" {
+		https_proxy = os.Getenv("all_proxy")
+	}
 	if https_proxy == "" {
 		return nil
 	}
 	return proxy.NewConnectDialToProxy(https_proxy)
 }
 
+// NewConnectDialToProxy returns a ConnectDial connecting through the upstream proxy at the URL
+// https_proxy: with a CONNECT request for http:// and https:// proxies, and with a SOCKS5 CONNECT
+// for socks5:// and socks5h:// proxies, authenticating with the user and password of the URL, if
+// any. It returns nil if the URL is invalid, or its scheme unsupported.
 func (proxy *ProxyHttpServer) NewConnectDialToProxy(https_proxy string) func(ctx context.Context, network, addr string) (net.Conn, error) {
 	u, err := url.Parse(https_proxy)
 	if err != nil {
 		return nil
 	}
+	if u.Scheme == "socks5" || u.Scheme == "socks5h" {
+		return proxy.newSocks5Dial(u)
+	}
 	if u.Scheme == "" || u.Scheme == "http" {
 		if strings.IndexRune(u.Host, ':') == -1 {
 			u.Host += ":80"
@@ -406,14 +1062,87 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxy(https_proxy string) func(ctx
 	return nil
 }
 
+// TLSConfigFromCA returns a ConnectAction.TLSConfig forging certificates signed by ca for
+// eavesdropped CONNECT tunnels. If ca is nil, the CA of the proxy handling the CONNECT request,
+// ProxyHttpServer.CA, is used, or GoproxyCa if it has none.
 func TLSConfigFromCA(ca *tls.Certificate) func(req *http.Request, host string) (*tls.Config, error) {
+	// the session ticket key is shared by all the configs, so that clients can resume TLS sessions
+	// on later CONNECT tunnels, while each config has its own certificate.
+	var (
+		ticketKeyOnce sync.Once
+		ticketKey     [32]byte
+		ticketKeyErr  error
+	)
 	return func(req *http.Request, host string) (*tls.Config, error) {
 		config := *defaultTLSConfig
-		cert, err := signHost(*ca, []string{stripPort(host)})
-		if err != nil {
-			return nil, err
+		proxy, ok := CtxProxyOK(req.Context())
+		ca := ca
+		if ca == nil {
+			ca = &GoproxyCa
+			if ok && proxy.CA != nil {
+				ca = proxy.CA
+			}
+		}
+		if ok && len(proxy.MitmSessionTicketKeys) > 0 {
+			config.SetSessionTicketKeys(proxy.MitmSessionTicketKeys)
+		} else {
+			ticketKeyOnce.Do(func() {
+				_, ticketKeyErr = rand.Read(ticketKey[:])
+			})
+			if ticketKeyErr != nil {
+				return nil, ticketKeyErr
+			}
+			config.SetSessionTicketKeys([][32]byte{ticketKey})
+		}
+		// the certificate is for the server name the client asks for in its TLS ClientHello, which
+		// may differ from the CONNECT host, e.g. when the client connects to an IP
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = stripPort(host)
+			}
+			var opts leafOptions
+			if ok && proxy.LeafCertTemplate != nil {
+				opts.template = func(base *x509.Certificate) *x509.Certificate {
+					return proxy.LeafCertTemplate(name, base)
+				}
+			}
+			hosts := []string{name}
+			sign := func() (tls.Certificate, error) {
+				var cert tls.Certificate
+				var err error
+				if ok && proxy.SignHost != nil {
+					cert, err = proxy.SignHost(*ca, hosts)
+				} else {
+					// the serial is only taken when a certificate is signed, not for cached ones
+					if ok && proxy.LeafSerialFunc != nil {
+						opts.serial = proxy.LeafSerialFunc(name)
+					}
+					cert, err = signHostOpts(*ca, hosts, opts)
+				}
+				if err != nil {
+					return cert, err
+				}
+				if ok && proxy.OnLeafCertGenerated != nil {
+					if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+						return cert, err
+					}
+					proxy.OnLeafCertGenerated(name, &cert)
+				}
+				return cert, nil
+			}
+			var cert tls.Certificate
+			var err error
+			if ok {
+				cert, err = proxy.storedCert(ca, hosts, sign)
+			} else {
+				cert, err = sign()
+			}
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
 		}
-		config.Certificates = append(config.Certificates, cert)
 		return &config, nil
 	}
 }
@@ -0,0 +1,50 @@
+package goproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIsSelfAddr(t *testing.T) {
+	for _, tc := range []struct {
+		local        string
+		listensOnAll bool
+		host         string
+		expected     bool
+	}{
+		{"127.0.0.1:8080", false, "127.0.0.1:8080", true},
+		{"127.0.0.1:8080", false, "localhost:8080", true},
+		{"127.0.0.1:8080", false, "127.0.0.1:9090", false},
+		{"10.0.0.1:8080", false, "10.0.0.1:8080", true},
+		// another service of the host on the same port
+		{"10.0.0.1:8080", false, "127.0.0.1:8080", false},
+		{"10.0.0.1:8080", false, "localhost:8080", false},
+		{"10.0.0.1:8080", false, "[::1]:8080", false},
+		// the proxy listens on all addresses, loopback ones included
+		{"10.0.0.1:8080", true, "127.0.0.1:8080", true},
+		{"10.0.0.1:8080", true, "[::1]:8080", true},
+	} {
+		proxy := New()
+		proxy.listensOnAll = tc.listensOnAll
+		local, _ := net.ResolveTCPAddr("tcp", tc.local)
+		r, _ := http.NewRequest("CONNECT", "http://"+tc.host, nil)
+		r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, local))
+		if actual := proxy.isSelfAddr(r, tc.host); actual != tc.expected {
+			t.Errorf("isSelfAddr(%s) on %s, listening on all addresses: %v = %v, expected %v", tc.host, tc.local, tc.listensOnAll, actual, tc.expected)
+		}
+	}
+}
+
+func TestNewBufioReaderSize(t *testing.T) {
+	proxy := New()
+	if size := proxy.newBufioReader(strings.NewReader("")).Size(); size != 4096 {
+		t.Error("Expected the bufio default size, got", size)
+	}
+	proxy.ReadBufferSize = 64 << 10
+	if size := proxy.newBufioReader(strings.NewReader("")).Size(); size != proxy.ReadBufferSize {
+		t.Errorf("Expected ReadBufferSize %d, got %d", proxy.ReadBufferSize, size)
+	}
+}
@@ -0,0 +1,39 @@
+package goproxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// Metrics is notified of the requests going through a proxy, to export counters and latencies,
+// e.g. to Prometheus. See ext/metrics for an adapter publishing them with expvar. Implementations
+// must be safe for concurrent use.
+type Metrics interface {
+	// ObserveRequest is called when a proxied request is received, including requests
+	// eavesdropped in CONNECT tunnels, before the request handlers run.
+	ObserveRequest(req *http.Request)
+	// ObserveResponse is called once resp, the response to req, was sent to the client. latency
+	// is the time since the request was received. When sending the response fails, ObserveError
+	// is called instead.
+	ObserveResponse(req *http.Request, resp *http.Response, latency time.Duration)
+	// ObserveError is called when sending req to its origin server, or sending the response to
+	// the client, fails with err.
+	ObserveError(req *http.Request, err error)
+	// ObserveConnect is called with the action the CONNECT handlers chose for a tunnel to host.
+	ObserveConnect(host string, action *ConnectAction)
+}
+
+// NopMetrics is a Metrics ignoring everything. It is used when ProxyHttpServer.Metrics is nil.
+type NopMetrics struct{}
+
+func (NopMetrics) ObserveRequest(req *http.Request)                                              {}
+func (NopMetrics) ObserveResponse(req *http.Request, resp *http.Response, latency time.Duration) {}
+func (NopMetrics) ObserveError(req *http.Request, err error)                                     {}
+func (NopMetrics) ObserveConnect(host string, action *ConnectAction)                             {}
+
+func (proxy *ProxyHttpServer) metrics() Metrics {
+	if proxy.Metrics == nil {
+		return NopMetrics{}
+	}
+	return proxy.Metrics
+}
@@ -0,0 +1,109 @@
+package goproxy
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+)
+
+// DefaultMitmDecisionCacheSize is the number of hosts kept by NewMitmDecisionCache
+const DefaultMitmDecisionCacheSize = 10000
+
+// MitmDecisionCache remembers, per host, whether CONNECT requests to that host should be
+// eavesdropped. Handlers populate it, typically after observing a response from the host,
+// and AdaptiveMitm consults it when a CONNECT request arrives.
+type MitmDecisionCache interface {
+	// MitmDecision returns whether to eavesdrop connections to host, and false
+	// if no decision was made for host yet.
+	MitmDecision(host string) (mitm bool, ok bool)
+	SetMitmDecision(host string, mitm bool)
+}
+
+type lruMitmDecisions struct {
+	mu        sync.Mutex
+	maxSize   int
+	order     *list.List
+	decisions map[string]*list.Element
+}
+
+type lruMitmDecision struct {
+	host string
+	mitm bool
+}
+
+// NewMitmDecisionCache returns an in memory MitmDecisionCache, safe for concurrent use, keeping
+// the decisions for DefaultMitmDecisionCacheSize hosts. See NewLRUMitmDecisionCache.
+func NewMitmDecisionCache() MitmDecisionCache {
+	return NewLRUMitmDecisionCache(DefaultMitmDecisionCacheSize)
+}
+
+// NewLRUMitmDecisionCache returns an in memory MitmDecisionCache, safe for concurrent use, keeping
+// the decisions for at most maxSize hosts, evicting the least recently used one when full. Clients
+// choose the hosts they CONNECT to, so the cache is bounded, not to grow without limit.
+func NewLRUMitmDecisionCache(maxSize int) MitmDecisionCache {
+	return &lruMitmDecisions{maxSize: maxSize, order: list.New(), decisions: make(map[string]*list.Element)}
+}
+
+func (m *lruMitmDecisions) MitmDecision(host string) (bool, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.decisions[host]
+	if !ok {
+		return false, false
+	}
+	m.order.MoveToFront(e)
+	return e.Value.(*lruMitmDecision).mitm, true
+}
+
+func (m *lruMitmDecisions) SetMitmDecision(host string, mitm bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.decisions[host]; ok {
+		e.Value.(*lruMitmDecision).mitm = mitm
+		m.order.MoveToFront(e)
+		return
+	}
+	m.decisions[host] = m.order.PushFront(&lruMitmDecision{host: host, mitm: mitm})
+	for m.order.Len() > m.maxSize {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.decisions, oldest.Value.(*lruMitmDecision).host)
+	}
+}
+
+// AdaptiveMitm returns a HttpsHandler eavesdropping CONNECT requests to hosts the cache decided
+// to eavesdrop. Hosts with no decision, or a decision not to eavesdrop, are left for the next
+// handlers. Ports are ignored when looking up the host.
+//
+//	cache := goproxy.NewMitmDecisionCache()
+//	proxy.OnRequest().HandleConnect(goproxy.AdaptiveMitm(cache))
+//	proxy.OnResponse(goproxy.ContentTypeIs("text/html")).Do(goproxy.LearnMitm(cache, true))
+//	proxy.OnMitmHandshakeError = goproxy.UnlearnMitmOnHandshakeError(cache)
+func AdaptiveMitm(cache MitmDecisionCache) FuncHttpsHandler {
+	return func(req *http.Request, host string) (*http.Request, *ConnectAction, string) {
+		if mitm, ok := cache.MitmDecision(stripPort(host)); ok && mitm {
+			return req, MitmConnect, host
+		}
+		return req, nil, ""
+	}
+}
+
+// LearnMitm returns a RespHandler recording in the cache the given decision for the host
+// of every response it handles. Use it with conditions to decide which hosts to eavesdrop.
+func LearnMitm(cache MitmDecisionCache, mitm bool) FuncRespHandler {
+	return func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		if req != nil && req.URL != nil {
+			cache.SetMitmDecision(stripPort(req.URL.Host), mitm)
+		}
+		return req, resp
+	}
+}
+
+// UnlearnMitmOnHandshakeError returns a function for ProxyHttpServer.OnMitmHandshakeError,
+// recording in the cache not to eavesdrop hosts whose clients failed the TLS handshake with the
+// proxy, e.g. because they pin certificates, so that their next CONNECTs are tunneled as is.
+func UnlearnMitmOnHandshakeError(cache MitmDecisionCache) func(connect *http.Request, err error) {
+	return func(connect *http.Request, err error) {
+		cache.SetMitmDecision(stripPort(connect.URL.Host), false)
+	}
+}
@@ -0,0 +1,80 @@
+package goproxy
+
+import (
+	"net/http"
+	"net/http/httptrace"
+)
+
+// MITMEvents are optional callbacks observing each stage of handling CONNECT requests, e.g. to
+// find out whether eavesdropping a host fails in the client handshake, in connecting to the
+// origin server, or in parsing requests. connect is always the CONNECT request, and host the
+// host:port the tunnel is opened to. Callbacks are called from the goroutines serving the
+// tunnels, so they must be safe for concurrent use.
+type MITMEvents struct {
+	// Connect is called when a CONNECT request is received, before the https handlers run
+	Connect func(connect *http.Request)
+	// Decision is called with the action the https handlers chose for the CONNECT request
+	Decision func(connect *http.Request, host string, action *ConnectAction)
+	// ClientHandshake is called once the TLS handshake with the client of a ConnectMitm tunnel
+	// is done, with the error if it failed.
+	ClientHandshake func(connect *http.Request, host string, err error)
+	// OriginDial is called after every attempt to connect to the origin server, with the error if
+	// it failed. Requests of ConnectMitm tunnels sent on reused connections do not connect.
+	OriginDial func(connect *http.Request, host string, err error)
+	// Request is called for every request read in a ConnectMitm or ConnectHTTPMitm tunnel, before
+	// the request handlers run, or with the error and a nil req if it could not be parsed.
+	Request func(connect *http.Request, req *http.Request, err error)
+	// TunnelDone is called once a ConnectAccept tunnel is closed, with the number of bytes copied
+	// from the client to the origin server, sent, and back, received, e.g. for accounting.
+	TunnelDone func(connect *http.Request, host string, sent, received int64)
+}
+
+func (e *MITMEvents) connect(connect *http.Request) {
+	if e.Connect != nil {
+		e.Connect(connect)
+	}
+}
+
+func (e *MITMEvents) decision(connect *http.Request, host string, action *ConnectAction) {
+	if e.Decision != nil {
+		e.Decision(connect, host, action)
+	}
+}
+
+func (e *MITMEvents) clientHandshake(connect *http.Request, host string, err error) {
+	if e.ClientHandshake != nil {
+		e.ClientHandshake(connect, host, err)
+	}
+}
+
+func (e *MITMEvents) originDial(connect *http.Request, host string, err error) {
+	if e.OriginDial != nil {
+		e.OriginDial(connect, host, err)
+	}
+}
+
+func (e *MITMEvents) request(connect *http.Request, req *http.Request, err error) {
+	if e.Request != nil {
+		e.Request(connect, req, err)
+	}
+}
+
+func (e *MITMEvents) tunnelDone(connect *http.Request, host string, sent, received int64) {
+	if e.TunnelDone != nil {
+		e.TunnelDone(connect, host, sent, received)
+	}
+}
+
+// withOriginDialEvent returns req traced to report its connections to the origin server to
+// e.OriginDial.
+func (e *MITMEvents) withOriginDialEvent(connect *http.Request, host string, req *http.Request) *http.Request {
+	if e.OriginDial == nil {
+		return req
+	}
+	trace := &httptrace.ClientTrace{
+		ConnectDone: func(network, addr string, err error) {
+			e.OriginDial(connect, host, err)
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
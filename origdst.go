@@ -0,0 +1,46 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ErrOriginalDstUnsupported is returned by OriginalDst on platforms other than Linux
+var ErrOriginalDstUnsupported = errors.New("SO_ORIGINAL_DST is only supported on Linux")
+
+// OriginalDstConnContext is an http.Server ConnContext function, storing on the context of the
+// requests of c the destination they were sent to before being redirected to the proxy by
+// iptables REDIRECT, see CtxOriginalDst. The proxy then sends non proxy requests, e.g. GET /, to
+// that destination, instead of passing them to NonproxyHandler. Only IPv4 is supported.
+//
+//	srv := &http.Server{Addr: ":3129", Handler: proxy, ConnContext: goproxy.OriginalDstConnContext}
+//	log.Fatal(srv.ListenAndServe())
+func OriginalDstConnContext(ctx context.Context, c net.Conn) context.Context {
+	dst, err := OriginalDst(c)
+	if err != nil || dst.String() == c.LocalAddr().String() {
+		// not redirected, the client connected to the proxy itself
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKeyOriginalDst, dst)
+}
+
+// CtxOriginalDst returns the destination the request of the given context was sent to, before
+// being redirected to the proxy, or nil if it was not redirected. See OriginalDstConnContext.
+func CtxOriginalDst(ctx context.Context) *net.TCPAddr {
+	dst, _ := ctx.Value(ctxKeyOriginalDst).(*net.TCPAddr)
+	return dst
+}
+
+// transparentRequest makes r, a non proxy request redirected to the proxy, a request to its
+// original destination. It returns false if r was not redirected.
+func transparentRequest(r *http.Request) bool {
+	dst := CtxOriginalDst(r.Context())
+	if dst == nil {
+		return false
+	}
+	r.URL.Scheme = "http"
+	r.URL.Host = dst.String()
+	return true
+}
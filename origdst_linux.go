@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// soOriginalDst is the SO_ORIGINAL_DST socket option of netfilter, from linux/netfilter_ipv4.h
+const soOriginalDst = 80
+
+// OriginalDst returns the destination c was sent to before being redirected to the proxy by
+// iptables REDIRECT. For connections that were not redirected, it is c.LocalAddr().
+func OriginalDst(c net.Conn) (*net.TCPAddr, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("SO_ORIGINAL_DST requires a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var addr *syscall.IPv6Mreq
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// the returned sockaddr_in fits in the IPv6Mreq struct
+		addr, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	sa := addr.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+		Port: int(sa[2])<<8 | int(sa[3]),
+	}, nil
+}
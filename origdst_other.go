@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package goproxy
+
+import "net"
+
+// OriginalDst returns the destination c was sent to before being redirected to the proxy by
+// iptables REDIRECT. It is only supported on Linux.
+func OriginalDst(c net.Conn) (*net.TCPAddr, error) {
+	return nil, ErrOriginalDstUnsupported
+}
@@ -0,0 +1,28 @@
+package goproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTransparentRequest(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Host + req.URL.Path))
+	}))
+	defer origin.Close()
+
+	proxy := New()
+	req := httptest.NewRequest("GET", "/bobo", nil)
+	req.Host = "example.com"
+	dst := origin.Listener.Addr().(*net.TCPAddr)
+	req = req.WithContext(context.WithValue(req.Context(), ctxKeyOriginalDst, dst))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if b, _ := ioutil.ReadAll(w.Body); string(b) != "example.com/bobo" {
+		t.Error("Expected request to be sent to its original destination, got", string(b))
+	}
+}
@@ -0,0 +1,95 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// pacProxies parses the result of the FindProxyForURL function of a PAC file, as
+// "PROXY proxy.example.com:8080; DIRECT", into the URLs of the proxies to try in order, nil
+// meaning DIRECT. Unsupported entries are skipped, an empty result means DIRECT.
+func pacProxies(result string) []*url.URL {
+	var proxies []*url.URL
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.EqualFold(fields[0], "DIRECT") {
+			proxies = append(proxies, nil)
+			continue
+		}
+		if len(fields) != 2 {
+			continue
+		}
+		var scheme string
+		switch strings.ToUpper(fields[0]) {
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		default:
+			continue
+		}
+		proxies = append(proxies, &url.URL{Scheme: scheme, Host: fields[1]})
+	}
+	if len(proxies) == 0 {
+		proxies = append(proxies, nil)
+	}
+	return proxies
+}
+
+// findPACProxies returns the proxies find chooses for u, DIRECT if it fails
+func (proxy *ProxyHttpServer) findPACProxies(find func(url, host string) (string, error), u *url.URL) []*url.URL {
+	result, err := find(u.String(), u.Hostname())
+	if err != nil {
+		proxy.Loggers.Error.Log("event", "PAC FindProxyForURL", "url", u.String(), "error", err.Error())
+		return []*url.URL{nil}
+	}
+	return pacProxies(result)
+}
+
+// NewConnectDialFromPAC returns a ConnectDial connecting to the upstream proxies chosen by find,
+// the FindProxyForURL(url, host) function of a PAC file, see ext/pac. find is called with the
+// https:// URL of the CONNECT host. DIRECT, PROXY, HTTPS and SOCKS results are supported, the
+// proxies are tried in order, and the connection is direct if find fails.
+func (proxy *ProxyHttpServer) NewConnectDialFromPAC(find func(url, host string) (string, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		err := errors.New("no proxy to connect through")
+		for _, u := range proxy.findPACProxies(find, &url.URL{Scheme: "https", Host: addr, Path: "/"}) {
+			var c net.Conn
+			if u == nil {
+				c, err = proxy.dial(ctx, network, addr)
+			} else if dial := proxy.NewConnectDialToProxy(u.String()); dial != nil {
+				c, err = dial(ctx, network, addr)
+			}
+			if err == nil {
+				return c, nil
+			}
+			proxy.debugLog(ctx).Log("event", "PAC dial", "addr", addr, "proxy", u, "error", err.Error())
+		}
+		return nil, err
+	}
+}
+
+// PACProxyFunc returns a function for http.Transport.Proxy, sending requests through the first
+// upstream proxy find chooses, see NewConnectDialFromPAC.
+func (proxy *ProxyHttpServer) PACProxyFunc(find func(url, host string) (string, error)) func(req *http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy.findPACProxies(find, req.URL)[0], nil
+	}
+}
+
+// SetPACFunc makes the proxy connect to origin servers through the upstream proxies chosen by
+// find, the FindProxyForURL(url, host) function of a PAC file, both for CONNECT tunnels and for
+// proxied requests. See ext/pac to evaluate PAC files.
+func (proxy *ProxyHttpServer) SetPACFunc(find func(url, host string) (string, error)) {
+	proxy.ConnectDial = proxy.NewConnectDialFromPAC(find)
+	proxy.Tr.Proxy = proxy.PACProxyFunc(find)
+}
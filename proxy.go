@@ -3,12 +3,19 @@ package goproxy
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"regexp"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type emptyLogger struct{}
@@ -48,13 +55,311 @@ type ProxyHttpServer struct {
 	Verbose         bool
 	Loggers         Loggers
 	NonproxyHandler http.Handler
+	handlersMu      sync.RWMutex
 	reqHandlers     []ReqHandler
 	respHandlers    []RespHandler
 	httpsHandlers   []HttpsHandler
+	bypassConds     []RespCondition
+	wsHandlers      []webSocketHandler
+	hostLimitsMu    sync.Mutex
+	hostLimits      map[string]chan struct{}
+	tunnelsMu       sync.Mutex
+	tunnels         map[*tunnel]struct{}
+	tunnelsWG       sync.WaitGroup
+	shuttingDown    bool
+	server          *http.Server
+	listensOnAll    bool
+	rtMu            sync.RWMutex
+	rt              http.RoundTripper
+	mitmTrMu        sync.Mutex
+	mitmTr          *http.Transport
+	mitmTrBase      *http.Transport
+	mitmTrProtos    []string
+	idleTrMu        sync.Mutex
+	idleTr          *http.Transport
+	idleTrBase      *http.Transport
+	certCallsMu     sync.Mutex
+	certCalls       map[string]*certCall
 	Tr              *http.Transport
+	// StripAltSvc removes HTTP/3 advertisements from the Alt-Svc header of responses, and the
+	// Alt-Used header of requests, so that clients would not switch to QUIC, which bypasses the
+	// proxy. The whole Alt-Svc header is removed, unless KeepNonH3AltSvc is set.
+	StripAltSvc bool
+	// KeepNonH3AltSvc keeps the Alt-Svc entries not advertising HTTP/3 when StripAltSvc is set.
+	KeepNonH3AltSvc bool
 	// ConnectDial will be used to create TCP connections for CONNECT requests
-	// if nil Tr.Dial will be used
+	// if nil Tr.DialContext, or Tr.Dial if set, will be used
 	ConnectDial func(ctx context.Context, network string, addr string) (net.Conn, error)
+	// DialRouter chooses how to connect to CONNECT targets by host. The CONNECT request is
+	// tested against the conditions of the routes in order, and the first matching route dials.
+	// If none matches, ConnectDial is used.
+	DialRouter []DialRoute
+	// DialControl, if not nil, is called after creating the socket of every outgoing connection,
+	// before dialing it. It allows setting socket options, e.g. SO_MARK for policy routing.
+	// See net.Dialer.Control. It is ignored if Tr.DialContext is replaced, or Tr.Dial is set.
+	DialControl func(network, address string, c syscall.RawConn) error
+	// LocalAddr, if not nil, is the local address outgoing connections, both to origin servers and
+	// for CONNECT tunnels, are bound to. Useful for choosing the egress IP on multi-homed hosts.
+	// It is ignored if Tr.DialContext is replaced, or Tr.Dial is set.
+	LocalAddr net.Addr
+	// ReadBufferSize is the size of the buffers used to read requests and responses in
+	// eavesdropped CONNECT connections. If zero, the bufio default size is used.
+	ReadBufferSize int
+	// DebugMatches records for every request which of the registered handlers had their
+	// conditions met, see CtxMatchedReqHandlers and CtxMatchedRespHandlers. The matches
+	// are logged to the debug logger.
+	DebugMatches bool
+	// OnHandlerTiming, if not nil, is called after every request and response handler runs, with
+	// the time it took. response tells response handlers apart from request handlers, and index is
+	// the position of the handler in registration order, as in CtxMatchedReqHandlers. It is meant
+	// to find expensive handlers, handlers are not timed when it is nil.
+	OnHandlerTiming func(req *http.Request, response bool, index int, elapsed time.Duration)
+	// RetryPolicy, if not nil, retries proxied requests failing to reach their origin server, see
+	// RetryPolicy. The error of the last attempt is passed to the response handlers as usual.
+	RetryPolicy *RetryPolicy
+	// Metrics, if not nil, is notified of the requests going through the proxy, their responses
+	// and errors, and of CONNECT requests.
+	Metrics Metrics
+	// ClientIPFunc, if not nil, returns the IP of the client that sent the request. It is used by
+	// conditions on the client IP, such as ClientIPIs, and for logging. Set it when the proxy is behind a load
+	// balancer, where req.RemoteAddr is not the real client. See ClientIP.
+	ClientIPFunc func(req *http.Request) string
+	// DryRun runs the handlers against copies of the requests and responses, and logs what they
+	// would have done to the debug logger, but sends the originals untouched. CONNECT requests are
+	// accepted, whatever their handlers decide. Use it to validate new rules against real traffic.
+	// Bodies are not available to handlers in dry run.
+	DryRun bool
+	// LeafSerialFunc, if not nil, returns the serial number of the certificate forged for host when
+	// eavesdropping CONNECT requests with TLSConfigFromCA. Serials must be unique among the
+	// certificates signed by the same CA, as clients may reject or confuse certificates sharing
+	// a serial. It is only called when a certificate is signed, not when one is taken from the
+	// CertStore. By default, the serial is a random 128 bit number from crypto/rand.
+	LeafSerialFunc func(host string) *big.Int
+	// OnLeafCertGenerated, if not nil, is called with every certificate TLSConfigFromCA forges for
+	// host, e.g. to log its names, validity and key type when clients reject it. cert.Leaf is set.
+	// It must not modify cert.
+	OnLeafCertGenerated func(host string, cert *tls.Certificate)
+	// CertStore, if not nil, keeps the certificates TLSConfigFromCA forges, so that they are reused
+	// by later CONNECT requests to the same host. New sets it to an in memory store keeping
+	// DefaultCertStoreSize certificates, set it to nil to sign a certificate on every CONNECT.
+	CertStore CertStore
+	// CA is the certificate authority signing the certificates forged for eavesdropped CONNECT
+	// tunnels by the default ConnectActions, such as MitmConnect. New sets it to GoproxyCa.
+	CA *tls.Certificate
+	// SignHost, if not nil, replaces the default signer of the certificates forged for
+	// eavesdropped CONNECT tunnels, returning a certificate for hosts signed by ca.
+	// LeafSerialFunc and LeafCertTemplate only apply to the default signer.
+	SignHost func(ca tls.Certificate, hosts []string) (tls.Certificate, error)
+	// MitmSessionTicketKeys, if not empty, are the keys TLSConfigFromCA uses to encrypt and decrypt
+	// the TLS session tickets of eavesdropped CONNECT tunnels, see tls.Config.SetSessionTicketKeys.
+	// Set them to let clients resume sessions across proxy restarts. By default, a random key
+	// generated once per TLSConfigFromCA is used.
+	MitmSessionTicketKeys [][32]byte
+	// LeafCertTemplate, if not nil, returns the template of the certificate forged for host when
+	// eavesdropping CONNECT requests with TLSConfigFromCA, given the default template base. It may
+	// modify and return base, e.g. to add extended key usages or extensions for testing how clients
+	// validate certificates. The serial, subject names and validity are already set in base.
+	LeafCertTemplate func(host string, base *x509.Certificate) *x509.Certificate
+	// BadRequestResponse, if not nil, returns the response sent before closing an eavesdropped
+	// CONNECT tunnel, when a request in it could not be parsed. connect is the CONNECT request of
+	// the tunnel, and err the parsing error. If it is nil or returns nil, 400 Bad Request is sent.
+	BadRequestResponse func(connect *http.Request, err error) *http.Response
+	// MaxRequestsPerTunnel, if positive, is the maximal number of requests served in a single
+	// eavesdropped CONNECT tunnel. The response to the last one has Connection: close, and the
+	// tunnel is closed after it. Zero means unlimited.
+	MaxRequestsPerTunnel int
+	// MaxConnections, if positive, is the maximal number of client connections, including CONNECT
+	// tunnels, open at once when serving with proxy.Serve. Further connections are not accepted
+	// until an open one is closed. Zero means unlimited.
+	MaxConnections int
+	// WriteResponseFunc, if not nil, replaces WriteResponse in writing the final response of a
+	// proxied request to the client, after all handlers ran. Use it to control the exact headers
+	// and framing sent. It may call proxy.WriteResponse, and must not close resp.Body.
+	WriteResponseFunc func(w http.ResponseWriter, r *http.Request, resp *http.Response) error
+	// MaxResponseHeaderBytes limits the size of the response headers read from origin servers in
+	// eavesdropped plain HTTP CONNECT tunnels. The bytes buffered while reading the headers count
+	// towards the limit. Larger responses are answered with 502 Bad Gateway. If zero, 1MB is used.
+	// Other responses are limited by Tr.MaxResponseHeaderBytes.
+	MaxResponseHeaderBytes int64
+	// MitmUpstreamNextProtos, if not empty, are the ALPN protocols offered to the origin servers
+	// of TLS eavesdropped CONNECT tunnels, e.g. []string{"http/1.1"} to keep origins offering h2
+	// on HTTP/1.1, or []string{"h2", "http/1.1"} to use HTTP/2 with them, regardless of the
+	// protocol spoken with the client. Requests are then sent with a clone of Tr with these
+	// protocols, unless a handler set a RoundTripper with CtxWithRoundTripper. The clone is
+	// rebuilt when these protocols change or Tr is replaced, but changes to the fields of Tr
+	// itself are not picked up: assign a new Tr to apply them.
+	MitmUpstreamNextProtos []string
+	// IdleConnTimeout, if not zero, is the maximum amount of time a pooled connection to an origin
+	// server may stay idle before being closed, overriding Tr.IdleConnTimeout. Tr is not modified,
+	// requests are sent with a clone of it with this timeout instead. Like for
+	// MitmUpstreamNextProtos, the clone is rebuilt when the timeout changes or Tr is replaced.
+	IdleConnTimeout time.Duration
+	// ConnectPool, if not nil, keeps the connections to origin servers of ConnectHTTPMitm tunnels
+	// once the tunnels end, for reuse by later tunnels to the same host:port. Connections of other
+	// tunnels carry opaque bytes, and cannot be reused.
+	ConnectPool *ConnPool
+	// MitmDialRetries is the number of times a failed connection to the origin server of an
+	// eavesdropped CONNECT tunnel is retried, before answering the request in the tunnel with
+	// 502 Bad Gateway. Requests with bodies that cannot be replayed are not retried.
+	MitmDialRetries int
+	// MitmDialBackoff is the wait before the first retry of MitmDialRetries, doubled after every
+	// retry. If zero, 100ms is used.
+	MitmDialBackoff time.Duration
+	// TolerateHTTP09, if true, salvages responses without a status line, as sent by HTTP/0.9 or
+	// broken origin servers, in eavesdropped plain HTTP CONNECT tunnels. Instead of failing, the
+	// raw bytes are sent to the client as the body of a 200 OK response, and the tunnel is closed
+	// after it, as such responses end when the connection does.
+	TolerateHTTP09 bool
+	// RequestTimeout, if not zero, limits the time a proxied request may take, from sending it to
+	// the origin server until the response body was copied to the client, including requests
+	// eavesdropped in CONNECT tunnels. Requests timing out before the response headers arrive are
+	// answered with 504 Gateway Timeout, slow bodies are cut short. Accepted CONNECT tunnels are
+	// not limited.
+	RequestTimeout time.Duration
+	// OnMitmHandshakeError, if not nil, is called when the TLS handshake with the client of an
+	// eavesdropped CONNECT tunnel fails, typically because the client does not trust the CA.
+	// connect is the CONNECT request of the tunnel. See HandshakeFailures.
+	OnMitmHandshakeError func(connect *http.Request, err error)
+	// MITMEvents are callbacks observing the stages of handling CONNECT requests
+	MITMEvents MITMEvents
+	// PinCheckedIPs makes the proxy connect to the IPs DstIsPrivate checked for the destination of
+	// a request, instead of resolving it again when dialing. Otherwise, a DNS rebinding attack,
+	// resolving the host to a public IP for the check, and to a private one for the dial, bypasses
+	// the check. It is ignored if Tr.DialContext or ConnectDial are replaced, e.g. when using an
+	// upstream proxy.
+	PinCheckedIPs bool
+}
+
+// BypassResponseFilters makes responses matching cond skip all response handlers, and be copied
+// to the client untouched. Use it to stream huge downloads, such as videos or disk images, without
+// the overhead of the handler chain.
+//
+//	proxy.BypassResponseFilters(goproxy.ContentTypeIs("application/octet-stream", "video/mp4"))
+func (proxy *ProxyHttpServer) BypassResponseFilters(cond RespCondition) {
+	proxy.handlersMu.Lock()
+	defer proxy.handlersMu.Unlock()
+	proxy.bypassConds = append(proxy.bypassConds, cond)
+}
+
+// SetHandlers atomically replaces all the request, response and CONNECT handlers of the proxy,
+// e.g. to reload rules from a configuration file. Requests already being handled keep using the
+// handlers registered when they started. Handlers passed here are called on every request, test
+// conditions in the handlers themselves.
+func (proxy *ProxyHttpServer) SetHandlers(req []ReqHandler, resp []RespHandler, https []HttpsHandler) {
+	set := handlerSet{
+		req:   append([]ReqHandler{}, req...),
+		resp:  append([]RespHandler{}, resp...),
+		https: append([]HttpsHandler{}, https...),
+	}
+	proxy.handlersMu.Lock()
+	defer proxy.handlersMu.Unlock()
+	proxy.reqHandlers, proxy.respHandlers, proxy.httpsHandlers = set.req, set.resp, set.https
+}
+
+// handlerSet is a snapshot of the handlers registered on a proxy
+type handlerSet struct {
+	req    []ReqHandler
+	resp   []RespHandler
+	https  []HttpsHandler
+	bypass []RespCondition
+}
+
+// handlers returns the currently registered handlers. Registration only appends, or replaces the
+// slices, so the returned slices are never modified.
+func (proxy *ProxyHttpServer) handlers() *handlerSet {
+	proxy.handlersMu.RLock()
+	defer proxy.handlersMu.RUnlock()
+	return &handlerSet{proxy.reqHandlers, proxy.respHandlers, proxy.httpsHandlers, proxy.bypassConds}
+}
+
+// SetRoundTripper makes rt send the requests of the proxy to origin servers, instead of Tr,
+// unless a handler sets another one with CtxWithRoundTripper. Use it to wrap the transport, e.g.
+// for instrumentation or circuit breaking. nil restores Tr. It may be called while serving, requests
+// already sent keep using the RoundTripper they were sent with.
+//
+// CONNECT tunnels are still dialed with ConnectDial, or Tr.DialContext, and the features
+// configuring Tr, such as NoUpstreamProxy, IdleConnTimeout, PinCheckedIPs and
+// MitmUpstreamNextProtos, only apply to rt if it sends its requests with Tr.
+// CloseIdleConnections is passed to rt if it has such a method.
+func (proxy *ProxyHttpServer) SetRoundTripper(rt http.RoundTripper) {
+	proxy.rtMu.Lock()
+	defer proxy.rtMu.Unlock()
+	proxy.rt = rt
+}
+
+// customRoundTripper returns the RoundTripper set with SetRoundTripper, or nil
+func (proxy *ProxyHttpServer) customRoundTripper() http.RoundTripper {
+	proxy.rtMu.RLock()
+	defer proxy.rtMu.RUnlock()
+	return proxy.rt
+}
+
+// roundTripper returns the RoundTripper set with SetRoundTripper, or Tr, with IdleConnTimeout
+func (proxy *ProxyHttpServer) roundTripper() http.RoundTripper {
+	if rt := proxy.customRoundTripper(); rt != nil {
+		return rt
+	}
+	return proxy.transport()
+}
+
+// transport returns Tr, or a clone of it with IdleConnTimeout, if set
+func (proxy *ProxyHttpServer) transport() *http.Transport {
+	timeout := proxy.IdleConnTimeout
+	if timeout == 0 {
+		return proxy.Tr
+	}
+	proxy.idleTrMu.Lock()
+	defer proxy.idleTrMu.Unlock()
+	// the clone is kept, so that its connections are reused, until Tr or the timeout change
+	if proxy.idleTr == nil || proxy.idleTrBase != proxy.Tr || proxy.idleTr.IdleConnTimeout != timeout {
+		if proxy.idleTr != nil {
+			proxy.idleTr.CloseIdleConnections()
+		}
+		tr := proxy.Tr.Clone()
+		tr.IdleConnTimeout = timeout
+		proxy.idleTr, proxy.idleTrBase = tr, proxy.Tr
+	}
+	return proxy.idleTr
+}
+
+// NoUpstreamProxy makes the proxy connect directly to origin servers, ignoring the HTTP_PROXY and
+// HTTPS_PROXY environment variables New uses by default to route requests through another proxy.
+func (proxy *ProxyHttpServer) NoUpstreamProxy() {
+	proxy.Tr.Proxy = nil
+	proxy.ConnectDial = nil
+}
+
+// CloseIdleConnections closes the idle pooled connections of the proxy transport to origin servers.
+// Call it, e.g. periodically, to recover from stale connections to backends whose IP changed.
+func (proxy *ProxyHttpServer) CloseIdleConnections() {
+	proxy.Tr.CloseIdleConnections()
+	// and the ones of its clones
+	proxy.idleTrMu.Lock()
+	if proxy.idleTr != nil {
+		proxy.idleTr.CloseIdleConnections()
+	}
+	proxy.idleTrMu.Unlock()
+	proxy.mitmTrMu.Lock()
+	if proxy.mitmTr != nil {
+		proxy.mitmTr.CloseIdleConnections()
+	}
+	proxy.mitmTrMu.Unlock()
+	if c, ok := proxy.customRoundTripper().(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// ClientIP returns the IP of the client that sent req, as determined by the ClientIPFunc of the
+// proxy handling it. By default, it is the IP of req.RemoteAddr.
+func ClientIP(req *http.Request) string {
+	if proxy, ok := CtxProxyOK(req.Context()); ok && proxy.ClientIPFunc != nil {
+		return proxy.ClientIPFunc(req)
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
 }
 
 var hasPort = regexp.MustCompile(`:\d+$`)
@@ -79,20 +384,75 @@ func isEof(r *bufio.Reader) bool {
 }
 
 func (proxy *ProxyHttpServer) filterRequest(r *http.Request) (req *http.Request, resp *http.Response) {
+	if proxy.DryRun {
+		proxy.dryRunRequest(r)
+		req = r
+	} else {
+		req, resp = proxy.runReqHandlers(r)
+	}
+	if proxy.StripAltSvc && resp == nil {
+		req, _ = StripAltUsed.Handle(req)
+	}
+	return req, resp
+}
+
+func (proxy *ProxyHttpServer) runReqHandlers(r *http.Request) (req *http.Request, resp *http.Response) {
 	req = r
-	for _, h := range proxy.reqHandlers {
-		req, resp = h.Handle(req)
+	for i, h := range proxy.ctxHandlers(r.Context()).req {
+		var newReq *http.Request
+		if proxy.OnHandlerTiming != nil {
+			start := time.Now()
+			newReq, resp = h.Handle(req)
+			timed := req
+			if newReq != nil {
+				timed = newReq
+			}
+			proxy.OnHandlerTiming(timed, false, i, time.Since(start))
+		} else {
+			newReq, resp = h.Handle(req)
+		}
+		// handlers returning a canned response might return a nil request,
+		// keep the last one, so that response handlers would still have it.
+		if newReq != nil {
+			req = newReq
+		}
 		// non-nil resp means the handler decided to skip sending the request
 		// and return canned response instead.
 		if resp != nil {
+			req = req.WithContext(ctxWithSynthesized(req.Context()))
 			break
 		}
 	}
 	return
 }
 func (proxy *ProxyHttpServer) filterResponse(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
-	for _, h := range proxy.respHandlers {
-		req, resp = h.Handle(req, resp)
+	if resp != nil {
+		for _, cond := range proxy.ctxHandlers(req.Context()).bypass {
+			if cond.HandleResp(req, resp) {
+				return req, resp
+			}
+		}
+	}
+	if proxy.DryRun {
+		proxy.dryRunResponse(req, resp)
+	} else {
+		req, resp = proxy.runRespHandlers(req, resp)
+	}
+	if proxy.StripAltSvc {
+		req, resp = StripH3Advertisement(proxy.KeepNonH3AltSvc).Handle(req, resp)
+	}
+	return req, resp
+}
+
+func (proxy *ProxyHttpServer) runRespHandlers(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+	for i, h := range proxy.ctxHandlers(req.Context()).resp {
+		if proxy.OnHandlerTiming != nil {
+			start := time.Now()
+			req, resp = h.Handle(req, resp)
+			proxy.OnHandlerTiming(req, true, i, time.Since(start))
+		} else {
+			req, resp = h.Handle(req, resp)
+		}
 	}
 	return req, resp
 }
@@ -123,53 +483,109 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		proxy.handleHttps(w, r)
 	} else {
 		r = proxy.requestWithContext(r)
+		r = ctxWithEarlyHints(r, responseWriterEarlyHints(w))
+		defer proxy.finish(r.Context())
 
 		var err error
-		proxy.Loggers.Debug.Log("event", "request", "path", r.URL.Path, "host", r.Host, "method", r.Method, "url", r.URL.String())
-		if !r.URL.IsAbs() {
+		proxy.debugLog(r.Context()).Log("event", "request", "client", ClientIP(r), "path", r.URL.Path, "host", r.Host, "method", r.Method, "url", r.URL.String())
+		if !r.URL.IsAbs() && !transparentRequest(r) {
 			proxy.NonproxyHandler.ServeHTTP(w, r)
 			return
 		}
+		start := time.Now()
+		proxy.metrics().ObserveRequest(r)
 		r, resp := proxy.filterRequest(r)
+		if resp == nil {
+			if err := proxy.acquireHostSlot(r); err != nil {
+				resp = proxy.hostLimitResponse(r, err)
+			}
+		}
 
 		if resp == nil {
 			removeProxyHeaders(r)
+			r = proxy.withRequestTimeout(r)
 			rt := CtxRoundTripper(r.Context())
-			resp, err = rt.RoundTrip(r)
+			resp, err = proxy.roundTrip(rt, r)
 			if err != nil {
+				proxy.metrics().ObserveError(r, err)
 				r = r.WithContext(CtxWithError(r.Context(), err))
 				r, resp = proxy.filterResponse(r, nil)
 				if resp == nil {
 					proxy.Loggers.Error.Log("event", "read response", "error", err.Error())
-					http.Error(w, err.Error(), 500)
+					if isTimeout(err) {
+						http.Error(w, "Gateway Timeout: "+err.Error(), http.StatusGatewayTimeout)
+					} else {
+						http.Error(w, err.Error(), 500)
+					}
 					return
 				}
 			}
-			proxy.Loggers.Debug.Log("event", "response", "status", resp.Status)
+			proxy.debugLog(r.Context()).Log("event", "response", "status", resp.Status)
 		}
 		origBody := resp.Body
+		origContentLength, origContentLengthHeader := resp.ContentLength, resp.Header.Get("Content-Length")
 		r, resp = proxy.filterResponse(r, resp)
-		defer origBody.Close()
-		proxy.Loggers.Debug.Log("event", "before copy response", "status", resp.Status)
+		defer func() {
+			if err := origBody.Close(); err != nil && (resp == nil || origBody != unpeekedBody(resp.Body)) {
+				recordTransferError(r.Context(), err)
+			}
+		}()
+		if resp == nil {
+			proxy.Loggers.Error.Log("event", "response handler returned nil response", "url", r.URL.String())
+			http.Error(w, "proxy response handlers returned no response", http.StatusBadGateway)
+			return
+		}
+		if proxy.DebugMatches {
+			proxy.debugLog(r.Context()).Log("event", "matched handlers", "url", r.URL.String(),
+				"request", CtxMatchedReqHandlers(r.Context()), "response", CtxMatchedRespHandlers(r.Context()))
+		}
+		proxy.debugLog(r.Context()).Log("event", "before copy response", "status", resp.Status)
 		// http.ResponseWriter will take care of filling the correct response length
 		// Setting it now, might impose wrong value, contradicting the actual new
 		// body the user returned.
 		// We keep the original body to remove the header only if things changed.
 		// This will prevent problems with HEAD requests where there's no body, yet,
 		// the Content-Length header should be set.
-		if origBody != resp.Body {
-			resp.Header.Del("Content-Length")
+		// A handler that knows the length of the new body can declare it, by setting
+		// either the Content-Length header or resp.ContentLength, and it will be respected.
+		if origBody != unpeekedBody(resp.Body) {
+			switch {
+			case resp.Header.Get("Content-Length") != origContentLengthHeader:
+			case resp.ContentLength != origContentLength && resp.ContentLength >= 0:
+				resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+			default:
+				resp.Header.Del("Content-Length")
+			}
+		}
+		write := proxy.WriteResponse
+		if proxy.WriteResponseFunc != nil {
+			write = proxy.WriteResponseFunc
+		}
+		err = write(w, r, resp)
+		recordTransferError(r.Context(), err)
+		if err != nil {
+			proxy.metrics().ObserveError(r, err)
+		} else {
+			proxy.metrics().ObserveResponse(r, resp, time.Since(start))
 		}
-		copyHeaders(w.Header(), resp.Header)
-		w.WriteHeader(resp.StatusCode)
-		nr, err := io.Copy(w, resp.Body)
 		if err := resp.Body.Close(); err != nil {
 			proxy.Loggers.Error.Log("event", "copy response close", "error", err.Error())
+			recordTransferError(r.Context(), err)
 		}
-		proxy.Loggers.Debug.Log("event", "copy response", "nbytes", nr, "error", err)
+		proxy.debugLog(r.Context()).Log("event", "copy response", "error", err)
 	}
 }
 
+// WriteResponse writes resp, the response to r, to the client. It is the default way ServeHTTP writes
+// responses to proxied requests, see WriteResponseFunc. The caller closes resp.Body.
+func (proxy *ProxyHttpServer) WriteResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) error {
+	copyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	nr, err := io.Copy(w, resp.Body)
+	proxy.debugLog(r.Context()).Log("event", "copy response body", "nbytes", nr)
+	return err
+}
+
 // New proxy server, logs to StdErr by default
 func New() *ProxyHttpServer {
 	proxy := ProxyHttpServer{
@@ -183,6 +599,9 @@ func New() *ProxyHttpServer {
 		Tr: &http.Transport{TLSClientConfig: tlsClientSkipVerify,
 			Proxy: http.ProxyFromEnvironment},
 	}
+	proxy.CertStore = NewLRUCertStore(DefaultCertStoreSize)
+	proxy.CA = &GoproxyCa
+	proxy.Tr.DialContext = proxy.netDial
 	proxy.ConnectDial = dialerFromEnv(&proxy)
 	return &proxy
 }
@@ -3,20 +3,32 @@ package goproxy_test
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"image"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/elazarl/goproxy2"
 	"github.com/elazarl/goproxy2/ext/image"
@@ -834,3 +846,3121 @@ func TestHttpsMitmURLRewrite(t *testing.T) {
 		}
 	}
 }
+
+func TestNewResponseFromReader(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		f, err := os.Open("test_data/panda.png")
+		if err != nil {
+			t.Fatal("Cannot open panda.png", err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal("Cannot stat panda.png", err)
+		}
+		return nil, goproxy.NewResponseFromReader(req, http.StatusOK, "image/png", info.Size(), f)
+	})
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	if err != nil {
+		t.Fatal("Cannot get from proxy", err)
+	}
+	b := readAll(resp.Body, t)
+	expected := readFile("test_data/panda.png", t)
+	if !bytes.Equal(b, expected) {
+		t.Error("Expected panda.png from reader, got", len(b), "bytes")
+	}
+	if resp.ContentLength != int64(len(expected)) {
+		t.Error("Expected Content-Length", len(expected), "got", resp.ContentLength)
+	}
+}
+
+func TestReplaceBodyKeepsContentLength(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		// large enough for net/http not to compute the length by itself
+		resp.Body = ioutil.NopCloser(bytes.NewBufferString(strings.Repeat("chico", 2000)))
+		resp.Header.Set("Content-Length", "10000")
+		return req, resp
+	})
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	if err != nil {
+		t.Fatal("Cannot get from proxy", err)
+	}
+	if b := string(readAll(resp.Body, t)); b != strings.Repeat("chico", 2000) {
+		t.Error("Expected replaced body of chicos, got", len(b), "bytes")
+	}
+	if resp.ContentLength != 10000 || len(resp.TransferEncoding) != 0 {
+		t.Error("Expected Content-Length 10000 set by handler to be kept, got", resp.ContentLength, resp.TransferEncoding)
+	}
+}
+
+func TestStripAltSvc(t *testing.T) {
+	altUsed := make(chan string, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		altUsed <- r.Header.Get("Alt-Used")
+		w.Header().Set("Alt-Svc", `h3=":443"; ma=86400, h3-29=":443"; ma=86400, h2=":443"`)
+		io.WriteString(w, "altsvc")
+	}))
+	defer origin.Close()
+
+	for _, tc := range []struct {
+		keepOthers bool
+		expected   string
+	}{
+		{false, ""},
+		{true, `h2=":443"`},
+	} {
+		proxy := goproxy.New()
+		proxy.StripAltSvc = true
+		proxy.KeepNonH3AltSvc = tc.keepOthers
+		client, l := oneShotProxy(proxy, t)
+
+		req, _ := http.NewRequest("GET", origin.URL+"/", nil)
+		req.Header.Set("Alt-Used", "example.com:443")
+		resp, err := client.Do(req)
+		fatalOnErr(err, "Do", t)
+		resp.Body.Close()
+		if altsvc := resp.Header.Get("Alt-Svc"); altsvc != tc.expected {
+			t.Errorf("With KeepNonH3AltSvc %v, expected Alt-Svc %q, got %q", tc.keepOthers, tc.expected, altsvc)
+		}
+		if used := <-altUsed; used != "" {
+			t.Error("Expected Alt-Used to be stripped from the request, got", used)
+		}
+		l.Close()
+	}
+}
+
+func TestStripH3Advertisement(t *testing.T) {
+	for _, tc := range []struct {
+		keepOthers bool
+		expected   string
+	}{
+		{false, ""},
+		{true, `h2=":443", h2="alt.example.com:443"`},
+	} {
+		req, _ := http.NewRequest("GET", "https://example.com/", nil)
+		resp := &http.Response{Header: http.Header{"Alt-Svc": {`h3=":443"; ma=86400, h2=":443"`, `quic=":443", h2="alt.example.com:443"`}}}
+		_, resp = goproxy.StripH3Advertisement(tc.keepOthers).Handle(req, resp)
+		if altsvc := strings.Join(resp.Header["Alt-Svc"], "|"); altsvc != tc.expected {
+			t.Errorf("With keepOthers %v, expected Alt-Svc %q, got %q", tc.keepOthers, tc.expected, altsvc)
+		}
+		if _, resp = goproxy.StripH3Advertisement(tc.keepOthers).Handle(req, nil); resp != nil {
+			t.Error("Expected a nil response to be kept nil, got", resp)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	req.Header.Set("Alt-Used", "alt.example.com:443")
+	if req, resp := goproxy.StripAltUsed.Handle(req); resp != nil || req.Header.Get("Alt-Used") != "" {
+		t.Error("Expected StripAltUsed to remove Alt-Used from the request, got", req.Header, resp)
+	}
+}
+
+func TestDialControl(t *testing.T) {
+	proxy := goproxy.New()
+	var called int32
+	proxy.DialControl = func(network, address string, c syscall.RawConn) error {
+		atomic.AddInt32(&called, 1)
+		return nil
+	}
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("proxy server does not serve constant handlers", r)
+	}
+	if atomic.LoadInt32(&called) == 0 {
+		t.Error("DialControl was not called when dialing origin")
+	}
+}
+
+type RemoteAddrHandler struct{}
+
+func (RemoteAddrHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	io.WriteString(w, host)
+}
+
+func TestLocalAddr(t *testing.T) {
+	plain := httptest.NewServer(RemoteAddrHandler{})
+	defer plain.Close()
+	tlsSrv := httptest.NewTLSServer(RemoteAddrHandler{})
+	defer tlsSrv.Close()
+
+	proxy := goproxy.New()
+	proxy.LocalAddr = &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(plain.URL, client, t)); r != "127.0.0.2" {
+		t.Error("Expected origin connection from 127.0.0.2, got", r)
+	}
+	if r := string(getOrFail(tlsSrv.URL, client, t)); r != "127.0.0.2" {
+		t.Error("Expected CONNECT tunnel from 127.0.0.2, got", r)
+	}
+}
+
+func TestHTTPMitmOriginError(t *testing.T) {
+	origin, err := net.Listen("tcp", "localhost:0")
+	fatalOnErr(err, "listen", t)
+	go func() {
+		c, err := origin.Accept()
+		if err != nil {
+			return
+		}
+		// read the request, and close without responding
+		http.ReadRequest(bufio.NewReader(c))
+		c.Close()
+		origin.Close()
+	}()
+
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *goproxy.ConnectAction, string) {
+		return req, goproxy.HTTPMitmConnect, host
+	}))
+	var handlerErr error
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		if resp == nil {
+			handlerErr = goproxy.CtxError(req.Context())
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "fallback")
+		}
+		return req, resp
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	addr := origin.Addr().String()
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	readConnectResponse(buf)
+	io.WriteString(conn, "GET /bobo HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	resp, err := http.ReadResponse(buf, nil)
+	fatalOnErr(err, "ReadResponse", t)
+	if b := string(readAll(resp.Body, t)); resp.StatusCode != http.StatusBadGateway || b != "fallback" {
+		t.Error("Expected fallback response from handler, got", resp.Status, b)
+	}
+	if handlerErr == nil {
+		t.Error("Expected response handler to see the origin error")
+	}
+}
+
+func TestConnectToSelf(t *testing.T) {
+	proxy := goproxy.New()
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	proxyAddr := l.Listener.Addr().String()
+	conn, err := net.Dial("tcp", proxyAddr)
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT "+proxyAddr+" HTTP/1.1\r\nHost: "+proxyAddr+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	fatalOnErr(err, "ReadResponse", t)
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Error("Expected CONNECT to the proxy itself to be rejected, got", resp.Status)
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest(goproxy.UrlHasPrefix("/api/")).Do(goproxy.RewritePath(func(u *url.URL) {
+		u.Path = strings.TrimPrefix(u.Path, "/api")
+		u.RawQuery = "result=rewritten"
+	}))
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(srv.URL+"/api/query?result=original", client, t)); r != "rewritten" {
+		t.Error("Expected origin to receive rewritten path and query, got", r)
+	}
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected non matching path to stay as is, got", r)
+	}
+}
+
+func TestRespBodyMatches(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnResponse(goproxy.RespBodyMatches(regexp.MustCompile("^bo"), 10)).DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		resp.Header.Set("X-Matched", "1")
+		return req, resp
+	})
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	fatalOnErr(err, "Get bobo", t)
+	if b := string(readAll(resp.Body, t)); b != "bobo" || resp.Header.Get("X-Matched") != "1" {
+		t.Error("Expected bobo body to match and be kept, got", b, resp.Header)
+	}
+	if resp.ContentLength != 4 {
+		t.Error("Expected the Content-Length of the peeked body to be kept, got", resp.ContentLength)
+	}
+	resp, err = client.Get(srv.URL + "/query?result=" + strings.Repeat("bo", 10))
+	fatalOnErr(err, "Get long bobo", t)
+	if b := string(readAll(resp.Body, t)); b != strings.Repeat("bo", 10) || resp.Header.Get("X-Matched") != "" {
+		t.Error("Expected body over the limit not to match and be kept, got", b, resp.Header)
+	}
+	if resp.ContentLength != 20 {
+		t.Error("Expected the Content-Length of the unmatched body to be kept, got", resp.ContentLength)
+	}
+}
+
+func TestDebugMatches(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.DebugMatches = true
+	noop := func(req *http.Request) (*http.Request, *http.Response) { return req, nil }
+	proxy.OnRequest(goproxy.UrlIs("/koko")).DoFunc(noop)
+	proxy.OnRequest().DoFunc(noop)
+	proxy.OnRequest(goproxy.UrlIs("/bobo")).DoFunc(noop)
+	var matched []int
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		matched = goproxy.CtxMatchedReqHandlers(req.Context())
+		return req, resp
+	})
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(srv.URL+"/bobo", client, t)
+	if len(matched) != 2 || matched[0] != 1 || matched[1] != 2 {
+		t.Error("Expected request handlers 1 and 2 to match, got", matched)
+	}
+}
+
+func TestClientIPFunc(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.ClientIPFunc = func(req *http.Request) string {
+		return req.Header.Get("X-Real-Client")
+	}
+	proxy.OnRequest(goproxy.ClientIPIs("10.0.0.1")).DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		return nil, goproxy.TextResponse(req, "real client")
+	})
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/bobo", nil)
+	fatalOnErr(err, "NewRequest", t)
+	req.Header.Set("X-Real-Client", "10.0.0.1")
+	resp, err := client.Do(req)
+	fatalOnErr(err, "Do", t)
+	if b := string(readAll(resp.Body, t)); b != "real client" {
+		t.Error("Expected ClientIPIs to use ClientIPFunc, got", b)
+	}
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected request without real client not to match, got", r)
+	}
+}
+
+func TestBypassResponseFilters(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.BypassResponseFilters(goproxy.ContentTypeIs("image/png"))
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		resp.Header.Set("X-Filtered", "1")
+		return req, resp
+	})
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(localFile("test_data/panda.png"))
+	fatalOnErr(err, "Get panda.png", t)
+	resp.Body.Close()
+	if resp.Header.Get("X-Filtered") != "" {
+		t.Error("Expected png response to bypass response handlers")
+	}
+	resp, err = client.Get(srv.URL + "/bobo")
+	fatalOnErr(err, "Get bobo", t)
+	resp.Body.Close()
+	if resp.Header.Get("X-Filtered") != "1" {
+		t.Error("Expected bobo response to be filtered")
+	}
+
+	// registering while serving requests
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.BypassResponseFilters(goproxy.ContentTypeIs("text/plain"))
+	}()
+	getOrFail(srv.URL+"/bobo", client, t)
+	<-done
+	resp, err = client.Get(srv.URL + "/bobo")
+	fatalOnErr(err, "Get bobo", t)
+	resp.Body.Close()
+	if resp.Header.Get("X-Filtered") != "" {
+		t.Error("Expected bobo response to bypass response handlers once text/plain is bypassed")
+	}
+}
+
+var largeBody = bytes.Repeat([]byte("0123456789abcdef"), 4*1024*1024/16)
+
+func benchmarkLargeResponse(b *testing.B, bypass bool) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(largeBody)
+	}))
+	defer origin.Close()
+	proxy := goproxy.New()
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		resp.Body = ioutil.NopCloser(resp.Body)
+		return req, resp
+	})
+	if bypass {
+		proxy.BypassResponseFilters(goproxy.ContentTypeIs("application/octet-stream"))
+	}
+	client, l := oneShotProxy(proxy, nil)
+	defer l.Close()
+
+	b.SetBytes(int64(len(largeBody)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp, err := client.Get(origin.URL)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+func BenchmarkLargeResponse(b *testing.B)       { benchmarkLargeResponse(b, false) }
+func BenchmarkLargeResponseBypass(b *testing.B) { benchmarkLargeResponse(b, true) }
+
+func TestIsDomainFronting(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.IsDomainFronting).DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		return nil, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden,
+			"fronting "+goproxy.CtxConnectHost(req.Context())+" "+req.Host)
+	})
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected request with matching Host to pass, got", r)
+	}
+	req, err := http.NewRequest("GET", https.URL+"/bobo", nil)
+	fatalOnErr(err, "NewRequest", t)
+	req.Host = "evil.example.com"
+	resp, err := client.Do(req)
+	fatalOnErr(err, "Do", t)
+	if b := string(readAll(resp.Body, t)); resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected domain fronting to be detected, got", resp.Status, b)
+	}
+}
+
+func TestNoUpstreamProxy(t *testing.T) {
+	defer os.Setenv("HTTPS_PROXY", os.Getenv("HTTPS_PROXY"))
+	// nothing listens on port 1, CONNECT requests would fail if sent through it
+	os.Setenv("HTTPS_PROXY", "http://127.0.0.1:1")
+	proxy := goproxy.New()
+	proxy.NoUpstreamProxy()
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected CONNECT to connect directly, got", r)
+	}
+}
+
+func TestCtxOKBareContext(t *testing.T) {
+	ctx := context.Background()
+	if proxy, ok := goproxy.CtxProxyOK(ctx); ok || proxy != nil {
+		t.Error("Expected no proxy in a bare context, got", proxy)
+	}
+	if req, ok := goproxy.CtxReqOK(ctx); ok || req != nil {
+		t.Error("Expected no request in a bare context, got", req)
+	}
+	if resp, ok := goproxy.CtxRespOK(ctx); ok || resp != nil {
+		t.Error("Expected no response in a bare context, got", resp)
+	}
+}
+
+func TestCtxSynthesized(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest(goproxy.UrlIs("/koko")).DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		return nil, goproxy.TextResponse(req, "koko")
+	})
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		if goproxy.CtxSynthesized(req.Context()) {
+			resp.Header.Set("X-Synthesized", "1")
+		}
+		return req, resp
+	})
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, tc := range []struct{ path, synthesized string }{{"/koko", "1"}, {"/bobo", ""}} {
+		resp, err := client.Get(srv.URL + tc.path)
+		fatalOnErr(err, "Get", t)
+		resp.Body.Close()
+		if resp.Header.Get("X-Synthesized") != tc.synthesized {
+			t.Errorf("%s: expected X-Synthesized %q, got %q", tc.path, tc.synthesized, resp.Header.Get("X-Synthesized"))
+		}
+	}
+}
+
+type recordingLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *recordingLogger) Log(keyvals ...interface{}) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, fmt.Sprintln(keyvals...))
+	return nil
+}
+
+func (l *recordingLogger) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, log := range l.logs {
+		if strings.Contains(log, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDryRun(t *testing.T) {
+	proxy := goproxy.New()
+	logger := &recordingLogger{}
+	proxy.Loggers.Debug = logger
+	proxy.DryRun = true
+	proxy.OnRequest(goproxy.UrlIs("/bobo")).DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		return nil, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "blocked")
+	})
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		resp.Header.Set("X-Dry", "1")
+		return req, resp
+	})
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	fatalOnErr(err, "Get", t)
+	if b := string(readAll(resp.Body, t)); b != "bobo" || resp.Header.Get("X-Dry") != "" {
+		t.Error("Expected original response in dry run, got", b, resp.Header)
+	}
+	if !logger.contains("action respond status 403") {
+		t.Error("Expected dry run to log the blocking response, got", logger.logs)
+	}
+	if !logger.contains("action response headers headers [X-Dry]") {
+		t.Error("Expected dry run to log the response header change, got", logger.logs)
+	}
+}
+
+func TestDryRunConnect(t *testing.T) {
+	proxy := goproxy.New()
+	logger := &recordingLogger{}
+	proxy.Loggers.Debug = logger
+	proxy.DryRun = true
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysReject)
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if b := string(getOrFail(https.URL+"/bobo", client, t)); b != "bobo" {
+		t.Error("Expected the CONNECT to be accepted in dry run, got", b)
+	}
+	if !logger.contains("action connect connect reject") {
+		t.Error("Expected dry run to log the CONNECT rejection, got", logger.logs)
+	}
+}
+
+func TestAnswerCORSPreflight(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest(goproxy.ReqIsCORSPreflight).Do(goproxy.AnswerCORSPreflight(goproxy.CORSConfig{
+		AllowedOrigins: []string{"http://app.example.com"},
+		AllowedMethods: []string{"GET", "POST"},
+	}))
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	req, err := http.NewRequest("OPTIONS", srv.URL+"/bobo", nil)
+	fatalOnErr(err, "NewRequest", t)
+	req.Header.Set("Origin", "http://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	resp, err := client.Do(req)
+	fatalOnErr(err, "Do", t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent ||
+		resp.Header.Get("Access-Control-Allow-Origin") != "http://app.example.com" ||
+		resp.Header.Get("Access-Control-Allow-Methods") != "GET, POST" {
+		t.Error("Expected preflight to be answered by the proxy, got", resp.Status, resp.Header)
+	}
+
+	req.Header.Set("Origin", "http://evil.example.com")
+	resp, err = client.Do(req)
+	fatalOnErr(err, "Do", t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected preflight from other origin to be forbidden, got", resp.Status)
+	}
+}
+
+func TestCtxOnFinish(t *testing.T) {
+	proxy := goproxy.New()
+	var mu sync.Mutex
+	var calls []string
+	record := func(s string) func() {
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, s)
+		}
+	}
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		goproxy.CtxOnFinish(req.Context(), record("first"))
+		goproxy.CtxOnFinish(req.Context(), func() { panic("finish panic") })
+		goproxy.CtxOnFinish(req.Context(), record("second"))
+		return req, nil
+	})
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(srv.URL+"/bobo", client, t)
+	mu.Lock()
+	if strings.Join(calls, ",") != "second,first" {
+		t.Error("Expected finish callbacks to run once in reverse order, got", calls)
+	}
+	mu.Unlock()
+	if goproxy.CtxOnFinish(context.Background(), record("outside")) {
+		t.Error("Expected CtxOnFinish outside of proxy requests to fail")
+	}
+}
+
+func TestMitmHeaderInjection(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		resp.Header.Set("X-Echo", "a\r\nSet-Cookie: pwned=1")
+		return req, resp
+	})
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(https.URL + "/bobo")
+	fatalOnErr(err, "Get", t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("Set-Cookie") != "" {
+		t.Error("Expected response with injected header to be rejected, got", resp.Status, resp.Header)
+	}
+}
+
+func TestLeafSerialFunc(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	var gotHost string
+	calls := 0
+	proxy.LeafSerialFunc = func(host string) *big.Int {
+		gotHost = host
+		calls++
+		return big.NewInt(42)
+	}
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	// a new tunnel, and handshake, for every request
+	client.Transport.(*http.Transport).DisableKeepAlives = true
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(https.URL + "/bobo")
+		fatalOnErr(err, "Get", t)
+		resp.Body.Close()
+		if serial := resp.TLS.PeerCertificates[0].SerialNumber; serial.Cmp(big.NewInt(42)) != 0 {
+			t.Error("Expected leaf serial 42, got", serial)
+		}
+	}
+	if u, _ := url.Parse(https.URL); gotHost != u.Hostname() {
+		t.Error("Expected LeafSerialFunc to be called with", u.Hostname(), "got", gotHost)
+	}
+	if calls != 1 {
+		t.Error("Expected LeafSerialFunc to be called once, for the certificate missing from the CertStore, got", calls)
+	}
+}
+
+func TestOnLeafCertGenerated(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	var leaf *x509.Certificate
+	proxy.OnLeafCertGenerated = func(host string, cert *tls.Certificate) {
+		leaf = cert.Leaf
+	}
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(https.URL + "/bobo")
+	fatalOnErr(err, "Get", t)
+	resp.Body.Close()
+	if leaf == nil {
+		t.Fatal("Expected OnLeafCertGenerated to be called")
+	}
+	if !leaf.Equal(resp.TLS.PeerCertificates[0]) {
+		t.Error("Expected the reported certificate to be the one sent to the client")
+	}
+}
+
+func TestNilResponseFromHandler(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		return req, nil
+	})
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	fatalOnErr(err, "Get", t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Error("Expected 502 when a handler returns a nil response, got", resp.Status)
+	}
+}
+
+func TestMitmBadRequest(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	readConnectResponse(buf)
+	tlsConn := tls.Client(conn, acceptAllCerts)
+	io.WriteString(tlsConn, "GARBAGE\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	fatalOnErr(err, "ReadResponse", t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected 400 for a malformed request, got", resp.Status)
+	}
+}
+
+func TestMaxRequestsPerTunnel(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.MaxRequestsPerTunnel = 2
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *goproxy.ConnectAction, string) {
+		return req, goproxy.HTTPMitmConnect, host
+	}))
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	addr := srv.Listener.Addr().String()
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	readConnectResponse(buf)
+	for i := 1; i <= 2; i++ {
+		io.WriteString(conn, "GET /bobo HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		resp, err := http.ReadResponse(buf, nil)
+		fatalOnErr(err, "ReadResponse", t)
+		readAll(resp.Body, t)
+		if resp.Close != (i == 2) {
+			t.Errorf("Expected Connection: close only on response 2, got %v on response %d", resp.Close, i)
+		}
+	}
+	io.WriteString(conn, "GET /bobo HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	if _, err := http.ReadResponse(buf, nil); err == nil {
+		t.Error("Expected tunnel to be closed after the limit")
+	}
+}
+
+func TestWriteResponseFunc(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.WriteResponseFunc = func(w http.ResponseWriter, r *http.Request, resp *http.Response) error {
+		resp.Header.Set("X-Written-By", "custom")
+		return proxy.WriteResponse(w, r, resp)
+	}
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	fatalOnErr(err, "Get", t)
+	if b := string(readAll(resp.Body, t)); b != "bobo" || resp.Header.Get("X-Written-By") != "custom" {
+		t.Error("Expected response written by WriteResponseFunc, got", b, resp.Header)
+	}
+}
+
+func TestHostConcurrencyLimit(t *testing.T) {
+	var inFlight, maxInFlight int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+	}))
+	defer slow.Close()
+
+	proxy := goproxy.New()
+	proxy.SetHostConcurrencyLimit(slow.Listener.Addr().String(), 1)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(slow.URL)
+			if err != nil {
+				t.Error("Get", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if maxInFlight != 1 {
+		t.Error("Expected at most 1 concurrent request to the host, got", maxInFlight)
+	}
+
+	// requests eavesdropped in HTTP MITM tunnels are limited too
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *goproxy.ConnectAction, string) {
+		return req, goproxy.HTTPMitmConnect, host
+	}))
+	maxInFlight = 0
+	addr := slow.Listener.Addr().String()
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", l.Listener.Addr().String())
+			if err != nil {
+				t.Error("dial proxy", err)
+				return
+			}
+			defer conn.Close()
+			buf := bufio.NewReader(conn)
+			io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+			readConnectResponse(buf)
+			io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+			resp, err := http.ReadResponse(buf, nil)
+			if err != nil {
+				t.Error("ReadResponse", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if maxInFlight != 1 {
+		t.Error("Expected at most 1 concurrent HTTP MITM request to the host, got", maxInFlight)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(b []byte) (int, error) { return 0, errors.New("failing body") }
+
+func TestTransferErrorOnFinish(t *testing.T) {
+	proxy := goproxy.New()
+	errc := make(chan error, 1)
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		goproxy.CtxOnFinish(req.Context(), func() { errc <- goproxy.CtxError(req.Context()) })
+		resp.Body = ioutil.NopCloser(io.MultiReader(strings.NewReader("partial"), failingReader{}))
+		return req, resp
+	})
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if resp, err := client.Get(srv.URL + "/bobo"); err == nil {
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err := <-errc; err == nil || err.Error() != "failing body" {
+		t.Error("Expected CtxError to report the body copy error, got", err)
+	}
+}
+
+func TestHTTPMitmMaxResponseHeaderBytes(t *testing.T) {
+	origin, err := net.Listen("tcp", "localhost:0")
+	fatalOnErr(err, "listen", t)
+	defer origin.Close()
+	go func() {
+		c, err := origin.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		http.ReadRequest(bufio.NewReader(c))
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nX-Huge: "+strings.Repeat("a", 64*1024)+"\r\nContent-Length: 0\r\n\r\n")
+	}()
+
+	proxy := goproxy.New()
+	proxy.MaxResponseHeaderBytes = 16 * 1024
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *goproxy.ConnectAction, string) {
+		return req, goproxy.HTTPMitmConnect, host
+	}))
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	addr := origin.Addr().String()
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	readConnectResponse(buf)
+	io.WriteString(conn, "GET /bobo HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	resp, err := http.ReadResponse(buf, nil)
+	fatalOnErr(err, "ReadResponse", t)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Error("Expected 502 for huge response headers, got", resp.Status)
+	}
+}
+
+func TestSetHandlers(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "old")
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "old" {
+		t.Error("Expected old handler response, got", r)
+	}
+	proxy.SetHandlers([]goproxy.ReqHandler{goproxy.FuncReqHandler(func(req *http.Request) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "new")
+	})}, nil, nil)
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "new" {
+		t.Error("Expected new handler response, got", r)
+	}
+	proxy.SetHandlers(nil, nil, nil)
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected no handlers after reset, got", r)
+	}
+}
+
+func TestCtxTimings(t *testing.T) {
+	proxy := goproxy.New()
+	timings := make(chan goproxy.Timings, 1)
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		goproxy.CtxOnFinish(req.Context(), func() { timings <- goproxy.CtxTimings(req.Context()) })
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(srv.URL+"/bobo", client, t)
+	tm := <-timings
+	if tm.ConnReused || tm.Connect <= 0 || tm.TimeToFirstByte < tm.Connect {
+		t.Errorf("Expected connect and first byte timings of a new connection, got %+v", tm)
+	}
+}
+
+func TestHandshakeFailuresCAInstallPage(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	failures := goproxy.NewHandshakeFailures(1)
+	failures.Track(proxy)
+	failed := make(chan bool, 1)
+	track := proxy.OnMitmHandshakeError
+	proxy.OnMitmHandshakeError = func(connect *http.Request, err error) {
+		track(connect, err)
+		failed <- true
+	}
+	proxy.OnRequest(failures).Do(failures.CAInstallPage("http://example.com/ca.pem"))
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	proxyUrl, _ := url.Parse(l.URL)
+
+	// a client not trusting the proxy CA
+	untrusting := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+	if _, err := untrusting.Get(https.URL + "/bobo"); err == nil {
+		t.Fatal("Expected certificate verification to fail")
+	}
+	<-failed
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); !strings.Contains(r, "http://example.com/ca.pem") {
+		t.Error("Expected CA install page, got", r)
+	}
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected the CA install page to be shown once, got", r)
+	}
+}
+
+func TestDebugCondition(t *testing.T) {
+	proxy := goproxy.New()
+	logger := &recordingLogger{}
+	proxy.Loggers = goproxy.Loggers{Error: logger, Debug: goproxy.NopLogger}
+	proxy.OnRequest(goproxy.UrlIs("/debugme")).Debug()
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(srv.URL+"/bobo", client, t)
+	if logger.contains("copy response") {
+		t.Error("Expected no debug logs for requests not marked for debugging")
+	}
+	getOrFail(srv.URL+"/debugme", client, t)
+	if !logger.contains("copy response") {
+		t.Error("Expected debug logs for requests marked for debugging")
+	}
+}
+
+func TestImageHandlerSniffing(t *testing.T) {
+	panda, err := ioutil.ReadFile("test_data/panda.png")
+	fatalOnErr(err, "ReadFile", t)
+	mislabeled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", fmt.Sprint(len(panda)))
+		w.Write(panda)
+	}))
+	defer mislabeled.Close()
+
+	proxy := goproxy.New()
+	football := getImage("test_data/football.png", t)
+	proxy.OnResponse().Do(goproxy_image.HandleImageSniffing(func(req *http.Request, img image.Image) image.Image {
+		return football
+	}))
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(mislabeled.URL)
+	fatalOnErr(err, "Get", t)
+	img, _, err := image.Decode(resp.Body)
+	if err != nil {
+		t.Error("decode", err)
+	} else {
+		compareImage(football, img, t)
+	}
+
+	resp, err = client.Get(srv.URL + "/bobo")
+	fatalOnErr(err, "Get bobo", t)
+	if r := string(readAll(resp.Body, t)); r != "bobo" || resp.ContentLength != 4 {
+		t.Error("Expected non images to be untouched, got", r, resp.ContentLength)
+	}
+
+	// a streamed page is not held until its first bytes arrive
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	streamed := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"text/html"}}, ContentLength: -1, Body: pr}
+	done := make(chan *http.Response)
+	go func() {
+		_, resp := goproxy_image.HandleImageSniffing(func(req *http.Request, img image.Image) image.Image {
+			return img
+		}).Handle(req, streamed)
+		done <- resp
+	}()
+	select {
+	case resp := <-done:
+		if resp.Body != pr {
+			t.Error("Expected the streamed page to be untouched")
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the streamed page not to be sniffed")
+	}
+}
+
+func TestLeafCertTemplate(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.LeafCertTemplate = func(host string, base *x509.Certificate) *x509.Certificate {
+		base.ExtKeyUsage = append(base.ExtKeyUsage, x509.ExtKeyUsageCodeSigning)
+		base.Subject.CommonName = "custom " + host
+		return base
+	}
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(https.URL + "/bobo")
+	fatalOnErr(err, "Get", t)
+	resp.Body.Close()
+	leaf := resp.TLS.PeerCertificates[0]
+	if len(leaf.ExtKeyUsage) != 2 || leaf.ExtKeyUsage[1] != x509.ExtKeyUsageCodeSigning {
+		t.Error("Expected custom extended key usage, got", leaf.ExtKeyUsage)
+	}
+	if !strings.HasPrefix(leaf.Subject.CommonName, "custom ") {
+		t.Error("Expected custom common name, got", leaf.Subject.CommonName)
+	}
+}
+
+func TestJSONAccessLog(t *testing.T) {
+	proxy := goproxy.New()
+	var out bytes.Buffer
+	accessLog := goproxy.NewJSONAccessLog(&out)
+	accessLog.Fields = []string{"method", "url", "status", "bytes_in", "bytes_out", "mitm", "error"}
+	accessLog.Register(proxy)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Post(srv.URL+"/bobo", "text/plain", strings.NewReader("panda"))
+	fatalOnErr(err, "Post", t)
+	readAll(resp.Body, t)
+	resp.Body.Close()
+
+	expected := `{"method":"POST","url":"` + srv.URL + `/bobo","status":200,"bytes_in":5,"bytes_out":4,"mitm":false,"error":null}` + "\n"
+	if out.String() != expected {
+		t.Errorf("Expected access log %q, got %q", expected, out.String())
+	}
+}
+
+func TestMitmChunkedOrigin(t *testing.T) {
+	chunkedOrigin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "first ")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "second")
+	}))
+	defer chunkedOrigin.Close()
+
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(chunkedOrigin.URL)
+	fatalOnErr(err, "Get", t)
+	if b := string(readAll(resp.Body, t)); b != "first second" {
+		t.Error("Expected chunked origin body to be re-framed once, got", b)
+	}
+	resp, err = client.Head(chunkedOrigin.URL)
+	fatalOnErr(err, "Head", t)
+	if len(resp.TransferEncoding) != 0 {
+		t.Error("Expected no body framing in HEAD response, got", resp.TransferEncoding)
+	}
+}
+
+func TestMitmReadBufferSize(t *testing.T) {
+	bigHeaderOrigin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, len(req.Header.Get("X-Big")))
+	}))
+	defer bigHeaderOrigin.Close()
+
+	proxy := goproxy.New()
+	proxy.ReadBufferSize = 64 << 10
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	// larger than the default 4KiB buffer of bufio
+	big := strings.Repeat("x", 16<<10)
+	req, err := http.NewRequest("GET", bigHeaderOrigin.URL, nil)
+	fatalOnErr(err, "NewRequest", t)
+	req.Header.Set("X-Big", big)
+	resp, err := client.Do(req)
+	fatalOnErr(err, "Do", t)
+	if b := string(readAll(resp.Body, t)); b != fmt.Sprint(len(big)) {
+		t.Errorf("Expected the origin to get a %d bytes header, got %s", len(big), b)
+	}
+}
+
+func TestHTTPMitmUnsupportedTransferEncoding(t *testing.T) {
+	origin, err := net.Listen("tcp", "localhost:0")
+	fatalOnErr(err, "listen", t)
+	defer origin.Close()
+	go func() {
+		c, err := origin.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		http.ReadRequest(bufio.NewReader(c))
+		io.WriteString(c, "HTTP/1.1 200 OK\r\nTransfer-Encoding: bogus\r\n\r\nbody")
+	}()
+
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *goproxy.ConnectAction, string) {
+		return req, goproxy.HTTPMitmConnect, host
+	}))
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	addr := origin.Addr().String()
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	readConnectResponse(buf)
+	io.WriteString(conn, "GET /bobo HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	resp, err := http.ReadResponse(buf, nil)
+	fatalOnErr(err, "ReadResponse", t)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Error("Expected 502 for an unsupported transfer encoding, got", resp.Status)
+	}
+}
+
+func TestEchoHandler(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		req.Header.Set("X-Added", "1")
+		return req, nil
+	})
+	proxy.OnRequest(goproxy.UrlHasPrefix("/__echo")).Do(goproxy.EchoHandler())
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Post(srv.URL+"/__echo", "text/plain", strings.NewReader("panda"))
+	fatalOnErr(err, "Post", t)
+	var echo struct {
+		Method     string
+		Headers    http.Header
+		BodyBase64 string `json:"body_base64"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&echo); err != nil {
+		t.Fatal("Decode echo", err)
+	}
+	resp.Body.Close()
+	body, _ := base64.StdEncoding.DecodeString(echo.BodyBase64)
+	if echo.Method != "POST" || echo.Headers.Get("X-Added") != "1" || string(body) != "panda" {
+		t.Error("Expected echo of the modified request, got", echo, string(body))
+	}
+}
+
+func TestCoalesceRequests(t *testing.T) {
+	var upstream int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&upstream, 1)
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(w, "shared")
+	}))
+	defer slow.Close()
+
+	proxy := goproxy.New()
+	proxy.OnRequest().Do(goproxy.CoalesceRequests())
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(slow.URL + "/resource")
+			if err != nil {
+				t.Error("Get", err)
+				return
+			}
+			if b := string(readAll(resp.Body, t)); b != "shared" {
+				t.Error("Expected shared response, got", b)
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if upstream != 1 {
+		t.Error("Expected a single upstream request, got", upstream)
+	}
+}
+
+func TestThrottleResponse(t *testing.T) {
+	body := strings.Repeat("a", 3000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer origin.Close()
+
+	proxy := goproxy.New()
+	proxy.OnResponse().Do(goproxy.ThrottleResponse(10000))
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	start := time.Now()
+	if r := string(getOrFail(origin.URL, client, t)); r != body {
+		t.Error("Expected full body, got", len(r), "bytes")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Error("Expected 3000 bytes at 10000 bytes/sec to take about 300ms, took", elapsed)
+	}
+}
+
+func TestMitmClientConnectionClose(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	addr := https.Listener.Addr().String()
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	readConnectResponse(buf)
+	tlsConn := tls.Client(conn, acceptAllCerts)
+	tlsBuf := bufio.NewReader(tlsConn)
+
+	io.WriteString(tlsConn, "GET /bobo HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	resp, err := http.ReadResponse(tlsBuf, nil)
+	fatalOnErr(err, "ReadResponse", t)
+	readAll(resp.Body, t)
+	if resp.Close {
+		t.Error("Expected the tunnel to be kept alive")
+	}
+	io.WriteString(tlsConn, "GET /bobo HTTP/1.1\r\nHost: "+addr+"\r\nConnection: close\r\n\r\n")
+	resp, err = http.ReadResponse(tlsBuf, nil)
+	fatalOnErr(err, "ReadResponse", t)
+	readAll(resp.Body, t)
+	if !resp.Close {
+		t.Error("Expected Connection: close in response to a client closing the connection")
+	}
+	if _, err := tlsBuf.ReadByte(); err == nil {
+		t.Error("Expected the tunnel to be closed")
+	}
+}
+
+func TestMitmSessionResumption(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	clientConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	addr := https.Listener.Addr().String()
+	connect := func() bool {
+		conn, err := net.Dial("tcp", l.Listener.Addr().String())
+		fatalOnErr(err, "dial proxy", t)
+		defer conn.Close()
+		io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		readConnectResponse(bufio.NewReader(conn))
+		tlsConn := tls.Client(conn, clientConfig)
+		io.WriteString(tlsConn, "GET /bobo HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		// reading the response also reads the session ticket
+		resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+		fatalOnErr(err, "ReadResponse", t)
+		readAll(resp.Body, t)
+		return tlsConn.ConnectionState().DidResume
+	}
+	if connect() {
+		t.Error("First MITM connection unexpectedly resumed a session")
+	}
+	if !connect() {
+		t.Error("Expected the second MITM connection to resume the TLS session")
+	}
+}
+
+func TestCertStoreSignsOnce(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	var generated int32
+	proxy.OnLeafCertGenerated = func(host string, cert *tls.Certificate) {
+		atomic.AddInt32(&generated, 1)
+	}
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	proxyUrl, _ := url.Parse(l.URL)
+	certs := make([]*x509.Certificate, 5)
+	var wg sync.WaitGroup
+	for i := range certs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// a transport per client, so that each one CONNECTs
+			tr := &http.Transport{TLSClientConfig: acceptAllCerts, Proxy: http.ProxyURL(proxyUrl)}
+			defer tr.CloseIdleConnections()
+			req, _ := http.NewRequest("GET", https.URL+"/bobo", nil)
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Error("RoundTrip", err)
+				return
+			}
+			resp.Body.Close()
+			certs[i] = resp.TLS.PeerCertificates[0]
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&generated); n != 1 {
+		t.Errorf("Expected a single certificate to be signed, got %d", n)
+	}
+	for _, cert := range certs[1:] {
+		if cert != nil && certs[0] != nil && !cert.Equal(certs[0]) {
+			t.Error("Expected all the clients to get the stored certificate")
+		}
+	}
+}
+
+func TestLRUCertStore(t *testing.T) {
+	store := goproxy.NewLRUCertStore(2)
+	a, b, c := tls.Certificate{OCSPStaple: []byte("a")}, tls.Certificate{OCSPStaple: []byte("b")}, tls.Certificate{OCSPStaple: []byte("c")}
+	store.Put("ca", []string{"a.com", "www.a.com"}, a)
+	store.Put("ca", []string{"b.com"}, b)
+	if cert, ok := store.Get("ca", []string{"www.a.com", "a.com"}); !ok || string(cert.OCSPStaple) != "a" {
+		t.Error("Expected the certificate to be found regardless of the hosts order")
+	}
+	store.Put("ca", []string{"c.com"}, c)
+	if _, ok := store.Get("ca", []string{"b.com"}); ok {
+		t.Error("Expected the least recently used certificate to be evicted")
+	}
+	if _, ok := store.Get("ca", []string{"a.com", "www.a.com"}); !ok {
+		t.Error("Expected the recently used certificate to be kept")
+	}
+	if _, ok := store.Get("other ca", []string{"a.com", "www.a.com"}); ok {
+		t.Error("Expected certificates to be stored by CA")
+	}
+}
+
+func TestRewriteCookies(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().Do(goproxy.RewriteRequestCookies(func(cookies []*http.Cookie) []*http.Cookie {
+		kept := cookies[:0]
+		for _, c := range cookies {
+			if c.Name != "_ga" {
+				kept = append(kept, c)
+			}
+		}
+		return kept
+	}))
+	var sent string
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		sent = req.Header.Get("Cookie")
+		resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "")
+		resp.Header.Add("Set-Cookie", "a=1; Path=/; HttpOnly")
+		resp.Header.Add("Set-Cookie", "b=2; Domain=example.com; Priority=High")
+		resp.Header.Add("Set-Cookie", "bad name=3")
+		return req, resp
+	})
+	proxy.OnResponse().Do(goproxy.RewriteResponseCookies(func(cookies []*http.Cookie) []*http.Cookie {
+		for _, c := range cookies {
+			c.Secure = true
+		}
+		return cookies
+	}))
+
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/bobo", nil)
+	req.Header.Set("Cookie", "_ga=GA1.2.3; session=abc; _ga_X=1")
+	resp, err := client.Do(req)
+	fatalOnErr(err, "Do", t)
+	resp.Body.Close()
+	if sent != "session=abc; _ga_X=1" {
+		t.Errorf("Expected the _ga cookie to be stripped, got %q", sent)
+	}
+	expected := "bad name=3|a=1; Path=/; HttpOnly; Secure|b=2; Domain=example.com; Secure; Priority=High"
+	if got := strings.Join(resp.Header["Set-Cookie"], "|"); got != expected {
+		t.Errorf("Expected Set-Cookie %q, got %q", expected, got)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.MaxConnections = 1
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatalOnErr(err, "Listen", t)
+	defer l.Close()
+	go proxy.Serve(l)
+
+	get := "GET " + srv.URL + "/bobo HTTP/1.1\r\nHost: " + srv.Listener.Addr().String() + "\r\n\r\n"
+	first, err := net.Dial("tcp", l.Addr().String())
+	fatalOnErr(err, "Dial", t)
+	io.WriteString(first, get)
+	resp, err := http.ReadResponse(bufio.NewReader(first), nil)
+	fatalOnErr(err, "ReadResponse", t)
+	readAll(resp.Body, t)
+
+	second, err := net.Dial("tcp", l.Addr().String())
+	fatalOnErr(err, "Dial", t)
+	defer second.Close()
+	io.WriteString(second, get)
+	secondBuf := bufio.NewReader(second)
+	second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := secondBuf.Peek(1); err == nil {
+		t.Fatal("Expected the second connection not to be served while the first one is open")
+	}
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err = http.ReadResponse(secondBuf, nil)
+	fatalOnErr(err, "ReadResponse after the first connection closed", t)
+	if string(readAll(resp.Body, t)) != "bobo" {
+		t.Error("Unexpected response to the second connection")
+	}
+}
+
+func TestMaxConnectionsHalfClose(t *testing.T) {
+	// the origin answers once the client is done sending
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	fatalOnErr(err, "Listen origin", t)
+	defer origin.Close()
+	go func() {
+		c, err := origin.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		ioutil.ReadAll(c)
+		io.WriteString(c, "bye")
+	}()
+
+	proxy := goproxy.New()
+	proxy.MaxConnections = 1
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatalOnErr(err, "Listen", t)
+	defer l.Close()
+	go proxy.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatalOnErr(err, "Dial", t)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	addr := origin.Addr().String()
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	buf := bufio.NewReader(conn)
+	readConnectResponse(buf)
+	io.WriteString(conn, "hello")
+	conn.(*net.TCPConn).CloseWrite()
+	if b, _ := ioutil.ReadAll(buf); string(b) != "bye" {
+		t.Errorf("Expected the tunnel to be half closed, and the origin answer, got %q", b)
+	}
+}
+
+func TestHTTPMitmTolerateHTTP09(t *testing.T) {
+	origin, err := net.Listen("tcp", "localhost:0")
+	fatalOnErr(err, "listen", t)
+	defer origin.Close()
+	go func() {
+		c, err := origin.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		http.ReadRequest(bufio.NewReader(c))
+		io.WriteString(c, "<html>legacy</html>")
+	}()
+
+	proxy := goproxy.New()
+	proxy.TolerateHTTP09 = true
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *goproxy.ConnectAction, string) {
+		return req, goproxy.HTTPMitmConnect, host
+	}))
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	addr := origin.Addr().String()
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	readConnectResponse(buf)
+	io.WriteString(conn, "GET /bobo HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	resp, err := http.ReadResponse(buf, nil)
+	fatalOnErr(err, "ReadResponse", t)
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Expected 200 for an HTTP/0.9 response, got", resp.Status)
+	}
+	if body := string(readAll(resp.Body, t)); body != "<html>legacy</html>" {
+		t.Errorf("Expected the raw HTTP/0.9 response as the body, got %q", body)
+	}
+	if !resp.Close {
+		t.Error("Expected the tunnel to be closed after an HTTP/0.9 response")
+	}
+}
+
+func TestMitmDialRetries(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.MitmDialRetries = 2
+	proxy.MitmDialBackoff = time.Millisecond
+	var dials int32
+	dial := proxy.Tr.DialContext
+	proxy.Tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) <= 2 {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("flaky origin")}
+		}
+		return dial(ctx, network, addr)
+	}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected the retried request to succeed, got", r)
+	}
+	if n := atomic.LoadInt32(&dials); n != 3 {
+		t.Errorf("Expected 3 dials, got %d", n)
+	}
+}
+
+func TestHTTPMitmDialFailure(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.MitmDialRetries = 1
+	proxy.MitmDialBackoff = time.Millisecond
+	proxy.ConnectDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("origin down")
+	}
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *goproxy.ConnectAction, string) {
+		return req, goproxy.HTTPMitmConnect, host
+	}))
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	io.WriteString(conn, "CONNECT example.com:80 HTTP/1.1\r\nHost: example.com:80\r\n\r\n")
+	readConnectResponse(buf)
+	io.WriteString(conn, "GET /bobo HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err := http.ReadResponse(buf, nil)
+	fatalOnErr(err, "ReadResponse", t)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Error("Expected 502 when the origin cannot be reached, got", resp.Status)
+	}
+	if body := string(readAll(resp.Body, t)); !strings.Contains(body, "origin down") {
+		t.Errorf("Expected the dial error in the body, got %q", body)
+	}
+}
+
+func TestMitmUpstreamNextProtos(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+
+	for _, tc := range []struct {
+		protos   []string
+		expected string
+	}{
+		{[]string{"h2", "http/1.1"}, "HTTP/2.0"},
+		{[]string{"http/1.1"}, "HTTP/1.1"},
+	} {
+		proxy := goproxy.New()
+		proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+		proxy.MitmUpstreamNextProtos = tc.protos
+		client, l := oneShotProxy(proxy, t)
+
+		resp, err := client.Get(origin.URL + "/")
+		fatalOnErr(err, "Get", t)
+		if proto := string(readAll(resp.Body, t)); proto != tc.expected {
+			t.Errorf("With upstream protocols %v, expected the origin to see %s, got %s", tc.protos, tc.expected, proto)
+		}
+		if resp.ProtoMajor != 1 {
+			t.Error("Expected the client to be served HTTP/1, got", resp.Proto)
+		}
+		l.Close()
+	}
+}
+
+func TestMitmUpstreamNextProtosChange(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, tc := range []struct {
+		protos   []string
+		expected string
+	}{
+		{[]string{"http/1.1"}, "HTTP/1.1"},
+		{[]string{"h2", "http/1.1"}, "HTTP/2.0"},
+		{[]string{"http/1.1"}, "HTTP/1.1"},
+	} {
+		proxy.MitmUpstreamNextProtos = tc.protos
+		if proto := string(getOrFail(origin.URL+"/", client, t)); proto != tc.expected {
+			t.Errorf("After changing the upstream protocols to %v, expected the origin to see %s, got %s", tc.protos, tc.expected, proto)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatalOnErr(err, "Listen", t)
+	served := make(chan error, 1)
+	go func() { served <- proxy.Serve(l) }()
+
+	// an open MITM tunnel, idle after its first request
+	conn, err := net.Dial("tcp", l.Addr().String())
+	fatalOnErr(err, "Dial", t)
+	defer conn.Close()
+	addr := https.Listener.Addr().String()
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	readConnectResponse(bufio.NewReader(conn))
+	tlsConn := tls.Client(conn, acceptAllCerts)
+	tlsBuf := bufio.NewReader(tlsConn)
+	io.WriteString(tlsConn, "GET /bobo HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	resp, err := http.ReadResponse(tlsBuf, nil)
+	fatalOnErr(err, "ReadResponse", t)
+	readAll(resp.Body, t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected Shutdown to wait for the open tunnel until ctx is done, got", err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Error("Expected Serve to return ErrServerClosed, got", err)
+	}
+	tlsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := tlsBuf.ReadByte(); err == nil {
+		t.Error("Expected the tunnel to be closed once ctx is done")
+	}
+	if err := proxy.Shutdown(context.Background()); err != nil {
+		t.Error("Expected Shutdown to return once all tunnels ended, got", err)
+	}
+}
+
+func TestConnectDuringShutdown(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.Shutdown(context.Background())
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "Dial", t)
+	defer conn.Close()
+	addr := https.Listener.Addr().String()
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	fatalOnErr(err, "ReadResponse", t)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Expected 503 for a CONNECT during shutdown, got", resp.Status)
+	}
+}
+
+func TestMITMEvents(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	var mu sync.Mutex
+	var events []string
+	handshakeFailed := make(chan struct{})
+	record := func(event string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			event += " failed"
+		}
+		events = append(events, event)
+	}
+	proxy.MITMEvents = goproxy.MITMEvents{
+		Connect: func(connect *http.Request) { record("connect", nil) },
+		Decision: func(connect *http.Request, host string, action *goproxy.ConnectAction) {
+			if action.Action == goproxy.ConnectMitm {
+				record("mitm", nil)
+			}
+		},
+		ClientHandshake: func(connect *http.Request, host string, err error) {
+			record("handshake", err)
+			if err != nil {
+				close(handshakeFailed)
+			}
+		},
+		OriginDial: func(connect *http.Request, host string, err error) { record("dial", err) },
+		Request:    func(connect *http.Request, req *http.Request, err error) { record("request", err) },
+	}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(https.URL+"/bobo", client, t)
+	// a client not trusting the CA
+	untrusting := &http.Client{Transport: &http.Transport{Proxy: client.Transport.(*http.Transport).Proxy}}
+	if _, err := untrusting.Get(https.URL + "/bobo"); err == nil {
+		t.Error("Expected the untrusting client to fail")
+	}
+	<-handshakeFailed
+	mu.Lock()
+	defer mu.Unlock()
+	expected := "connect,mitm,handshake,request,dial,connect,mitm,handshake failed"
+	if got := strings.Join(events, ","); got != expected {
+		t.Errorf("Expected events %s, got %s", expected, got)
+	}
+}
+
+func TestMITMEventsTunnelDone(t *testing.T) {
+	// an origin reading a 5 bytes ping, and answering with a 7 bytes pong
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	fatalOnErr(err, "Listen", t)
+	defer origin.Close()
+	go func() {
+		for {
+			conn, err := origin.Accept()
+			if err != nil {
+				return
+			}
+			io.ReadFull(conn, make([]byte, 5))
+			io.WriteString(conn, "pong!!!")
+			conn.Close()
+		}
+	}()
+
+	for _, bytesPerSec := range []int{0, 1 << 20} {
+		proxy := goproxy.New()
+		proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *goproxy.ConnectAction, string) {
+			return req, &goproxy.ConnectAction{Action: goproxy.ConnectAccept, BytesPerSec: bytesPerSec}, host
+		}))
+		type stats struct {
+			host           string
+			sent, received int64
+		}
+		done := make(chan stats, 1)
+		proxy.MITMEvents.TunnelDone = func(connect *http.Request, host string, sent, received int64) {
+			done <- stats{host, sent, received}
+		}
+		_, l := oneShotProxy(proxy, t)
+
+		conn, err := net.Dial("tcp", l.Listener.Addr().String())
+		fatalOnErr(err, "Dial", t)
+		addr := origin.Addr().String()
+		io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		buf := bufio.NewReader(conn)
+		readConnectResponse(buf)
+		io.WriteString(conn, "ping!")
+		pong := make([]byte, 7)
+		io.ReadFull(buf, pong)
+		if string(pong) != "pong!!!" {
+			t.Errorf("With %d bytes/s, expected the pong of the origin, got %q", bytesPerSec, pong)
+		}
+		conn.Close()
+		select {
+		case got := <-done:
+			if expected := (stats{addr, 5, 7}); got != expected {
+				t.Errorf("With %d bytes/s, expected tunnel stats %+v, got %+v", bytesPerSec, expected, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("With %d bytes/s, expected TunnelDone to be called", bytesPerSec)
+		}
+		l.Close()
+	}
+}
+
+// countingHTTPMitmProxy returns a proxy eavesdropping CONNECT requests as plain HTTP, with a pool
+// of origin connections if pooled, and the count of its dials to origin servers.
+func countingHTTPMitmProxy(pooled bool) (*goproxy.ProxyHttpServer, *int32) {
+	proxy := goproxy.New()
+	if pooled {
+		proxy.ConnectPool = goproxy.NewConnPool(4, time.Minute)
+	}
+	var dials int32
+	proxy.ConnectDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.Dial(network, addr)
+	}
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *goproxy.ConnectAction, string) {
+		return req, goproxy.HTTPMitmConnect, host
+	}))
+	return proxy, &dials
+}
+
+// httpMitmGet sends a GET for /bobo to origin, in a CONNECT tunnel of the proxy at proxyAddr,
+// and waits for the tunnel to be closed.
+func httpMitmGet(proxyAddr, origin string) (string, error) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	io.WriteString(conn, "CONNECT "+origin+" HTTP/1.1\r\nHost: "+origin+"\r\n\r\n")
+	readConnectResponse(buf)
+	io.WriteString(conn, "GET /bobo HTTP/1.1\r\nHost: "+origin+"\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(buf, nil)
+	if err != nil {
+		return "", err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	_, err = buf.ReadByte()
+	if err != io.EOF {
+		return "", fmt.Errorf("expected the tunnel to be closed, got %v", err)
+	}
+	return string(body), nil
+}
+
+func TestConnectPool(t *testing.T) {
+	proxy, dials := countingHTTPMitmProxy(true)
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		body, err := httpMitmGet(l.Listener.Addr().String(), srv.Listener.Addr().String())
+		fatalOnErr(err, "httpMitmGet", t)
+		if body != "bobo" {
+			t.Error("Unexpected response", body)
+		}
+	}
+	if n := atomic.LoadInt32(dials); n != 1 {
+		t.Errorf("Expected the origin connection to be reused by later tunnels, got %d dials", n)
+	}
+}
+
+func benchmarkHTTPMitm(b *testing.B, pooled bool) {
+	proxy, dials := countingHTTPMitmProxy(pooled)
+	_, l := oneShotProxy(proxy, nil)
+	defer l.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := httpMitmGet(l.Listener.Addr().String(), srv.Listener.Addr().String()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt32(dials))/float64(b.N), "dials/op")
+}
+
+func BenchmarkHTTPMitm(b *testing.B)            { benchmarkHTTPMitm(b, false) }
+func BenchmarkHTTPMitmConnectPool(b *testing.B) { benchmarkHTTPMitm(b, true) }
+
+// webSocketFrame returns a final text frame with payload, masked with mask if not nil
+func webSocketFrame(payload string, mask []byte) []byte {
+	frame := []byte{0x81, byte(len(payload))}
+	p := []byte(payload)
+	if mask != nil {
+		frame[1] |= 0x80
+		frame = append(frame, mask...)
+		for i := range p {
+			p[i] ^= mask[i%4]
+		}
+	}
+	return append(frame, p...)
+}
+
+func TestMitmWebSocket(t *testing.T) {
+	// an origin answering every frame with an unmasked frame with the same payload
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "expected upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		header := make([]byte, 6)
+		if _, err := io.ReadFull(buf, header); err != nil {
+			return
+		}
+		payload := make([]byte, header[1]&0x7f)
+		io.ReadFull(buf, payload)
+		for i := range payload {
+			payload[i] ^= header[2+i%4]
+		}
+		conn.Write(webSocketFrame(string(payload), nil))
+	}))
+	defer origin.Close()
+
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	var mu sync.Mutex
+	var frames []string
+	proxy.OnWebSocket().DoFunc(func(req *http.Request, frame *goproxy.WebSocketFrame) {
+		mu.Lock()
+		defer mu.Unlock()
+		frames = append(frames, fmt.Sprintf("%v:%s", frame.FromClient, frame.Payload))
+		// changing the payload must not change the forwarded frames
+		for i := range frame.Payload {
+			frame.Payload[i] = 'x'
+		}
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	addr := origin.Listener.Addr().String()
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	readConnectResponse(bufio.NewReader(conn))
+	tlsConn := tls.Client(conn, acceptAllCerts)
+	tlsBuf := bufio.NewReader(tlsConn)
+	io.WriteString(tlsConn, "GET /chat HTTP/1.1\r\nHost: "+addr+"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	resp, err := http.ReadResponse(tlsBuf, nil)
+	fatalOnErr(err, "ReadResponse", t)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("Expected 101 Switching Protocols, got", resp.Status)
+	}
+	tlsConn.Write(webSocketFrame("hello", []byte{1, 2, 3, 4}))
+	echo := make([]byte, 7)
+	_, err = io.ReadFull(tlsBuf, echo)
+	fatalOnErr(err, "read echo frame", t)
+	if !bytes.Equal(echo, webSocketFrame("hello", nil)) {
+		t.Errorf("Expected the echo frame to be passed through, got %q", echo)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(frames, ","); got != "true:hello,false:hello" {
+		t.Error("Expected the handler to see both frames unmasked, got", got)
+	}
+}
+
+func TestEarlyHints(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		if err := goproxy.CtxWriteEarlyHints(req.Context(), http.Header{"Link": {"</style.css>; rel=preload; as=style"}}); err != nil {
+			t.Error("CtxWriteEarlyHints", err)
+		}
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, u := range []string{srv.URL + "/bobo", https.URL + "/bobo"} {
+		var hints []string
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					hints = append(hints, header.Get("Link"))
+				}
+				return nil
+			},
+		}
+		req, _ := http.NewRequest("GET", u, nil)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		resp, err := client.Do(req)
+		fatalOnErr(err, "Do", t)
+		if body := string(readAll(resp.Body, t)); body != "bobo" {
+			t.Error("Unexpected final response", body)
+		}
+		if len(hints) != 1 || hints[0] != "</style.css>; rel=preload; as=style" {
+			t.Errorf("Expected an early hint ahead of the response to %s, got %q", u, hints)
+		}
+		if resp.Header.Get("Link") != "" {
+			t.Error("Expected the final response not to have the hinted headers")
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bobo" {
+			io.WriteString(w, "bobo")
+			return
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	origin := httptest.NewServer(slow)
+	defer origin.Close()
+	tlsOrigin := httptest.NewTLSServer(slow)
+	defer tlsOrigin.Close()
+	defer close(release)
+
+	proxy := goproxy.New()
+	proxy.RequestTimeout = 100 * time.Millisecond
+	proxy.OnRequest(goproxy.ReqHostIs(tlsOrigin.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.ReqHostIs(origin.Listener.Addr().String())).HandleConnect(goproxy.FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *goproxy.ConnectAction, string) {
+		return req, goproxy.HTTPMitmConnect, host
+	}))
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, u := range []string{origin.URL, tlsOrigin.URL} {
+		if body := string(getOrFail(u+"/bobo", client, t)); body != "bobo" {
+			t.Errorf("Expected fast requests to %s to succeed, got %q", u, body)
+		}
+		resp, err := client.Get(u + "/slow")
+		fatalOnErr(err, "Get "+u, t)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("Expected 504 for a slow request to %s, got %s", u, resp.Status)
+		}
+	}
+
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	host := origin.Listener.Addr().String()
+	io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	readConnectResponse(buf)
+	io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	resp, err := http.ReadResponse(buf, nil)
+	fatalOnErr(err, "ReadResponse", t)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Error("Expected 504 for a slow request in an HTTP MITM tunnel, got", resp.Status)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	proxy := goproxy.New()
+	auth := goproxy.BasicAuth("my proxy", goproxy.BasicAuthCredentials("user", "secret"))
+	proxy.OnRequest().Do(auth)
+	proxy.OnRequest().HandleConnect(auth)
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, tc := range []struct {
+		userinfo *url.Userinfo
+		ok       bool
+	}{
+		{nil, false},
+		{url.UserPassword("user", "wrong"), false},
+		{url.UserPassword("user", "secret"), true},
+	} {
+		proxyURL, _ := url.Parse(l.URL)
+		proxyURL.User = tc.userinfo
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: acceptAllCerts, Proxy: http.ProxyURL(proxyURL)}}
+
+		resp, err := client.Get(srv.URL + "/bobo")
+		fatalOnErr(err, "Get", t)
+		body := string(readAll(resp.Body, t))
+		if tc.ok && body != "bobo" {
+			t.Errorf("Expected %v to be let through, got %s %q", tc.userinfo, resp.Status, body)
+		}
+		if !tc.ok {
+			if resp.StatusCode != http.StatusProxyAuthRequired {
+				t.Errorf("Expected 407 for %v, got %s", tc.userinfo, resp.Status)
+			}
+			if h := resp.Header.Get("Proxy-Authenticate"); h != `Basic realm="my proxy"` {
+				t.Errorf("Unexpected Proxy-Authenticate header %q", h)
+			}
+		}
+
+		resp, err = client.Get(https.URL + "/bobo")
+		if tc.ok {
+			fatalOnErr(err, "Get through CONNECT", t)
+			if body := string(readAll(resp.Body, t)); body != "bobo" {
+				t.Errorf("Expected %v to be let through CONNECT, got %s %q", tc.userinfo, resp.Status, body)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), "Proxy Authentication Required") {
+			t.Errorf("Expected CONNECT with %v to be rejected with 407, got %v", tc.userinfo, err)
+		}
+	}
+}
+
+func TestOnHandlerTiming(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		return req, nil
+	})
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		time.Sleep(20 * time.Millisecond)
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		time.Sleep(20 * time.Millisecond)
+		return req, resp
+	})
+	var mu sync.Mutex
+	timings := map[string]time.Duration{}
+	proxy.OnHandlerTiming = func(req *http.Request, response bool, index int, elapsed time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		timings[fmt.Sprint(response, index)] = elapsed
+	}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if body := string(getOrFail(srv.URL+"/bobo", client, t)); body != "bobo" {
+		t.Fatal("Unexpected body", body)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(timings) != 3 {
+		t.Fatal("Expected every handler to be timed, got", timings)
+	}
+	if timings["false 1"] < 20*time.Millisecond || timings["true 0"] < 20*time.Millisecond {
+		t.Error("Expected the slow handlers to take their time, got", timings)
+	}
+	if timings["false 0"] >= 20*time.Millisecond {
+		t.Error("Expected the fast handler to be fast, got", timings)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().Do(goproxy.RateLimitBy(0.1, 2, func(req *http.Request) string {
+		return req.Header.Get("X-User")
+	}))
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	proxyURL, _ := url.Parse(l.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	get := func(user string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+"/bobo", nil)
+		req.Header.Set("X-User", user)
+		resp, err := client.Do(req)
+		fatalOnErr(err, "Do", t)
+		readAll(resp.Body, t)
+		return resp
+	}
+	for i := 0; i < 2; i++ {
+		if resp := get("alice"); resp.StatusCode != http.StatusOK {
+			t.Fatal("Expected the burst to be allowed, got", resp.Status)
+		}
+	}
+	resp := get("alice")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatal("Expected 429 once the burst is used, got", resp.Status)
+	}
+	if retry := resp.Header.Get("Retry-After"); retry != "10" {
+		t.Error("Expected to be told to retry in 10 seconds, got", retry)
+	}
+	if resp := get("bob"); resp.StatusCode != http.StatusOK {
+		t.Error("Expected other keys not to be limited, got", resp.Status)
+	}
+}
+
+type headerRoundTripper struct {
+	rt    http.RoundTripper
+	calls int32
+}
+
+func (h *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&h.calls, 1)
+	resp, err := h.rt.RoundTrip(req)
+	if err == nil {
+		resp.Header.Set("X-Wrapped", "yes")
+	}
+	return resp, err
+}
+
+func TestSetRoundTripper(t *testing.T) {
+	proxy := goproxy.New()
+	wrapped := &headerRoundTripper{rt: proxy.Tr}
+	proxy.SetRoundTripper(wrapped)
+	proxy.OnRequest(goproxy.ReqHostIs(https.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, u := range []string{srv.URL, https.URL} {
+		resp, err := client.Get(u + "/bobo")
+		fatalOnErr(err, "Get "+u, t)
+		if body := string(readAll(resp.Body, t)); body != "bobo" {
+			t.Errorf("Unexpected body from %s: %q", u, body)
+		}
+		if resp.Header.Get("X-Wrapped") != "yes" {
+			t.Error("Expected the request to be sent with the RoundTripper set, for", u)
+		}
+	}
+	if calls := atomic.LoadInt32(&wrapped.calls); calls != 2 {
+		t.Error("Expected 2 requests through the RoundTripper, got", calls)
+	}
+
+	// restoring Tr while serving requests
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.SetRoundTripper(nil)
+	}()
+	getOrFail(srv.URL+"/bobo", client, t)
+	<-done
+	resp, err := client.Get(srv.URL + "/bobo")
+	fatalOnErr(err, "Get", t)
+	resp.Body.Close()
+	if resp.Header.Get("X-Wrapped") != "" {
+		t.Error("Expected the request to be sent with Tr once the RoundTripper is unset")
+	}
+}
+
+func TestCloseIdleConnections(t *testing.T) {
+	closed := make(chan struct{}, 10)
+	origin := httptest.NewUnstartedServer(ConstantHanlder("bobo"))
+	origin.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	for _, tc := range []struct {
+		name  string
+		setup func(proxy *goproxy.ProxyHttpServer)
+		close func(proxy *goproxy.ProxyHttpServer)
+	}{
+		{"CloseIdleConnections", func(*goproxy.ProxyHttpServer) {}, (*goproxy.ProxyHttpServer).CloseIdleConnections},
+		{"IdleConnTimeout", func(proxy *goproxy.ProxyHttpServer) { proxy.IdleConnTimeout = 50 * time.Millisecond }, func(*goproxy.ProxyHttpServer) {}},
+	} {
+		proxy := goproxy.New()
+		tc.setup(proxy)
+		client, l := oneShotProxy(proxy, t)
+		if body := string(getOrFail(origin.URL+"/", client, t)); body != "bobo" {
+			t.Errorf("%s: unexpected body %q", tc.name, body)
+		}
+		select {
+		case <-closed:
+			t.Fatalf("%s: expected the upstream connection to be pooled", tc.name)
+		case <-time.After(10 * time.Millisecond):
+		}
+		tc.close(proxy)
+		select {
+		case <-closed:
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s: expected the pooled upstream connection to be closed", tc.name)
+		}
+		l.Close()
+	}
+}
+
+func TestIdleConnTimeout(t *testing.T) {
+	closed := make(chan struct{}, 10)
+	origin := httptest.NewUnstartedServer(ConstantHanlder("bobo"))
+	origin.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	proxy := goproxy.New()
+	tr := proxy.Tr
+	proxy.IdleConnTimeout = time.Hour
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(origin.URL+"/", client, t)
+	// changing the timeout while serving closes the connections pooled with the previous one
+	proxy.IdleConnTimeout = 50 * time.Millisecond
+	getOrFail(origin.URL+"/", client, t)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-closed:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected the connections pooled with both timeouts to be closed, got", i)
+		}
+	}
+	if proxy.Tr != tr || tr.IdleConnTimeout != 0 {
+		t.Error("Expected Tr not to be modified, got IdleConnTimeout", tr.IdleConnTimeout)
+	}
+}
+
+type recordingMetrics struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (m *recordingMetrics) record(event string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, event)
+}
+
+func (m *recordingMetrics) ObserveRequest(req *http.Request) {
+	m.record("request " + req.URL.Path)
+}
+
+func (m *recordingMetrics) ObserveResponse(req *http.Request, resp *http.Response, latency time.Duration) {
+	m.record("response " + req.URL.Path + " " + fmt.Sprint(resp.StatusCode))
+}
+
+func (m *recordingMetrics) ObserveError(req *http.Request, err error) {
+	m.record("error " + req.URL.Path)
+}
+
+func (m *recordingMetrics) ObserveConnect(host string, action *goproxy.ConnectAction) {
+	m.record("connect " + fmt.Sprint(action.Action))
+}
+
+func TestMetrics(t *testing.T) {
+	proxy := goproxy.New()
+	metrics := &recordingMetrics{}
+	proxy.Metrics = metrics
+	proxy.OnRequest(goproxy.ReqHostIs(https.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(srv.URL+"/bobo", client, t)
+	getOrFail(https.URL+"/bobo", client, t)
+	resp, err := client.Get("http://localhost:1/unreachable")
+	fatalOnErr(err, "Get unreachable", t)
+	resp.Body.Close()
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	expected := []string{
+		"request /bobo", "response /bobo 200",
+		"connect " + fmt.Sprint(goproxy.ConnectMitm), "request /bobo", "response /bobo 200",
+		"request /unreachable", "error /unreachable",
+	}
+	if fmt.Sprint(metrics.events) != fmt.Sprint(expected) {
+		t.Errorf("Expected metrics %q, got %q", expected, metrics.events)
+	}
+}
+
+func TestMetricsResponseWriteError(t *testing.T) {
+	proxy := goproxy.New()
+	metrics := &recordingMetrics{}
+	proxy.Metrics = metrics
+	proxy.WriteResponseFunc = func(w http.ResponseWriter, r *http.Request, resp *http.Response) error {
+		http.Error(w, "write failed", http.StatusBadGateway)
+		return errors.New("write failed")
+	}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	fatalOnErr(err, "Get", t)
+	resp.Body.Close()
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	expected := []string{"request /bobo", "error /bobo"}
+	if fmt.Sprint(metrics.events) != fmt.Sprint(expected) {
+		t.Errorf("Expected metrics %q, got %q", expected, metrics.events)
+	}
+}
+
+// flakyRoundTripper fails the first failures requests with err, then sends them with rt
+type flakyRoundTripper struct {
+	rt       http.RoundTripper
+	failures int32
+	err      error
+	// wrote, if true, reports the request headers as written before failing
+	wrote    bool
+	attempts int32
+	bodies   []string
+}
+
+func (f *flakyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempt := atomic.AddInt32(&f.attempts, 1)
+	if req.Body != nil {
+		b, _ := ioutil.ReadAll(req.Body)
+		f.bodies = append(f.bodies, string(b))
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	}
+	if attempt <= f.failures {
+		if trace := httptrace.ContextClientTrace(req.Context()); f.wrote && trace != nil && trace.WroteHeaderField != nil {
+			trace.WroteHeaderField("Host", []string{req.Host})
+		}
+		return nil, f.err
+	}
+	return f.rt.RoundTrip(req)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	for _, tc := range []struct {
+		name     string
+		method   string
+		body     string
+		err      error
+		wrote    bool
+		attempts int32
+		status   int
+	}{
+		{"GET", "GET", "", dialErr, false, 3, http.StatusOK},
+		{"PUT with body", "PUT", "panda", dialErr, false, 3, http.StatusOK},
+		{"POST", "POST", "panda", dialErr, false, 1, http.StatusInternalServerError},
+		{"partially written", "GET", "", dialErr, true, 1, http.StatusInternalServerError},
+		{"not retryable", "GET", "", errors.New("bad response"), false, 1, http.StatusInternalServerError},
+	} {
+		proxy := goproxy.New()
+		flaky := &flakyRoundTripper{rt: proxy.Tr, failures: 2, err: tc.err, wrote: tc.wrote}
+		proxy.SetRoundTripper(flaky)
+		var backoffs []int
+		proxy.RetryPolicy = &goproxy.RetryPolicy{MaxRetries: 3, Backoff: func(attempt int) time.Duration {
+			backoffs = append(backoffs, attempt)
+			return time.Millisecond
+		}}
+		client, l := oneShotProxy(proxy, t)
+
+		req, _ := http.NewRequest(tc.method, srv.URL+"/bobo", strings.NewReader(tc.body))
+		resp, err := client.Do(req)
+		fatalOnErr(err, tc.name, t)
+		readAll(resp.Body, t)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: expected %d, got %s", tc.name, tc.status, resp.Status)
+		}
+		if flaky.attempts != tc.attempts {
+			t.Errorf("%s: expected %d attempts, got %d", tc.name, tc.attempts, flaky.attempts)
+		}
+		if tc.attempts == 3 && fmt.Sprint(backoffs) != "[1 2]" {
+			t.Errorf("%s: expected backoffs of retries 1 and 2, got %v", tc.name, backoffs)
+		}
+		for _, b := range flaky.bodies {
+			if b != tc.body {
+				t.Errorf("%s: expected every attempt to send the body %q, got %q", tc.name, tc.body, b)
+			}
+		}
+		l.Close()
+	}
+}
+
+// serveSocks5 runs a minimal SOCKS5 proxy on l, requiring user and pass if user is not empty,
+// and records the addresses it is asked to connect to.
+func serveSocks5(l net.Listener, user, pass string, addrs chan<- string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			buf := make([]byte, 512)
+			io.ReadFull(c, buf[:2])
+			io.ReadFull(c, buf[:buf[1]])
+			if user == "" {
+				c.Write([]byte{5, 0})
+			} else {
+				c.Write([]byte{5, 2})
+				io.ReadFull(c, buf[:2])
+				u := make([]byte, buf[1])
+				io.ReadFull(c, u)
+				io.ReadFull(c, buf[:1])
+				p := make([]byte, buf[0])
+				io.ReadFull(c, p)
+				if string(u) != user || string(p) != pass {
+					c.Write([]byte{1, 1})
+					return
+				}
+				c.Write([]byte{1, 0})
+			}
+			io.ReadFull(c, buf[:4])
+			var host string
+			switch buf[3] {
+			case 1:
+				io.ReadFull(c, buf[:4])
+				host = net.IP(buf[:4]).String()
+			case 3:
+				io.ReadFull(c, buf[:1])
+				name := make([]byte, buf[0])
+				io.ReadFull(c, name)
+				host = string(name)
+			}
+			io.ReadFull(c, buf[:2])
+			addr := net.JoinHostPort(host, fmt.Sprint(int(buf[0])<<8|int(buf[1])))
+			addrs <- addr
+			target, err := net.Dial("tcp", addr)
+			if err != nil {
+				c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			defer target.Close()
+			c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+			go io.Copy(target, c)
+			io.Copy(c, target)
+		}()
+	}
+}
+
+func TestConnectDialToSocks5(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatalOnErr(err, "Listen", t)
+	defer l.Close()
+	addrs := make(chan string, 10)
+	go serveSocks5(l, "user", "secret", addrs)
+	srvURL, _ := url.Parse(srv.URL)
+
+	for _, tc := range []struct {
+		userinfo string
+		ok       bool
+	}{
+		{"user:secret@", true},
+		{"user:wrong@", false},
+		{"", false},
+	} {
+		proxy := goproxy.New()
+		dial := proxy.NewConnectDialToProxy("socks5://" + tc.userinfo + l.Addr().String())
+		if dial == nil {
+			t.Fatal("Expected socks5 upstream proxies to be supported")
+		}
+		c, err := dial(context.Background(), "tcp", srvURL.Host)
+		if !tc.ok {
+			if err == nil {
+				c.Close()
+				t.Errorf("Expected the dial with %q to fail", tc.userinfo)
+			}
+			continue
+		}
+		fatalOnErr(err, "dial through SOCKS5", t)
+		if addr := <-addrs; addr != srvURL.Host {
+			t.Errorf("Expected the SOCKS5 proxy to connect to %s, got %s", srvURL.Host, addr)
+		}
+		io.WriteString(c, "GET /bobo HTTP/1.1\r\nHost: "+srvURL.Host+"\r\nConnection: close\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		fatalOnErr(err, "ReadResponse", t)
+		if body := string(readAll(resp.Body, t)); body != "bobo" {
+			t.Errorf("Unexpected body through SOCKS5: %q", body)
+		}
+		c.Close()
+	}
+}
+
+func TestHTTP10Connect(t *testing.T) {
+	// the origin streams its response, which HTTP/1.1 clients get chunked
+	streaming := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "bo")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "bo")
+	})
+	origin := httptest.NewServer(streaming)
+	defer origin.Close()
+	tlsOrigin := httptest.NewTLSServer(streaming)
+	defer tlsOrigin.Close()
+
+	proxy := goproxy.New()
+	proxy.OnRequest(goproxy.ReqHostIs(tlsOrigin.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.ReqHostIs(origin.Listener.Addr().String())).HandleConnect(goproxy.FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *goproxy.ConnectAction, string) {
+		return req, goproxy.HTTPMitmConnect, host
+	}))
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, tc := range []struct {
+		addr string
+		tls  bool
+	}{
+		{origin.Listener.Addr().String(), false},
+		{tlsOrigin.Listener.Addr().String(), true},
+	} {
+		conn, err := net.Dial("tcp", l.Listener.Addr().String())
+		fatalOnErr(err, "dial proxy", t)
+		// fail instead of hanging if the tunnel is kept open
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := bufio.NewReader(conn)
+		io.WriteString(conn, "CONNECT "+tc.addr+" HTTP/1.0\r\n\r\n")
+		readConnectResponse(buf)
+		var tunnel io.ReadWriter = struct {
+			io.Reader
+			io.Writer
+		}{buf, conn}
+		if tc.tls {
+			tunnel = tls.Client(conn, acceptAllCerts)
+		}
+		io.WriteString(tunnel, "GET /bobo HTTP/1.0\r\nHost: "+tc.addr+"\r\nConnection: keep-alive\r\n\r\n")
+		raw, err := ioutil.ReadAll(tunnel)
+		conn.Close()
+		if err != nil && !tc.tls {
+			t.Fatal("Expected the tunnel to be closed after the response, got", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+		fatalOnErr(err, "ReadResponse", t)
+		if resp.Proto != "HTTP/1.0" || len(resp.TransferEncoding) != 0 {
+			t.Errorf("Expected an HTTP/1.0 response without chunked encoding, tls %v, got %q", tc.tls, raw)
+		}
+		if body := string(readAll(resp.Body, t)); body != "bobo" {
+			t.Errorf("Unexpected body, tls %v: %q", tc.tls, body)
+		}
+	}
+}
+
+func TestConnectDialFromPAC(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	fatalOnErr(err, "Listen", t)
+	defer l.Close()
+	addrs := make(chan string, 10)
+	go serveSocks5(l, "", "", addrs)
+	srvURL, _ := url.Parse(srv.URL)
+	// nothing listens on the first proxy
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	fatalOnErr(err, "Listen", t)
+	closed.Close()
+
+	proxy := goproxy.New()
+	var urls []string
+	dial := proxy.NewConnectDialFromPAC(func(u, host string) (string, error) {
+		urls = append(urls, u+" "+host)
+		if host == "localhost" {
+			return "", errors.New("ReferenceError")
+		}
+		return "PROXY " + closed.Addr().String() + "; SOCKS " + l.Addr().String() + "; DIRECT", nil
+	})
+	c, err := dial(context.Background(), "tcp", srvURL.Host)
+	fatalOnErr(err, "dial with PAC", t)
+	c.Close()
+	if addr := <-addrs; addr != srvURL.Host {
+		t.Errorf("Expected to fall back to the SOCKS proxy, which connected to %s", addr)
+	}
+	if expected := "https://" + srvURL.Host + "/ " + srvURL.Hostname(); urls[0] != expected {
+		t.Errorf("Expected FindProxyForURL to be called with %q, got %q", expected, urls[0])
+	}
+
+	// DIRECT when the PAC file fails, nothing listens on the closed port
+	_, port, _ := net.SplitHostPort(closed.Addr().String())
+	if _, err := dial(context.Background(), "tcp", "localhost:"+port); err == nil || strings.Contains(err.Error(), "socks") {
+		t.Error("Expected a failed PAC evaluation to dial directly, got", err)
+	}
+	select {
+	case addr := <-addrs:
+		t.Error("Expected no SOCKS connection, got one to", addr)
+	default:
+	}
+
+	proxyFunc := proxy.PACProxyFunc(func(u, host string) (string, error) {
+		return "SOCKS5 socks.example.com:1080; DIRECT", nil
+	})
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	if u, err := proxyFunc(req); err != nil || u.String() != "socks5://socks.example.com:1080" {
+		t.Error("Expected the first proxy of the PAC result, got", u, err)
+	}
+}
+
+func TestMitmCertificateForSNI(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	addr := https.Listener.Addr().String()
+	for _, serverName := range []string{"sni.example.com", ""} {
+		conn, err := net.Dial("tcp", l.Listener.Addr().String())
+		fatalOnErr(err, "dial proxy", t)
+		buf := bufio.NewReader(conn)
+		io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		readConnectResponse(buf)
+		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: serverName})
+		fatalOnErr(tlsConn.Handshake(), "Handshake", t)
+		leaf := tlsConn.ConnectionState().PeerCertificates[0]
+		if serverName != "" {
+			fatalOnErr(leaf.VerifyHostname(serverName), "certificate for the SNI", t)
+		} else {
+			// without SNI, the certificate is for the CONNECT host
+			fatalOnErr(leaf.VerifyHostname("127.0.0.1"), "certificate for the CONNECT host", t)
+		}
+		conn.Close()
+	}
+}
+
+func TestProxyCA(t *testing.T) {
+	otherCA, err := goproxy.NewCA(goproxy.KeyTypeECDSA)
+	fatalOnErr(err, "NewCA", t)
+	var signed int32
+	for _, tc := range []struct {
+		ca       *tls.Certificate
+		signHost bool
+	}{
+		{&goproxy.GoproxyCa, false},
+		{&otherCA, false},
+		{&otherCA, true},
+	} {
+		proxy := goproxy.New()
+		proxy.CA = tc.ca
+		if tc.signHost {
+			proxy.SignHost = func(ca tls.Certificate, hosts []string) (tls.Certificate, error) {
+				atomic.AddInt32(&signed, 1)
+				return *tc.ca, nil
+			}
+		}
+		proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+		_, l := oneShotProxy(proxy, t)
+
+		addr := https.Listener.Addr().String()
+		conn, err := net.Dial("tcp", l.Listener.Addr().String())
+		fatalOnErr(err, "dial proxy", t)
+		buf := bufio.NewReader(conn)
+		io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		readConnectResponse(buf)
+		tlsConn := tls.Client(conn, acceptAllCerts)
+		fatalOnErr(tlsConn.Handshake(), "Handshake", t)
+		leaf := tlsConn.ConnectionState().PeerCertificates[0]
+		if tc.signHost {
+			if !bytes.Equal(leaf.Raw, tc.ca.Certificate[0]) {
+				t.Error("Expected the certificate of SignHost")
+			}
+		} else if err := leaf.CheckSignatureFrom(tc.ca.Leaf); err != nil {
+			t.Error("Expected the certificate to be signed by the CA of the proxy:", err)
+		}
+		conn.Close()
+		l.Close()
+	}
+	if signed != 1 {
+		t.Error("Expected SignHost to be called once, got", signed)
+	}
+}
+
+func TestRejectWeakCipherSuites(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().Do(goproxy.RejectWeakCipherSuites)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	tr := client.Transport.(*http.Transport)
+	// a new tunnel for every request, negotiating the suites of its case
+	tr.DisableKeepAlives = true
+
+	for _, tc := range []struct {
+		suites []uint16
+		status int
+	}{
+		{[]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}, http.StatusForbidden},
+		{[]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, http.StatusOK},
+	} {
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12, CipherSuites: tc.suites}
+		resp, err := client.Get(https.URL + "/bobo")
+		fatalOnErr(err, "client.Get", t)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("Expected status %d for suites %v, got %d", tc.status, tc.suites, resp.StatusCode)
+		}
+	}
+}
+
+func TestDialRouter(t *testing.T) {
+	var routed, fallback int32
+	countingDial := func(n *int32) func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(n, 1)
+			return net.Dial(network, addr)
+		}
+	}
+	proxy := goproxy.New()
+	proxy.ConnectDial = countingDial(&fallback)
+	proxy.DialRouter = []goproxy.DialRoute{
+		{Cond: goproxy.ReqHostIs("example.internal:443")},
+		{Cond: goproxy.ReqHostIs(https.Listener.Addr().String()), Dial: countingDial(&routed)},
+	}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if resp := string(getOrFail(https.URL+"/bobo", client, t)); resp != "bobo" {
+		t.Error("Expected bobo, got", resp)
+	}
+	if routed != 1 || fallback != 0 {
+		t.Errorf("Expected the matching route to dial once, got %d routed and %d fallback dials", routed, fallback)
+	}
+
+	proxy.DialRouter = proxy.DialRouter[:1]
+	client.Transport.(*http.Transport).CloseIdleConnections()
+	getOrFail(https.URL+"/bobo", client, t)
+	if fallback != 1 {
+		t.Error("Expected ConnectDial to be used when no route matches, got", fallback)
+	}
+}
+
+func TestSetHealthCheck(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		t.Error("Expected the health check not to run handlers")
+		return req, nil
+	})
+	proxy.SetHealthCheck("/healthz", http.StatusOK, "ok")
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/healthz")
+	fatalOnErr(err, "health check", t)
+	if body := string(readAll(resp.Body, t)); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("Expected 200 ok, got %d %q", resp.StatusCode, body)
+	}
+	resp, err = http.Get(s.URL + "/other")
+	fatalOnErr(err, "non-proxy request", t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Error("Expected other paths to be served by the previous NonproxyHandler, got", resp.StatusCode)
+	}
+}
+
+func TestNewJSONAndRedirectResponse(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest(goproxy.UrlHasPrefix("/json")).DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		return req, goproxy.NewJSONResponse(req, http.StatusForbidden, map[string]string{"error": "blocked"})
+	})
+	proxy.OnRequest(goproxy.UrlHasPrefix("/badjson")).DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		return req, goproxy.NewJSONResponse(req, http.StatusOK, func() {})
+	})
+	proxy.OnRequest(goproxy.UrlHasPrefix("/redirect")).DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		return req, goproxy.NewRedirectResponse(req, http.StatusFound, "http://example.com/")
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := client.Get(srv.URL + "/json")
+	fatalOnErr(err, "client.Get json", t)
+	var v map[string]string
+	fatalOnErr(json.NewDecoder(resp.Body).Decode(&v), "decode json", t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || v["error"] != "blocked" {
+		t.Errorf("Expected 403 with the JSON body, got %d %v", resp.StatusCode, v)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != goproxy.ContentTypeJson {
+		t.Error("Expected the JSON content type, got", ct)
+	}
+	if resp.ContentLength <= 0 {
+		t.Error("Expected a Content-Length, got", resp.ContentLength)
+	}
+
+	resp, err = client.Get(srv.URL + "/badjson")
+	fatalOnErr(err, "client.Get badjson", t)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Error("Expected 500 when marshaling fails, got", resp.StatusCode)
+	}
+
+	resp, err = client.Get(srv.URL + "/redirect")
+	fatalOnErr(err, "client.Get redirect", t)
+	resp.Body.Close()
+	if loc := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || loc != "http://example.com/" {
+		t.Errorf("Expected 302 to http://example.com/, got %d %q", resp.StatusCode, loc)
+	}
+}
+
+func TestCtxUpstreamTLS(t *testing.T) {
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	var state *tls.ConnectionState
+	var beforeSend bool
+	proxy.OnRequest().DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		beforeSend = goproxy.CtxUpstreamTLS(req.Context()) != nil
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		state = goproxy.CtxUpstreamTLS(req.Context())
+		return req, resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if resp := string(getOrFail(https.URL+"/bobo", client, t)); resp != "bobo" {
+		t.Error("Expected bobo, got", resp)
+	}
+	if beforeSend {
+		t.Error("Expected no upstream TLS state before the request is sent")
+	}
+	if state == nil || len(state.PeerCertificates) == 0 {
+		t.Fatal("Expected the TLS state of the origin, got", state)
+	}
+	if !state.PeerCertificates[0].Equal(https.Certificate()) {
+		t.Error("Expected the certificate of the origin server")
+	}
+}
+
+func TestTransportDial(t *testing.T) {
+	var dials int32
+	proxy := goproxy.New()
+	proxy.Tr.Dial = func(network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return net.Dial(network, addr)
+	}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(srv.URL+"/bobo", client, t)
+	getOrFail(https.URL+"/bobo", client, t)
+	if dials != 2 {
+		t.Error("Expected Tr.Dial to dial the origin and the CONNECT target, got", dials)
+	}
+}
+
+func TestCertStoreByCA(t *testing.T) {
+	otherCA, err := goproxy.NewCA(goproxy.KeyTypeECDSA)
+	fatalOnErr(err, "NewCA", t)
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	leaf := func() *x509.Certificate {
+		addr := https.Listener.Addr().String()
+		conn, err := net.Dial("tcp", l.Listener.Addr().String())
+		fatalOnErr(err, "dial proxy", t)
+		defer conn.Close()
+		buf := bufio.NewReader(conn)
+		io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		readConnectResponse(buf)
+		tlsConn := tls.Client(conn, acceptAllCerts)
+		fatalOnErr(tlsConn.Handshake(), "Handshake", t)
+		return tlsConn.ConnectionState().PeerCertificates[0]
+	}
+	if err := leaf().CheckSignatureFrom(goproxy.GoproxyCa.Leaf); err != nil {
+		t.Error("Expected the certificate to be signed by the default CA:", err)
+	}
+	proxy.CA = &otherCA
+	if err := leaf().CheckSignatureFrom(otherCA.Leaf); err != nil {
+		t.Error("Expected the stored certificate of the previous CA not to be reused:", err)
+	}
+}
+
+func TestMitmClosesHandlerBody(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	proxy := goproxy.New()
+	proxy.OnRequest(goproxy.ReqHostIs(srv.Listener.Addr().String())).HandleConnect(goproxy.FuncHttpsHandler(func(req *http.Request, host string) (*http.Request, *goproxy.ConnectAction, string) {
+		return req, goproxy.HTTPMitmConnect, host
+	}))
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		// a threshold of a byte spills the body to a temporary file
+		goproxy.TransformResponseBody(resp, 1, func(dst io.Writer, src io.Reader) error {
+			_, err := io.Copy(dst, src)
+			return err
+		})
+		return req, resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	spilledRemoved := func(what string) {
+		var left []os.DirEntry
+		for i := 0; i < 100; i++ {
+			if left, _ = os.ReadDir(dir); len(left) == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Error("Expected the spilled body of", what, "to be removed, found", left[0].Name())
+	}
+
+	// HTTP MITM, the tunnel is kept open while the file is checked
+	addr := srv.Listener.Addr().String()
+	conn, err := net.Dial("tcp", l.Listener.Addr().String())
+	fatalOnErr(err, "dial proxy", t)
+	defer conn.Close()
+	buf := bufio.NewReader(conn)
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	readConnectResponse(buf)
+	io.WriteString(conn, "GET /bobo HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	resp, err := http.ReadResponse(buf, nil)
+	fatalOnErr(err, "ReadResponse", t)
+	if b := string(readAll(resp.Body, t)); b != "bobo" {
+		t.Error("Expected bobo, got", b)
+	}
+	spilledRemoved("the HTTP MITM response")
+
+	// TLS MITM
+	if resp := string(getOrFail(https.URL+"/bobo", client, t)); resp != "bobo" {
+		t.Error("Expected bobo, got", resp)
+	}
+	spilledRemoved("the TLS MITM response")
+}
+
+func TestLRUMitmDecisionCache(t *testing.T) {
+	cache := goproxy.NewLRUMitmDecisionCache(2)
+	cache.SetMitmDecision("a.com", true)
+	cache.SetMitmDecision("b.com", false)
+	if mitm, ok := cache.MitmDecision("a.com"); !ok || !mitm {
+		t.Error("Expected the decision for a.com to be kept")
+	}
+	cache.SetMitmDecision("c.com", true)
+	if _, ok := cache.MitmDecision("b.com"); ok {
+		t.Error("Expected the least recently used decision to be evicted")
+	}
+	for _, host := range []string{"a.com", "c.com"} {
+		if mitm, ok := cache.MitmDecision(host); !ok || !mitm {
+			t.Error("Expected the recent decision to be kept for", host)
+		}
+	}
+}
+
+func TestAdaptiveMitm(t *testing.T) {
+	cache := goproxy.NewMitmDecisionCache()
+	proxy := goproxy.New()
+	proxy.OnRequest().HandleConnect(goproxy.AdaptiveMitm(cache))
+	proxy.OnResponse().Do(goproxy.LearnMitm(cache, true))
+	unlearn := goproxy.UnlearnMitmOnHandshakeError(cache)
+	unlearned := make(chan bool, 1)
+	proxy.OnMitmHandshakeError = func(connect *http.Request, err error) {
+		unlearn(connect, err)
+		unlearned <- true
+	}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	proxyUrl, _ := url.Parse(l.URL)
+
+	get := func(tlsConfig *tls.Config) (*http.Response, error) {
+		tr := &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyURL(proxyUrl)}
+		defer tr.CloseIdleConnections()
+		req, _ := http.NewRequest("GET", https.URL+"/bobo", nil)
+		resp, err := tr.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	resp, err := get(acceptAllCerts)
+	fatalOnErr(err, "first CONNECT", t)
+	if !resp.TLS.PeerCertificates[0].Equal(https.Certificate()) {
+		t.Error("Expected the first CONNECT, with no decision, to be tunneled")
+	}
+	// the response to a plain request to the same host teaches the cache to eavesdrop it
+	getOrFail(srv.URL+"/bobo", client, t)
+	resp, err = get(acceptAllCerts)
+	fatalOnErr(err, "learned CONNECT", t)
+	if resp.TLS.PeerCertificates[0].Equal(https.Certificate()) {
+		t.Error("Expected the learned decision to eavesdrop the next CONNECT")
+	}
+
+	// a client not trusting the proxy CA fails the handshake, and the decision is flipped
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+	if _, err := get(&tls.Config{RootCAs: roots}); err == nil {
+		t.Error("Expected the eavesdropped handshake to fail")
+	}
+	<-unlearned
+	resp, err = get(&tls.Config{RootCAs: roots})
+	fatalOnErr(err, "CONNECT after the handshake failure", t)
+	if !resp.TLS.PeerCertificates[0].Equal(https.Certificate()) {
+		t.Error("Expected the CONNECT after a handshake failure to be tunneled")
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	sampled := goproxy.SampleRateSeed(0.5, 1)
+	proxy := goproxy.New()
+	proxy.OnRequest(sampled).DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		req.Header.Set("X-Sampled", "1")
+		return req, nil
+	})
+	var nsampled, disagreed int
+	proxy.OnResponse().DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		s := sampled(req)
+		if s {
+			nsampled++
+		}
+		if s != (req.Header.Get("X-Sampled") == "1") {
+			disagreed++
+		}
+		return req, resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	const n = 40
+	for i := 0; i < n; i++ {
+		getOrFail(srv.URL+"/bobo", client, t)
+	}
+	if disagreed > 0 {
+		t.Error("Expected the request and response handlers to agree on every request, disagreed on", disagreed)
+	}
+	if nsampled == 0 || nsampled == n {
+		t.Error("Expected about half of the requests to be sampled, got", nsampled, "of", n)
+	}
+}
@@ -0,0 +1,171 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoProxyProtocol is returned when reading from a connection accepted by a ProxyProtocolListener
+// requiring a PROXY protocol header, if the connection does not start with one.
+var ErrNoProxyProtocol = errors.New("connection does not start with a PROXY protocol header")
+
+var (
+	proxyProtocolV1Prefix  = []byte("PROXY ")
+	proxyProtocolV2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	proxyProtocolV1MaxLine = 107
+	errInvalidProxyHeader  = errors.New("invalid PROXY protocol header")
+)
+
+// ProxyProtocolListener wraps a listener accepting connections from a load balancer speaking the
+// PROXY protocol (v1 or v2), such as HAProxy or AWS NLB. The header is parsed, and the RemoteAddr
+// of accepted connections is the address of the real client, so that req.RemoteAddr, ClientIP and
+// source IP conditions see the real client.
+//
+//	l, err := net.Listen("tcp", ":8080")
+//	...
+//	http.Serve(&goproxy.ProxyProtocolListener{Listener: l, Required: true}, proxy)
+type ProxyProtocolListener struct {
+	net.Listener
+	// Required rejects connections not starting with a PROXY protocol header. If false, such
+	// connections are passed through as is.
+	Required bool
+	// HeaderTimeout bounds the time to wait for the header. If zero, 10 seconds are used.
+	HeaderTimeout time.Duration
+}
+
+// Accept accepts a connection. The PROXY protocol header is read lazily on the first
+// Read or RemoteAddr, so that a slow client would not block accepting connections.
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	timeout := l.HeaderTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &proxyProtocolConn{Conn: c, r: bufio.NewReader(c), required: l.Required, timeout: timeout}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	r          *bufio.Reader
+	required   bool
+	timeout    time.Duration
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.remoteAddr, c.err = readProxyProtocolHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err == ErrNoProxyProtocol && !c.required {
+			c.err = nil
+		}
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader reads a PROXY protocol header from r, and returns the source address
+// it holds. A nil address with no error means the header carries no address (UNKNOWN or LOCAL).
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	if b, err := r.Peek(len(proxyProtocolV2Sig)); err == nil && bytes.Equal(b, proxyProtocolV2Sig) {
+		return readProxyProtocolV2(r)
+	}
+	if b, err := r.Peek(len(proxyProtocolV1Prefix)); err == nil && bytes.Equal(b, proxyProtocolV1Prefix) {
+		return readProxyProtocolV1(r)
+	} else if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return nil, ErrNoProxyProtocol
+}
+
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLine {
+			return nil, errInvalidProxyHeader
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	// PROXY TCP4 src dst srcport dstport
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errInvalidProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Sig)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	verCmd, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if verCmd>>4 != 2 {
+		return nil, errInvalidProxyHeader
+	}
+	// LOCAL command, e.g. health checks of the load balancer itself
+	if verCmd&0xf == 0 {
+		return nil, nil
+	}
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errInvalidProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,61 @@
+package goproxy_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/elazarl/goproxy2"
+)
+
+func acceptWithHeader(header string, required bool, t *testing.T) net.Conn {
+	l, err := net.Listen("tcp", "localhost:0")
+	fatalOnErr(err, "listen", t)
+	defer l.Close()
+	pl := &goproxy.ProxyProtocolListener{Listener: l, Required: required}
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		io.WriteString(c, header+"payload")
+		c.Close()
+	}()
+	c, err := pl.Accept()
+	fatalOnErr(err, "accept", t)
+	return c
+}
+
+func TestProxyProtocol(t *testing.T) {
+	v2 := "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c" + "\x0a\x00\x00\x01" + "\x0a\x00\x00\x02" + "\x30\x39" + "\x00\x50"
+	testCases := []struct {
+		header   string
+		required bool
+		expected string
+	}{
+		{"PROXY TCP4 10.0.0.1 10.0.0.2 12345 80\r\n", true, "10.0.0.1:12345"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 12345 80\r\n", true, "[2001:db8::1]:12345"},
+		{v2, true, "10.0.0.1:12345"},
+		{"", false, ""},
+	}
+	for _, tc := range testCases {
+		c := acceptWithHeader(tc.header, tc.required, t)
+		b, err := ioutil.ReadAll(c)
+		if err != nil || string(b) != "payload" {
+			t.Errorf("header %q: expected payload after header, got %q %v", tc.header, b, err)
+		}
+		if tc.expected != "" && c.RemoteAddr().String() != tc.expected {
+			t.Errorf("header %q: expected remote address %s, got %s", tc.header, tc.expected, c.RemoteAddr())
+		}
+		c.Close()
+	}
+}
+
+func TestProxyProtocolRequired(t *testing.T) {
+	c := acceptWithHeader("", true, t)
+	defer c.Close()
+	if _, err := ioutil.ReadAll(c); err != goproxy.ErrNoProxyProtocol {
+		t.Error("Expected connection without PROXY header to be rejected, got", err)
+	}
+}
@@ -0,0 +1,96 @@
+package goproxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket per key, refilled at perSec tokens per second up to burst
+type rateLimiter struct {
+	perSec float64
+	burst  float64
+	key    func(req *http.Request) string
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimit returns a ReqHandler allowing each client at most perSec requests per second, with
+// bursts of up to burst requests, answering the requests over the limit with 429 Too Many
+// Requests. Clients are told apart by ClientIP.
+//
+//	proxy.OnRequest().Do(goproxy.RateLimit(10, 20))
+func RateLimit(perSec float64, burst int) ReqHandler {
+	return RateLimitBy(perSec, burst, ClientIP)
+}
+
+// RateLimitBy is like RateLimit, but limits the requests of every key returned by key, e.g. the
+// user authenticated by the request, instead of every client IP.
+func RateLimitBy(perSec float64, burst int, key func(req *http.Request) string) ReqHandler {
+	l := &rateLimiter{perSec: perSec, burst: float64(burst), key: key, buckets: make(map[string]*rateBucket)}
+	return FuncReqHandler(func(req *http.Request) (*http.Request, *http.Response) {
+		wait, ok := l.allow(l.key(req), time.Now())
+		if ok {
+			return req, nil
+		}
+		resp := NewResponse(req, ContentTypeText, http.StatusTooManyRequests, "Too Many Requests")
+		resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return req, resp
+	})
+}
+
+// allow takes a token from the bucket of key, and returns whether there was one, or else the
+// time until there is.
+func (l *rateLimiter) allow(key string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.perSec)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if l.perSec <= 0 {
+		return time.Hour, false
+	}
+	return time.Duration((1 - b.tokens) / l.perSec * float64(time.Second)), false
+}
+
+// fillTime is the time it takes an empty bucket to be full
+func (l *rateLimiter) fillTime() time.Duration {
+	if l.perSec <= 0 {
+		return time.Hour
+	}
+	return time.Duration(l.burst / l.perSec * float64(time.Second))
+}
+
+// sweep drops the buckets idle long enough to be full again, they are no different from the
+// buckets of new keys. It runs at most once per fillTime, so memory is bound by the keys seen in
+// that time.
+func (l *rateLimiter) sweep(now time.Time) {
+	idle := l.fillTime()
+	if now.Sub(l.lastSweep) < idle {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= idle {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package goproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterSweep(t *testing.T) {
+	l := &rateLimiter{perSec: 1, burst: 2, buckets: make(map[string]*rateBucket)}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	l.allow("a", now)
+	l.allow("b", now.Add(time.Second))
+	if len(l.buckets) != 2 {
+		t.Fatal("Expected a bucket per key, got", len(l.buckets))
+	}
+	// a is full again, b is not
+	l.allow("c", now.Add(2500*time.Millisecond))
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("Expected the full bucket to be dropped")
+	}
+	if _, ok := l.buckets["b"]; !ok {
+		t.Error("Expected the refilling bucket to be kept")
+	}
+}
@@ -2,8 +2,11 @@ package goproxy
 
 import (
 	"bytes"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 )
 
 // Will generate a valid http response to the given request the response will have
@@ -27,11 +30,67 @@ func NewResponse(r *http.Request, contentType string, status int, body string) *
 	return resp
 }
 
+// NewResponseFromReader generates a response to the given request, whose body is
+// streamed from body instead of being buffered in memory. This is useful for
+// serving large canned responses, such as a file on disk.
+// length is used as the response Content-Length, a length of -1 means the length
+// is unknown, and the response will be sent chunked.
+// The proxy closes body after the response is written to the client.
+//
+//	f, err := os.Open("blocked.html")
+//	...
+//	return nil, NewResponseFromReader(r, http.StatusForbidden, goproxy.ContentTypeHtml, info.Size(), f)
+func NewResponseFromReader(r *http.Request, status int, contentType string, length int64, body io.ReadCloser) *http.Response {
+	resp := &http.Response{}
+	resp.Request = r
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	resp.Header = make(http.Header)
+	resp.Header.Add("Content-Type", contentType)
+	resp.StatusCode = status
+	resp.Status = strconv.Itoa(status) + " " + http.StatusText(status)
+	resp.ContentLength = length
+	if length >= 0 {
+		resp.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	} else {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	resp.Body = body
+	return resp
+}
+
 const (
 	ContentTypeText = "text/plain"
 	ContentTypeHtml = "text/html"
+	ContentTypeJson = "application/json"
 )
 
+// NewJSONResponse generates a response to the given request, whose body is v marshaled to JSON.
+// If v cannot be marshaled, the response is a 500 Internal Server Error with the marshal error.
+//
+//	return req, goproxy.NewJSONResponse(req, http.StatusForbidden, map[string]string{"error": "blocked"})
+func NewJSONResponse(r *http.Request, status int, v interface{}) *http.Response {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return withContentLength(NewResponse(r, ContentTypeText, http.StatusInternalServerError, err.Error()))
+	}
+	return withContentLength(NewResponse(r, ContentTypeJson, status, string(body)))
+}
+
+// NewRedirectResponse generates a response to the given request redirecting the client to
+// location, with the given status, e.g. http.StatusFound. The body is a short text pointing
+// to location, for clients not following redirects.
+func NewRedirectResponse(r *http.Request, status int, location string) *http.Response {
+	resp := NewResponse(r, ContentTypeText, status, "Redirecting to "+location+"\n")
+	resp.Header.Set("Location", location)
+	return withContentLength(resp)
+}
+
+// withContentLength sets the Content-Length header of a response generated by NewResponse
+func withContentLength(resp *http.Response) *http.Response {
+	resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	return resp
+}
+
 // Alias for NewResponse(r,ContentTypeText,http.StatusAccepted,text)
 func TextResponse(r *http.Request, text string) *http.Response {
 	return NewResponse(r, ContentTypeText, http.StatusAccepted, text)
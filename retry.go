@@ -0,0 +1,101 @@
+package goproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// maxRetriedBodySize is the largest request body buffered to be resent by a RetryPolicy
+const maxRetriedBodySize = 1 << 20
+
+// RetryPolicy configures the retries of proxied requests failing to reach their origin server,
+// see ProxyHttpServer.RetryPolicy. Only idempotent requests are retried, and only if the failed
+// attempt did not start writing the request, so the origin server cannot have acted on it.
+// Request bodies of up to 1MB are buffered to be resent, requests with larger bodies, or bodies
+// of unknown length, are retried only if they have a GetBody.
+type RetryPolicy struct {
+	// MaxRetries is the number of times a request is retried
+	MaxRetries int
+	// Backoff, if not nil, returns the time to wait before the given retry, starting at 1
+	Backoff func(attempt int) time.Duration
+	// RetryableError, if not nil, returns whether a request failing with err is retried. By
+	// default, dial errors and connection resets are.
+	RetryableError func(err error) bool
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.RetryableError != nil {
+		return p.RetryableError(err)
+	}
+	return isDialError(err) || errors.Is(err, syscall.ECONNRESET)
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// roundTrip sends req with rt, retrying as configured by proxy.RetryPolicy. The error of the
+// last attempt is returned.
+func (proxy *ProxyHttpServer) roundTrip(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	policy := proxy.RetryPolicy
+	if policy == nil || policy.MaxRetries <= 0 || !isIdempotent(req.Method) || !replayableBody(req) {
+		return rt.RoundTrip(withTimings(req))
+	}
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		var wrote int32
+		trace := &httptrace.ClientTrace{WroteHeaderField: func(string, []string) { atomic.StoreInt32(&wrote, 1) }}
+		resp, err := rt.RoundTrip(withTimings(req.WithContext(httptrace.WithClientTrace(req.Context(), trace))))
+		if err == nil || attempt >= policy.MaxRetries || atomic.LoadInt32(&wrote) != 0 || !policy.retryable(err) {
+			return resp, err
+		}
+		proxy.debugLog(req.Context()).Log("event", "retry", "url", req.URL.String(), "attempt", attempt+1, "error", err.Error())
+		if policy.Backoff != nil {
+			timer := time.NewTimer(policy.Backoff(attempt + 1))
+			select {
+			case <-timer.C:
+			case <-req.Context().Done():
+				timer.Stop()
+				return nil, err
+			}
+		}
+	}
+}
+
+// replayableBody returns whether the body of req can be sent again, buffering it if it is small
+func replayableBody(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return true
+	}
+	if req.ContentLength < 0 || req.ContentLength > maxRetriedBodySize {
+		return false
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		// the body is sent as read, the first attempt fails on it
+		return false
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return true
+}
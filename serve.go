@@ -0,0 +1,96 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Serve accepts connections on l and serves proxy requests on them, like http.Serve, enforcing
+// MaxConnections. It always returns a non nil error, http.ErrServerClosed after Shutdown.
+//
+//	l, err := net.Listen("tcp", ":8080")
+//	...
+//	proxy.MaxConnections = 1000
+//	log.Fatal(proxy.Serve(l))
+func (proxy *ProxyHttpServer) Serve(l net.Listener) error {
+	if proxy.MaxConnections > 0 {
+		l = newLimitListener(l, proxy.MaxConnections)
+	}
+	server := &http.Server{Handler: proxy}
+	proxy.tunnelsMu.Lock()
+	if proxy.shuttingDown {
+		proxy.tunnelsMu.Unlock()
+		return http.ErrServerClosed
+	}
+	proxy.server = server
+	if addr, ok := l.Addr().(*net.TCPAddr); ok && (addr.IP == nil || addr.IP.IsUnspecified()) {
+		proxy.listensOnAll = true
+	}
+	proxy.tunnelsMu.Unlock()
+	return server.Serve(l)
+}
+
+// limitListener accepts a connection only when less than cap(sem) accepted connections are open,
+// new connections wait in the backlog of the listener until then.
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(l net.Listener, n int) *limitListener {
+	return &limitListener{Listener: l, sem: make(chan struct{}, n), done: make(chan struct{})}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	lc := &limitConn{Conn: c, release: func() { <-l.sem }}
+	if _, ok := c.(CloseWriteReader); ok {
+		// CONNECT tunnels half close TCP connections
+		return &limitHalfCloseConn{lc}, nil
+	}
+	return lc, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitConn frees its slot in a limitListener when closed, including after being hijacked for
+// a CONNECT tunnel.
+type limitConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
+
+// limitHalfCloseConn is a limitConn of a connection that can be half closed, like a TCP one
+type limitHalfCloseConn struct {
+	*limitConn
+}
+
+func (c *limitHalfCloseConn) CloseWrite() error {
+	return c.Conn.(CloseWriteReader).CloseWrite()
+}
+
+func (c *limitHalfCloseConn) CloseRead() error {
+	return c.Conn.(CloseWriteReader).CloseRead()
+}
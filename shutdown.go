@@ -0,0 +1,111 @@
+package goproxy
+
+import (
+	"context"
+	"net"
+)
+
+// tunnel tracks the connections of a hijacked CONNECT request, until the goroutines serving it
+// are done.
+type tunnel struct {
+	proxy  *ProxyHttpServer
+	refs   int
+	conns  []net.Conn
+	closed bool
+}
+
+// openTunnel starts tracking the CONNECT tunnel of client. It returns nil if the proxy is
+// shutting down, and the tunnel must not be served.
+func (proxy *ProxyHttpServer) openTunnel(client net.Conn) *tunnel {
+	proxy.tunnelsMu.Lock()
+	defer proxy.tunnelsMu.Unlock()
+	if proxy.shuttingDown {
+		return nil
+	}
+	if proxy.tunnels == nil {
+		proxy.tunnels = make(map[*tunnel]struct{})
+	}
+	t := &tunnel{proxy: proxy, refs: 1, conns: []net.Conn{client}}
+	proxy.tunnels[t] = struct{}{}
+	proxy.tunnelsWG.Add(1)
+	return t
+}
+
+// add tracks c as a connection of the tunnel, it is closed right away if Shutdown already
+// closed the tunnel.
+func (t *tunnel) add(c net.Conn) {
+	t.proxy.tunnelsMu.Lock()
+	defer t.proxy.tunnelsMu.Unlock()
+	if t.closed {
+		c.Close()
+		return
+	}
+	t.conns = append(t.conns, c)
+}
+
+// release drops a reference to the tunnel, when the last one is dropped, the tunnel is done.
+func (t *tunnel) release() {
+	t.proxy.tunnelsMu.Lock()
+	defer t.proxy.tunnelsMu.Unlock()
+	if t.refs--; t.refs == 0 {
+		delete(t.proxy.tunnels, t)
+		t.proxy.tunnelsWG.Done()
+	}
+}
+
+// goTunnel runs f in a goroutine, keeping the tunnel open until it returns
+func (t *tunnel) goTunnel(f func()) {
+	t.proxy.tunnelsMu.Lock()
+	t.refs++
+	t.proxy.tunnelsMu.Unlock()
+	go func() {
+		defer t.release()
+		f()
+	}()
+}
+
+// Shutdown gracefully stops the proxy. New CONNECT requests are answered with 503 Service
+// Unavailable, and, if the proxy is served with proxy.Serve, the listener is closed and idle
+// connections are closed, as in http.Server.Shutdown. It then waits for the open CONNECT tunnels
+// to end. If ctx is done first, the connections of the remaining tunnels are closed, and
+// ctx.Err() is returned.
+// A tunnel passed to a ConnectHijack handler is tracked only until its Hijack function returns,
+// connections it keeps afterwards are neither waited for nor closed. Tunnels whose connections
+// never end, such as idle ConnectAccept tunnels, are only closed once ctx is done, so use a ctx
+// with a deadline.
+func (proxy *ProxyHttpServer) Shutdown(ctx context.Context) error {
+	proxy.tunnelsMu.Lock()
+	proxy.shuttingDown = true
+	server := proxy.server
+	proxy.tunnelsMu.Unlock()
+	if server != nil {
+		if err := server.Shutdown(ctx); err != nil {
+			proxy.closeTunnels()
+			return err
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		proxy.tunnelsWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		proxy.closeTunnels()
+		return ctx.Err()
+	}
+}
+
+// closeTunnels closes the connections of all open tunnels
+func (proxy *ProxyHttpServer) closeTunnels() {
+	proxy.tunnelsMu.Lock()
+	defer proxy.tunnelsMu.Unlock()
+	for t := range proxy.tunnels {
+		t.closed = true
+		for _, c := range t.conns {
+			c.Close()
+		}
+	}
+}
@@ -1,11 +1,16 @@
 package goproxy
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	"math/big"
 	"net"
 	"runtime"
@@ -33,6 +38,19 @@ func hashSortedBigInt(lst []string) *big.Int {
 var goproxySignerVersion = ":goroxy1"
 
 func signHost(ca tls.Certificate, hosts []string) (cert tls.Certificate, err error) {
+	return signHostOpts(ca, hosts, leafOptions{})
+}
+
+// leafOptions customize the certificates signHostOpts signs
+type leafOptions struct {
+	// serial is the serial number of the certificate. If nil, a random one is used.
+	serial *big.Int
+	// template, if not nil, returns the template to sign given the default one.
+	template func(base *x509.Certificate) *x509.Certificate
+}
+
+// signHostOpts signs a certificate for hosts, customized by opts
+func signHostOpts(ca tls.Certificate, hosts []string, opts leafOptions) (cert tls.Certificate, err error) {
 	var x509ca *x509.Certificate
 
 	// Use the provided ca and not the global GoproxyCa for certificate generation.
@@ -45,8 +63,12 @@ func signHost(ca tls.Certificate, hosts []string) (cert tls.Certificate, err err
 		panic(err)
 	}
 	hash := hashSorted(append(hosts, goproxySignerVersion, ":"+runtime.Version()))
-	serial := new(big.Int)
-	serial.SetBytes(hash)
+	serial := opts.serial
+	if serial == nil {
+		if serial, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128)); err != nil {
+			return
+		}
+	}
 	template := x509.Certificate{
 		// TODO(elazar): instead of this ugly hack, just encode the certificate and hash the binary form.
 		SerialNumber: serial,
@@ -68,16 +90,32 @@ func signHost(ca tls.Certificate, hosts []string) (cert tls.Certificate, err err
 			template.DNSNames = append(template.DNSNames, h)
 		}
 	}
+	if _, ok := ca.PrivateKey.(*ecdsa.PrivateKey); ok {
+		// key encipherment is for RSA key exchange only
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+	}
+	tmpl := &template
+	if opts.template != nil {
+		tmpl = opts.template(tmpl)
+	}
 	var csprng CounterEncryptorRand
 	if csprng, err = NewCounterEncryptorRandFromKey(ca.PrivateKey, hash); err != nil {
 		return
 	}
-	var certpriv *rsa.PrivateKey
-	if certpriv, err = rsa.GenerateKey(&csprng, 1024); err != nil {
-		return
+	// the leaf key has the algorithm of the CA key, ECDSA leaves are much cheaper to sign
+	var certpriv crypto.Signer
+	switch ca.PrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		if certpriv, err = ecdsa.GenerateKey(elliptic.P256(), &csprng); err != nil {
+			return
+		}
+	default:
+		if certpriv, err = rsa.GenerateKey(&csprng, 1024); err != nil {
+			return
+		}
 	}
 	var derBytes []byte
-	if derBytes, err = x509.CreateCertificate(&csprng, &template, x509ca, &certpriv.PublicKey, ca.PrivateKey); err != nil {
+	if derBytes, err = x509.CreateCertificate(&csprng, tmpl, x509ca, certpriv.Public(), ca.PrivateKey); err != nil {
 		return
 	}
 	return tls.Certificate{
@@ -85,3 +123,55 @@ func signHost(ca tls.Certificate, hosts []string) (cert tls.Certificate, err err
 		PrivateKey:  certpriv,
 	}, nil
 }
+
+// KeyType is the algorithm of the key of a CA generated with NewCA
+type KeyType int
+
+const (
+	KeyTypeRSA KeyType = iota
+	KeyTypeECDSA
+)
+
+// NewCA generates a self signed CA, with an RSA 2048 or an ECDSA P-256 key, to eavesdrop CONNECT
+// requests with TLSConfigFromCA. The certificates forged with it have keys of the same algorithm.
+// The Leaf of the returned certificate is set.
+func NewCA(keyType KeyType) (tls.Certificate, error) {
+	var priv crypto.Signer
+	var err error
+	switch keyType {
+	case KeyTypeRSA:
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeECDSA:
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		err = errors.New("unknown CA key type")
+	}
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"GoProxy untrusted MITM proxy Inc"},
+			CommonName:   "GoProxy CA",
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, priv.Public(), priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv, Leaf: leaf}, nil
+}
@@ -1,6 +1,7 @@
 package goproxy
 
 import (
+	"crypto/ecdsa"
 	"crypto/tls"
 	"crypto/x509"
 	"io/ioutil"
@@ -85,3 +86,51 @@ func TestSingerX509(t *testing.T) {
 	})
 	orFatal("Verify", err, t)
 }
+
+func TestSignerECDSA(t *testing.T) {
+	ca, err := NewCA(KeyTypeECDSA)
+	orFatal("NewCA", err, t)
+	cert, err := signHost(ca, []string{"example.com", "localhost"})
+	orFatal("singHost", err, t)
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	orFatal("ParseCertificate", err, t)
+	if _, ok := cert.Leaf.PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Errorf("Expected an ECDSA leaf for an ECDSA CA, got %T", cert.Leaf.PublicKey)
+	}
+	certpool := x509.NewCertPool()
+	certpool.AddCert(ca.Leaf)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: certpool})
+	orFatal("Verify", err, t)
+
+	expected := "ECDSA key verifies with Go"
+	server := httptest.NewUnstartedServer(ConstantHanlder(expected))
+	defer server.Close()
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.StartTLS()
+	tr := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: certpool}}
+	req, err := http.NewRequest("GET", strings.Replace(server.URL, "127.0.0.1", "localhost", -1), nil)
+	orFatal("NewRequest", err, t)
+	resp, err := tr.RoundTrip(req)
+	orFatal("RoundTrip", err, t)
+	txt, err := ioutil.ReadAll(resp.Body)
+	orFatal("ioutil.ReadAll", err, t)
+	if string(txt) != expected {
+		t.Errorf("Expected '%s' got '%s'", expected, string(txt))
+	}
+}
+
+func TestSignerECDSAKeyUsageWithTemplate(t *testing.T) {
+	ca, err := NewCA(KeyTypeECDSA)
+	orFatal("NewCA", err, t)
+	var base x509.KeyUsage
+	cert, err := signHostOpts(ca, []string{"example.com"}, leafOptions{template: func(tmpl *x509.Certificate) *x509.Certificate {
+		base = tmpl.KeyUsage
+		return tmpl
+	}})
+	orFatal("signHostOpts", err, t)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	orFatal("ParseCertificate", err, t)
+	if base&x509.KeyUsageKeyEncipherment != 0 || leaf.KeyUsage&x509.KeyUsageKeyEncipherment != 0 {
+		t.Error("Expected no key encipherment usage for an ECDSA leaf, got", base, leaf.KeyUsage)
+	}
+}
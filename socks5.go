@@ -0,0 +1,156 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// socks5 protocol constants, see RFC 1928 and RFC 1929
+const (
+	socks5Version          = 5
+	socks5NoAuth           = 0
+	socks5UserPassAuth     = 2
+	socks5UserPassVersion  = 1
+	socks5Connect          = 1
+	socks5AddrIPv4         = 1
+	socks5AddrDomain       = 3
+	socks5AddrIPv6         = 4
+	socks5ReplySucceeded   = 0
+	socks5DefaultProxyPort = "1080"
+)
+
+var socks5Replies = []string{"succeeded", "general SOCKS server failure", "connection not allowed by ruleset",
+	"network unreachable", "host unreachable", "connection refused", "TTL expired",
+	"command not supported", "address type not supported"}
+
+// newSocks5Dial returns a ConnectDial connecting through the SOCKS5 proxy of u, authenticating
+// with the user and password of u, if any. Host names are resolved by the SOCKS5 proxy.
+func (proxy *ProxyHttpServer) newSocks5Dial(u *url.URL) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		proxyAddr = net.JoinHostPort(u.Hostname(), socks5DefaultProxyPort)
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := proxy.dial(ctx, network, proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			c.SetDeadline(deadline)
+		}
+		if err := socks5Handshake(c, addr, u.User); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.SetDeadline(time.Time{})
+		return c, nil
+	}
+}
+
+// socks5Handshake asks the SOCKS5 proxy at the other end of c to connect to addr
+func socks5Handshake(c net.Conn, addr string, user *url.Userinfo) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("socks5: invalid port %q", portStr)
+	}
+
+	methods := []byte{socks5NoAuth}
+	if user != nil {
+		methods = []byte{socks5UserPassAuth}
+	}
+	if _, err := c.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(c, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("socks5: unexpected version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPassAuth:
+		if user == nil {
+			return errors.New("socks5: proxy requires authentication")
+		}
+		username := user.Username()
+		password, _ := user.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("socks5: username or password too long")
+		}
+		auth := []byte{socks5UserPassVersion, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := c.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("socks5: authentication failed")
+		}
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(append(req, socks5AddrIPv4), ip4...)
+		} else {
+			req = append(append(req, socks5AddrIPv6), ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("socks5: host name too long: %q", host)
+		}
+		req = append(append(req, socks5AddrDomain, byte(len(host))), host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	// version, reply, reserved, address type, and the bound address, which is not used
+	var head [4]byte
+	if _, err := io.ReadFull(c, head[:]); err != nil {
+		return err
+	}
+	if head[1] != socks5ReplySucceeded {
+		msg := "unknown error"
+		if int(head[1]) < len(socks5Replies) {
+			msg = socks5Replies[head[1]]
+		}
+		return fmt.Errorf("socks5: connect to %s failed: %s", addr, msg)
+	}
+	var boundLen int
+	switch head[3] {
+	case socks5AddrIPv4:
+		boundLen = net.IPv4len
+	case socks5AddrIPv6:
+		boundLen = net.IPv6len
+	case socks5AddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			return err
+		}
+		boundLen = int(l[0])
+	default:
+		return fmt.Errorf("socks5: unexpected address type %d", head[3])
+	}
+	_, err = io.ReadFull(c, make([]byte, boundLen+2))
+	return err
+}
@@ -0,0 +1,133 @@
+package goproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// DefaultSpillThreshold is the number of bytes a SpillBuffer keeps in memory when it is created
+// with a threshold of zero
+const DefaultSpillThreshold = 4 << 20
+
+// SpillBuffer buffers the bytes written to it in memory up to a threshold, and in a temporary
+// file past it, so that transforming large bodies does not exhaust the memory of the proxy. Once
+// written, the bytes are read back from it, as a response body. Close removes the temporary file.
+type SpillBuffer struct {
+	threshold int64
+	mem       bytes.Buffer
+	file      *os.File
+	size      int64
+	reading   bool
+}
+
+// NewSpillBuffer returns an empty SpillBuffer keeping up to threshold bytes in memory, or
+// DefaultSpillThreshold bytes if threshold is zero.
+func NewSpillBuffer(threshold int64) *SpillBuffer {
+	if threshold == 0 {
+		threshold = DefaultSpillThreshold
+	}
+	return &SpillBuffer{threshold: threshold}
+}
+
+var errSpillBufferReading = errors.New("goproxy: write to a SpillBuffer already read from")
+
+// Write appends p to the buffer. Writing after the first Read fails.
+func (b *SpillBuffer) Write(p []byte) (int, error) {
+	if b.reading {
+		return 0, errSpillBufferReading
+	}
+	if b.file == nil && b.size+int64(len(p)) > b.threshold {
+		f, err := os.CreateTemp("", "goproxy-spill-")
+		if err != nil {
+			return 0, err
+		}
+		b.file = f
+		if _, err := b.mem.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if b.file != nil {
+		n, err = b.file.Write(p)
+	} else {
+		n, err = b.mem.Write(p)
+	}
+	b.size += int64(n)
+	return n, err
+}
+
+// Len returns the number of bytes written to the buffer
+func (b *SpillBuffer) Len() int64 {
+	return b.size
+}
+
+// Spilled returns whether the buffer exceeded its threshold, and is kept in a temporary file
+func (b *SpillBuffer) Spilled() bool {
+	return b.file != nil
+}
+
+// Read reads the bytes written to the buffer, from the first one.
+func (b *SpillBuffer) Read(p []byte) (int, error) {
+	if !b.reading {
+		b.reading = true
+		if b.file != nil {
+			if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if b.file != nil {
+		return b.file.Read(p)
+	}
+	return b.mem.Read(p)
+}
+
+// Close releases the memory of the buffer, and removes its temporary file, if any.
+func (b *SpillBuffer) Close() error {
+	b.mem = bytes.Buffer{}
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	if rerr := os.Remove(b.file.Name()); err == nil {
+		err = rerr
+	}
+	b.file = nil
+	return err
+}
+
+// TransformResponseBody replaces the body of resp with the one f writes to dst, given the
+// original body as src. The new body is buffered in a SpillBuffer with the given threshold, see
+// NewSpillBuffer, so that f may transform large bodies, and its length is set as the
+// Content-Length of resp. The original body is closed. If f fails, its error is returned, and
+// resp is left with an empty body.
+//
+//	proxy.OnResponse(goproxy.ContentTypeIs("text/csv")).DoFunc(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+//		goproxy.TransformResponseBody(resp, 0, func(dst io.Writer, src io.Reader) error {
+//			_, err := io.Copy(dst, transform.NewReader(src, charmap.ISO8859_1.NewDecoder()))
+//			return err
+//		})
+//		return req, resp
+//	})
+func TransformResponseBody(resp *http.Response, threshold int64, f func(dst io.Writer, src io.Reader) error) error {
+	buf := NewSpillBuffer(threshold)
+	err := f(buf, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		buf.Close()
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+		resp.Header.Set("Content-Length", "0")
+		return err
+	}
+	resp.Body = buf
+	resp.ContentLength = buf.Len()
+	resp.Header.Set("Content-Length", strconv.FormatInt(buf.Len(), 10))
+	resp.TransferEncoding = nil
+	return nil
+}
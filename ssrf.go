@@ -0,0 +1,174 @@
+package goproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResolveCacheTTL is the time a host resolved by DstIsPrivate is kept in its DNS cache
+var ResolveCacheTTL = time.Minute
+
+// ResolveCacheSize is the maximum number of hosts kept in the DNS cache of DstIsPrivate. Clients
+// choose the hosts, so the cache is bounded, not to grow without limit on a public proxy.
+var ResolveCacheSize = 10000
+
+type resolveCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+var resolveCache = struct {
+	sync.Mutex
+	hosts map[string]resolveCacheEntry
+}{hosts: make(map[string]resolveCacheEntry)}
+
+// resolveHost returns the IPs of host, caching the results for ResolveCacheTTL. The lookup is
+// canceled with ctx.
+func resolveHost(ctx context.Context, host string) ([]net.IP, error) {
+	host = strings.Trim(host, "[]")
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	now := time.Now()
+	resolveCache.Lock()
+	entry, ok := resolveCache.hosts[host]
+	resolveCache.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.ips, entry.err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if ctx.Err() != nil {
+		// the request is gone, and the failure says nothing about host
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	resolveCache.Lock()
+	cacheResolved(host, resolveCacheEntry{ips, err, now.Add(ResolveCacheTTL)}, now)
+	resolveCache.Unlock()
+	return ips, err
+}
+
+// cacheResolved adds entry for host to resolveCache, which must be locked. When the cache is full,
+// expired entries are removed, and if none expired, arbitrary ones.
+func cacheResolved(host string, entry resolveCacheEntry, now time.Time) {
+	hosts := resolveCache.hosts
+	if _, ok := hosts[host]; !ok && len(hosts) >= ResolveCacheSize {
+		for h, e := range hosts {
+			if !now.Before(e.expires) {
+				delete(hosts, h)
+			}
+		}
+		for h := range hosts {
+			if len(hosts) < ResolveCacheSize {
+				break
+			}
+			delete(hosts, h)
+		}
+	}
+	hosts[host] = entry
+}
+
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // this network
+		"10.0.0.0/8",     // RFC1918
+		"100.64.0.0/10",  // carrier grade NAT
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link local
+		"172.16.0.0/12",  // RFC1918
+		"192.168.0.0/16", // RFC1918
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"fc00::/7",       // unique local
+		"fe80::/10",      // link local
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// isPrivateIP returns whether ip is a private, loopback or link local address
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// pinnedIPs holds the IPs DstIsPrivate checked for the hosts of a request, see PinCheckedIPs
+type pinnedIPs struct {
+	mu    sync.Mutex
+	hosts map[string][]net.IP
+}
+
+// pinIPs records that ips were checked for host, if the request of the given context pins them
+func pinIPs(ctx context.Context, host string, ips []net.IP) {
+	pinned, ok := ctx.Value(ctxKeyPinnedIPs).(*pinnedIPs)
+	if !ok {
+		return
+	}
+	pinned.mu.Lock()
+	defer pinned.mu.Unlock()
+	pinned.hosts[strings.ToLower(strings.Trim(host, "[]"))] = ips
+}
+
+// ctxPinnedIPs returns the IPs checked for host by the request of the given context, if any
+func ctxPinnedIPs(ctx context.Context, host string) []net.IP {
+	pinned, ok := ctx.Value(ctxKeyPinnedIPs).(*pinnedIPs)
+	if !ok {
+		return nil
+	}
+	pinned.mu.Lock()
+	defer pinned.mu.Unlock()
+	return pinned.hosts[strings.ToLower(strings.Trim(host, "[]"))]
+}
+
+// DstIsPrivate checks whether the destination host of the request resolves to a private (RFC1918,
+// unique local), loopback or link local IP. Use it to keep a public proxy from being used to
+// reach internal services:
+//
+//	proxy.OnRequest(goproxy.DstIsPrivate).HandleConnect(goproxy.AlwaysReject)
+//	proxy.OnRequest(goproxy.DstIsPrivate).DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+//		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "Forbidden")
+//	})
+//
+// Hosts that fail to resolve match, so that they are blocked too, see DstIsPrivateOr.
+// Resolved hosts are cached for ResolveCacheTTL. Set PinCheckedIPs on the proxy, so that the
+// checked IPs are the ones connected to.
+var DstIsPrivate = DstIsPrivateOr(true)
+
+// DstIsPrivateOr returns a ReqCondition like DstIsPrivate, matching hosts that fail to resolve
+// if unresolved is true.
+func DstIsPrivateOr(unresolved bool) ReqConditionFunc {
+	return func(req *http.Request) bool {
+		ips, err := resolveHost(req.Context(), req.URL.Hostname())
+		if err != nil || len(ips) == 0 {
+			return unresolved
+		}
+		pinIPs(req.Context(), req.URL.Hostname(), ips)
+		for _, ip := range ips {
+			if isPrivateIP(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,74 @@
+package goproxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPinCheckedIPs(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("pinned"))
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	// the check resolves the host to the origin IP, while a real lookup fails
+	resolveCache.Lock()
+	resolveCache.hosts["pinned.invalid"] = resolveCacheEntry{[]net.IP{net.ParseIP("127.0.0.1")}, nil, time.Now().Add(time.Hour)}
+	resolveCache.Unlock()
+
+	proxy := New()
+	proxy.NoUpstreamProxy()
+	proxy.PinCheckedIPs = true
+	proxy.OnRequest(DstIsPrivate).DoFunc(func(req *http.Request) (*http.Request, *http.Response) {
+		return req, nil
+	})
+	req := httptest.NewRequest("GET", "http://pinned.invalid:"+port+"/", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if b, _ := ioutil.ReadAll(w.Body); string(b) != "pinned" {
+		t.Error("Expected the proxy to dial the checked IP, got", w.Code, string(b))
+	}
+}
+
+func TestResolveCacheBounded(t *testing.T) {
+	defer func(size int) { ResolveCacheSize = size }(ResolveCacheSize)
+	ResolveCacheSize = 3
+	resolveCache.Lock()
+	defer resolveCache.Unlock()
+	saved := resolveCache.hosts
+	defer func() { resolveCache.hosts = saved }()
+	resolveCache.hosts = make(map[string]resolveCacheEntry)
+
+	now := time.Now()
+	cacheResolved("expired.invalid", resolveCacheEntry{expires: now.Add(-time.Second)}, now)
+	for i := 0; i < 10; i++ {
+		cacheResolved(fmt.Sprint("host", i, ".invalid"), resolveCacheEntry{expires: now.Add(time.Hour)}, now)
+		if n := len(resolveCache.hosts); n > ResolveCacheSize {
+			t.Fatal("Expected the cache to keep at most", ResolveCacheSize, "hosts, got", n)
+		}
+	}
+	if _, ok := resolveCache.hosts["host9.invalid"]; !ok {
+		t.Error("Expected the last resolved host to be cached")
+	}
+}
+
+func TestResolveHostCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := resolveHost(ctx, "canceled.invalid"); err == nil {
+		t.Error("Expected the lookup to fail with a canceled context")
+	}
+	resolveCache.Lock()
+	_, ok := resolveCache.hosts["canceled.invalid"]
+	resolveCache.Unlock()
+	if ok {
+		t.Error("Expected a canceled lookup not to be cached")
+	}
+}
@@ -0,0 +1,64 @@
+package goproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// throttledReader reads at most bytesPerSec bytes per second, using a token bucket
+type throttledReader struct {
+	ctx         context.Context
+	r           io.Reader
+	bytesPerSec int
+	tokens      float64
+	last        time.Time
+}
+
+// NewThrottledReader returns a reader reading from r at most bytesPerSec bytes per second, to
+// simulate slow links. Waiting for the rate stops with an error when ctx is done.
+func NewThrottledReader(ctx context.Context, r io.Reader, bytesPerSec int) io.Reader {
+	return &throttledReader{ctx: ctx, r: r, bytesPerSec: bytesPerSec, last: time.Now()}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// read in slices of a tenth of a second, for a smooth rate
+	if max := t.bytesPerSec/10 + 1; len(p) > max {
+		p = p[:max]
+	}
+	n, err := t.r.Read(p)
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * float64(t.bytesPerSec)
+	if t.tokens > float64(t.bytesPerSec) {
+		t.tokens = float64(t.bytesPerSec)
+	}
+	t.last = now
+	t.tokens -= float64(n)
+	if t.tokens < 0 {
+		wait := time.Duration(-t.tokens / float64(t.bytesPerSec) * float64(time.Second))
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// ThrottleResponse returns a RespHandler sending response bodies to the client at most
+// bytesPerSec bytes per second, e.g. to test how applications behind the proxy handle slow links.
+// To throttle CONNECT tunnels, see ConnectAction.BytesPerSec.
+//
+//	proxy.OnResponse(goproxy.UrlHasPrefix("example.com/")).Do(goproxy.ThrottleResponse(50 * 1024))
+func ThrottleResponse(bytesPerSec int) RespHandler {
+	return FuncRespHandler(func(req *http.Request, resp *http.Response) (*http.Request, *http.Response) {
+		if resp == nil || resp.Body == nil {
+			return req, resp
+		}
+		resp.Body = readCloser{NewThrottledReader(req.Context(), resp.Body, bytesPerSec), resp.Body}
+		return req, resp
+	})
+}
@@ -0,0 +1,36 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// withRequestTimeout returns req with a context ending after proxy.RequestTimeout, if set. The
+// deadline lasts until the request is finished, so it also covers copying the response body.
+func (proxy *ProxyHttpServer) withRequestTimeout(req *http.Request) *http.Request {
+	if proxy.RequestTimeout <= 0 {
+		return req
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), proxy.RequestTimeout)
+	// the timer is released once the request is finished, or by the deadline at the latest
+	CtxOnFinish(ctx, cancel)
+	return req.WithContext(ctx)
+}
+
+// isTimeout returns whether err is the result of a deadline, rather than of a failure of the
+// origin server
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// gatewayErrorStatus returns the status answering a request whose origin server failed with err,
+// 504 Gateway Timeout if it timed out, and 502 Bad Gateway otherwise
+func gatewayErrorStatus(err error) int {
+	if isTimeout(err) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
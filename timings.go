@@ -0,0 +1,88 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings is the breakdown of the time it took to get the response to a request from the origin
+// server. Phases that did not happen, e.g. the DNS lookup of an IP, or all of them for a reused
+// connection, are zero.
+type Timings struct {
+	DNSLookup    time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	// TimeToFirstByte is the time from starting to send the request, including getting a
+	// connection, to reading the first byte of the response.
+	TimeToFirstByte time.Duration
+	ConnReused      bool
+}
+
+// timingsRecorder collects the Timings of a request, from the callbacks of an httptrace.ClientTrace
+type timingsRecorder struct {
+	mu                                   sync.Mutex
+	t                                    Timings
+	start, dnsStart, connStart, tlsStart time.Time
+}
+
+// CtxTimings returns the timings of sending the request of the given context to the origin server
+// so far. Call it in response handlers, or in callbacks registered with CtxOnFinish. It returns
+// zero Timings for requests that were not sent, e.g. answered by request handlers.
+func CtxTimings(ctx context.Context) Timings {
+	rec, ok := ctx.Value(ctxKeyTimings).(*timingsRecorder)
+	if !ok {
+		return Timings{}
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.t
+}
+
+// withTimings returns req traced to record its timings, see CtxTimings
+func withTimings(req *http.Request) *http.Request {
+	rec, ok := req.Context().Value(ctxKeyTimings).(*timingsRecorder)
+	if !ok {
+		return req
+	}
+	since := func(start time.Time) time.Duration {
+		if start.IsZero() {
+			return 0
+		}
+		return time.Since(start)
+	}
+	locked := func(f func()) {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		f()
+	}
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) { locked(func() { rec.start = time.Now() }) },
+		GotConn: func(info httptrace.GotConnInfo) { locked(func() { rec.t.ConnReused = info.Reused }) },
+		DNSStart: func(httptrace.DNSStartInfo) {
+			locked(func() { rec.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			locked(func() { rec.t.DNSLookup = since(rec.dnsStart) })
+		},
+		ConnectStart: func(string, string) {
+			locked(func() { rec.connStart = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			locked(func() { rec.t.Connect = since(rec.connStart) })
+		},
+		TLSHandshakeStart: func() {
+			locked(func() { rec.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			locked(func() { rec.t.TLSHandshake = since(rec.tlsStart) })
+		},
+		GotFirstResponseByte: func() {
+			locked(func() { rec.t.TimeToFirstByte = since(rec.start) })
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
@@ -0,0 +1,38 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+)
+
+// upstreamTLS holds the TLS connection state of the origin server of a request
+type upstreamTLS struct {
+	mu    sync.Mutex
+	state *tls.ConnectionState
+}
+
+// CtxUpstreamTLS returns the TLS connection state of the origin server the request of the given
+// context, eavesdropped in a TLS CONNECT tunnel, was sent to. It holds the certificate chain of
+// the origin, the negotiated TLS version and cipher suite, e.g. for pinning certificates or
+// detecting downgrades. Call it in response handlers, or in callbacks registered with
+// CtxOnFinish. It returns nil for requests that were not sent to an origin over TLS.
+func CtxUpstreamTLS(ctx context.Context) *tls.ConnectionState {
+	u, ok := ctx.Value(ctxKeyUpstreamTLS).(*upstreamTLS)
+	if !ok {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.state
+}
+
+// recordUpstreamTLS records state as the TLS connection state of the origin server of the
+// request of the given context, see CtxUpstreamTLS.
+func recordUpstreamTLS(ctx context.Context, state *tls.ConnectionState) {
+	if u, ok := ctx.Value(ctxKeyUpstreamTLS).(*upstreamTLS); ok {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		u.state = state
+	}
+}
@@ -0,0 +1,263 @@
+package goproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// maxInspectedWebSocketFrame is the largest WebSocket frame payload passed to WebSocketHandlers,
+// larger frames are forwarded without being inspected.
+const maxInspectedWebSocketFrame = 16 << 20
+
+// WebSocketFrame is a frame of a WebSocket connection eavesdropped in a CONNECT tunnel
+type WebSocketFrame struct {
+	// FromClient is true for frames sent by the client, and false for frames sent by the server
+	FromClient bool
+	Fin        bool
+	Opcode     byte
+	// Payload is the unmasked payload of the frame
+	Payload []byte
+}
+
+// WebSocketHandler inspects the frames of WebSocket connections. req is the upgrade request.
+// Frames are forwarded unmodified once the handlers returned.
+type WebSocketHandler interface {
+	HandleFrame(req *http.Request, frame *WebSocketFrame)
+}
+
+// FuncWebSocketHandler is a function implementing WebSocketHandler
+type FuncWebSocketHandler func(req *http.Request, frame *WebSocketFrame)
+
+func (f FuncWebSocketHandler) HandleFrame(req *http.Request, frame *WebSocketFrame) {
+	f(req, frame)
+}
+
+type webSocketHandler struct {
+	conds []ReqCondition
+	h     WebSocketHandler
+}
+
+// WebSocketConds registers WebSocketHandlers for WebSocket connections whose upgrade request
+// meets all the conditions.
+type WebSocketConds struct {
+	proxy *ProxyHttpServer
+	conds []ReqCondition
+}
+
+// OnWebSocket is used to inspect the frames of WebSocket connections eavesdropped in TLS MITM
+// CONNECT tunnels, whose upgrade requests meet all the given conditions.
+//
+//	proxy.OnWebSocket(goproxy.ReqHostIs("chat.example.com")).DoFunc(func(req *http.Request, frame *goproxy.WebSocketFrame) {
+//		log.Printf("%v %s", frame.FromClient, frame.Payload)
+//	})
+func (proxy *ProxyHttpServer) OnWebSocket(conds ...ReqCondition) *WebSocketConds {
+	return &WebSocketConds{proxy, conds}
+}
+
+// Do registers h to inspect the frames of WebSocket connections meeting the conditions.
+// SetHandlers does not replace WebSocketHandlers.
+func (c *WebSocketConds) Do(h WebSocketHandler) {
+	c.proxy.handlersMu.Lock()
+	defer c.proxy.handlersMu.Unlock()
+	c.proxy.wsHandlers = append(c.proxy.wsHandlers, webSocketHandler{c.conds, h})
+}
+
+// DoFunc is equivalent to Do(FuncWebSocketHandler(f))
+func (c *WebSocketConds) DoFunc(f func(req *http.Request, frame *WebSocketFrame)) {
+	c.Do(FuncWebSocketHandler(f))
+}
+
+// matchingWebSocketHandlers returns the WebSocketHandlers whose conditions req meets
+func (proxy *ProxyHttpServer) matchingWebSocketHandlers(req *http.Request) []WebSocketHandler {
+	proxy.handlersMu.RLock()
+	all := proxy.wsHandlers
+	proxy.handlersMu.RUnlock()
+	var handlers []WebSocketHandler
+outer:
+	for _, wh := range all {
+		for _, cond := range wh.conds {
+			if !cond.HandleReq(req) {
+				continue outer
+			}
+		}
+		handlers = append(handlers, wh.h)
+	}
+	return handlers
+}
+
+// isWebSocketUpgrade returns whether req asks to switch the connection to the WebSocket protocol
+func isWebSocketUpgrade(req *http.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade") && headerHasToken(req.Header, "Upgrade", "websocket")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveWebSocket forwards the WebSocket upgrade request req, read from client in the TLS MITM
+// tunnel of connect to host, to the origin server, and once it switched protocols, copies the
+// frames between them until either side closes. clientReader buffers the reads from client.
+func (proxy *ProxyHttpServer) serveWebSocket(connect *http.Request, host string, client net.Conn, clientReader *bufio.Reader, req *http.Request) {
+	targetConn, err := proxy.connectDial(req.Context(), connect, "tcp", host)
+	proxy.MITMEvents.originDial(connect, host, err)
+	if err != nil {
+		proxy.Loggers.Error.Log("event", "WebSocket dial", "host", host, "error", err.Error())
+		proxy.writeGatewayError(client, req, err)
+		return
+	}
+	defer targetConn.Close()
+	var config *tls.Config
+	if proxy.Tr.TLSClientConfig != nil {
+		config = proxy.Tr.TLSClientConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName = stripPort(host)
+	}
+	// the upgrade is defined for HTTP/1.1 only
+	config.NextProtos = []string{"http/1.1"}
+	target := tls.Client(targetConn, config)
+	targetReader := bufio.NewReader(target)
+	if err := req.Write(target); err != nil {
+		proxy.Loggers.Error.Log("event", "WebSocket write upgrade", "host", host, "error", err.Error())
+		proxy.writeGatewayError(client, req, err)
+		return
+	}
+	resp, err := http.ReadResponse(targetReader, req)
+	if err != nil {
+		proxy.Loggers.Error.Log("event", "WebSocket read upgrade response", "host", host, "error", err.Error())
+		proxy.writeGatewayError(client, req, err)
+		return
+	}
+	req, resp = proxy.filterResponse(req, resp)
+	resp = proxy.validResponse(req, resp)
+	switched := resp.StatusCode == http.StatusSwitchingProtocols
+	if !switched {
+		resp.Close = true
+	}
+	err = resp.Write(client)
+	resp.Body.Close()
+	if err != nil || !switched {
+		return
+	}
+	proxy.debugLog(req.Context()).Log("event", "WebSocket", "host", host)
+
+	handlers := proxy.matchingWebSocketHandlers(req)
+	done := make(chan struct{}, 2)
+	go func() {
+		proxy.copyWebSocket(target, clientReader, req, true, handlers)
+		done <- struct{}{}
+	}()
+	go func() {
+		proxy.copyWebSocket(client, targetReader, req, false, handlers)
+		done <- struct{}{}
+	}()
+	// either side closing ends the connection
+	<-done
+	client.Close()
+	target.Close()
+	<-done
+}
+
+// copyWebSocket copies the frames read from src to dst, passing them to handlers first
+func (proxy *ProxyHttpServer) copyWebSocket(dst io.Writer, src io.Reader, req *http.Request, fromClient bool, handlers []WebSocketHandler) {
+	if len(handlers) == 0 {
+		proxy.copyOrWarn(dst, src)
+		return
+	}
+	for {
+		frame, header, err := readWebSocketFrameHeader(src)
+		if err != nil {
+			return
+		}
+		frame.FromClient = fromClient
+		if frame.payloadLength > maxInspectedWebSocketFrame {
+			if _, err := dst.Write(header); err != nil {
+				return
+			}
+			if _, err := io.CopyN(dst, src, int64(frame.payloadLength)); err != nil {
+				return
+			}
+			continue
+		}
+		payload := make([]byte, frame.payloadLength)
+		if _, err := io.ReadFull(src, payload); err != nil {
+			return
+		}
+		// handlers get a copy, so that changing it doesn't change the forwarded frame
+		frame.Payload = make([]byte, len(payload))
+		copy(frame.Payload, payload)
+		if frame.mask != nil {
+			for i := range payload {
+				frame.Payload[i] ^= frame.mask[i%4]
+			}
+		}
+		for _, h := range handlers {
+			h.HandleFrame(req, &frame.WebSocketFrame)
+		}
+		if _, err := dst.Write(append(header, payload...)); err != nil {
+			return
+		}
+	}
+}
+
+// webSocketFrameHeader is a parsed WebSocket frame header
+type webSocketFrameHeader struct {
+	WebSocketFrame
+	payloadLength uint64
+	mask          []byte
+}
+
+// readWebSocketFrameHeader reads a frame header from r, and returns it parsed and raw
+func readWebSocketFrameHeader(r io.Reader) (*webSocketFrameHeader, []byte, error) {
+	header := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	frame := &webSocketFrameHeader{}
+	frame.Fin = header[0]&0x80 != 0
+	frame.Opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	extra := 0
+	switch header[1] & 0x7f {
+	case 126:
+		extra = 2
+	case 127:
+		extra = 8
+	}
+	if masked {
+		extra += 4
+	}
+	header = header[:2+extra]
+	if _, err := io.ReadFull(r, header[2:]); err != nil {
+		return nil, nil, err
+	}
+	rest := header[2:]
+	switch header[1] & 0x7f {
+	case 126:
+		frame.payloadLength = uint64(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+	case 127:
+		frame.payloadLength = binary.BigEndian.Uint64(rest)
+		rest = rest[8:]
+	default:
+		frame.payloadLength = uint64(header[1] & 0x7f)
+	}
+	if masked {
+		frame.mask = rest[:4]
+	}
+	return frame, header, nil
+}